@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// fields replaced with a pseudonym, so an anonymized device's records still group together
+var pseudonymizedFields = []string{"deviceId"}
+
+// fields that identify the device and are removed from records and their payloads
+var identifyingFields = []string{"deviceSerialNumber", "serialNumber", "transmitterId", "receiverId"}
+
+// newAnonymizer returns the processor used for research exports. It swaps deviceIds for pseudonyms made
+// with a keyed hash, so they are the same in every record and export made with the key but can't be
+// reversed without it, and removes serial numbers
+func newAnonymizer(key string) RecordProcessor {
+	pseudonym := func(value string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))[:32]
+	}
+
+	return RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		for _, field := range pseudonymizedFields {
+			if value, ok := record[field].(string); ok {
+				record[field] = pseudonym(value)
+			}
+		}
+		payload, _ := record["payload"].(map[string]interface{})
+		for _, field := range identifyingFields {
+			delete(record, field)
+			delete(payload, field)
+		}
+		return record, nil
+	})
+}
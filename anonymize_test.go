@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAnonymizer(t *testing.T) {
+	anonymizer := newAnonymizer("research-key")
+
+	process := func(record map[string]interface{}) map[string]interface{} {
+		processed, err := anonymizer.Process(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return processed
+	}
+
+	first := process(map[string]interface{}{
+		"type":               "cbg",
+		"deviceId":           "DexG4Rec_SM12345678",
+		"deviceSerialNumber": "SM12345678",
+		"payload":            map[string]interface{}{"serialNumber": "SM12345678", "transmitterId": "6XXXXX", "trend": "flat"},
+	})
+	second := process(map[string]interface{}{"type": "cbg", "deviceId": "DexG4Rec_SM12345678"})
+	other := process(map[string]interface{}{"type": "cbg", "deviceId": "OmniPod_4242"})
+
+	pseudonym, _ := first["deviceId"].(string)
+	if pseudonym == "" || pseudonym == "DexG4Rec_SM12345678" {
+		t.Fatalf("expected the deviceId to be replaced but got [%s]", pseudonym)
+	}
+	if second["deviceId"] != pseudonym {
+		t.Fatalf("expected the same deviceId to get the same pseudonym but got [%s] and [%s]", pseudonym, second["deviceId"])
+	}
+	if other["deviceId"] == pseudonym {
+		t.Fatal("expected different deviceIds to get different pseudonyms")
+	}
+	if anotherKey, _ := newAnonymizer("other-key").Process(map[string]interface{}{"deviceId": "DexG4Rec_SM12345678"}); anotherKey["deviceId"] == pseudonym {
+		t.Fatal("expected the pseudonym to depend on the key")
+	}
+
+	if _, ok := first["deviceSerialNumber"]; ok {
+		t.Fatal("expected deviceSerialNumber to be removed")
+	}
+	payload := first["payload"].(map[string]interface{})
+	if _, ok := payload["serialNumber"]; ok {
+		t.Fatal("expected the payload serialNumber to be removed")
+	}
+	if _, ok := payload["transmitterId"]; ok {
+		t.Fatal("expected the payload transmitterId to be removed")
+	}
+	if payload["trend"] != "flat" || first["type"] != "cbg" {
+		t.Fatalf("expected the other fields to be kept but got %v", first)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"regexp"
+)
+
+// anything that could make an entry name a path, or awkward to unzip, is replaced in the type it's named for
+var unsafeEntryName = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// zipEntryName is the name of the entry holding objType's records. Types come straight from the database so
+// are made safe to use as a file name
+func zipEntryName(objType string) string {
+	name := unsafeEntryName.ReplaceAllString(objType, "_")
+	if name == "" {
+		name = "_"
+	}
+	return name + ".ndjson"
+}
+
+// writeZipArchive streams a zip holding a <type>.ndjson entry for each type, with that type's records
+// one per line written as processResults would, going through the processors, local time, time zone,
+// rounding and field order in opts. Each entry is written as its records are read so only one record
+// is in memory at a time
+func writeZipArchive(w io.Writer, types []string, opts resultOptions, iterFor func(objType string) resultIter) error {
+	archive := zip.NewWriter(w)
+
+	for _, objType := range types {
+		entry, err := archive.Create(zipEntryName(objType))
+		if err != nil {
+			return err
+		}
+
+		iter := iterFor(objType)
+		var record map[string]interface{}
+		for iter.Next(&record) {
+			processed, err := processRecord(record, opts.processors)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			if processed == nil {
+				continue
+			}
+			opts.formatRecord(processed)
+			bytes, err := marshalOrdered(processed, opts.fieldOrder)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			if _, err := entry.Write(append(bytes, '\n')); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWriteZipArchive(t *testing.T) {
+	data := map[string][]map[string]interface{}{
+		"cbg":  {{"type": "cbg", "value": 101}, {"type": "cbg", "value": 105}},
+		"smbg": {{"type": "smbg", "value": 5.5}},
+	}
+
+	var buffer bytes.Buffer
+	err := writeZipArchive(&buffer, []string{"cbg", "smbg"}, resultOptions{}, func(objType string) resultIter {
+		return &testIter{records: data[objType]}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"cbg.ndjson":  "{\"type\":\"cbg\",\"value\":101}\n{\"type\":\"cbg\",\"value\":105}\n",
+		"smbg.ndjson": "{\"type\":\"smbg\",\"value\":5.5}\n",
+	}
+	if len(archive.File) != len(expected) {
+		t.Fatalf("expected %d entries but got %d", len(expected), len(archive.File))
+	}
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected[file.Name] {
+			t.Fatalf("expected %s to contain %q but got %q", file.Name, expected[file.Name], contents)
+		}
+	}
+}
+
+func TestWriteZipArchive_iterError(t *testing.T) {
+	var buffer bytes.Buffer
+	err := writeZipArchive(&buffer, []string{"cbg"}, resultOptions{}, func(objType string) resultIter {
+		return &testIter{err: errors.New("cursor lost")}
+	})
+	if err == nil {
+		t.Fatal("should have returned the iterator error")
+	}
+}
+
+func TestWriteZipArchive_formatsRecords(t *testing.T) {
+	records := []map[string]interface{}{{"value": 5.550847, "type": "smbg", "id": "a1"}}
+
+	var buffer bytes.Buffer
+	opts := resultOptions{fieldOrder: []string{"type", "value"}, valueDecimals: map[string]int{"value": 1}}
+	err := writeZipArchive(&buffer, []string{"smbg"}, opts, func(objType string) resultIter {
+		return &testIter{records: records}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := archive.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if expected := "{\"type\":\"smbg\",\"value\":5.6,\"id\":\"a1\"}\n"; string(contents) != expected {
+		t.Fatalf("expected the record rounded and in field order as %q but got %q", expected, contents)
+	}
+}
+
+func TestZipEntryName(t *testing.T) {
+	for objType, expected := range map[string]string{
+		"cbg":              "cbg.ndjson",
+		"pump-settings":    "pump-settings.ndjson",
+		"../../etc/passwd": "______etc_passwd.ndjson",
+		"a b/c\\d":         "a_b_c_d.ndjson",
+		"":                 "_.ndjson",
+	} {
+		if name := zipEntryName(objType); name != expected {
+			t.Errorf("[%s]: expected %s but got %s", objType, expected, name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"time"
+)
+
+// basalCollapser is a resultIter that merges runs of basal segments delivering the same rate into one
+// segment, as devices report a new segment every time the schedule or a temp basal is evaluated even when
+// nothing changes. It reads one basal ahead to see whether the run continues, so the objects have to come
+// in time order. Other objects read while a run is being merged are held back and returned after it, so the
+// output stays in time order; a long run with many objects inside it holds them all in memory until it ends
+type basalCollapser struct {
+	iter    resultIter
+	pending map[string]interface{}
+	//objects that started after the pending basal, returned once it's done
+	held []map[string]interface{}
+	//objects ready to be returned, in order
+	ready []map[string]interface{}
+}
+
+func collapseBasals(iter resultIter) *basalCollapser {
+	return &basalCollapser{iter: iter}
+}
+
+func (c *basalCollapser) Next(result interface{}) bool {
+	out := result.(*map[string]interface{})
+	for {
+		if len(c.ready) > 0 {
+			*out, c.ready = c.ready[0], c.ready[1:]
+			return true
+		}
+
+		//a fresh map each time as the driver decodes into the same map unless it's reset
+		var record map[string]interface{}
+		if !c.iter.Next(&record) {
+			if c.pending == nil {
+				return false
+			}
+			c.release(nil)
+			continue
+		}
+
+		if record["type"] != "basal" {
+			if c.pending == nil {
+				*out = record
+				return true
+			}
+			c.held = append(c.held, record)
+			continue
+		}
+		if c.pending == nil {
+			c.pending = record
+			continue
+		}
+		if continuesBasal(c.pending, record) {
+			duration, _ := numberValue(c.pending["duration"])
+			next, _ := numberValue(record["duration"])
+			c.pending["duration"] = duration + next
+			continue
+		}
+		c.release(record)
+	}
+}
+
+// release readies the pending basal then the objects held behind it, and makes next the pending basal
+func (c *basalCollapser) release(next map[string]interface{}) {
+	c.ready = append(append(c.ready, c.pending), c.held...)
+	c.pending, c.held = next, nil
+}
+
+func (c *basalCollapser) Close() error {
+	return c.iter.Close()
+}
+
+// continuesBasal reports whether next starts as the segment ends and delivers the same rate in the same way
+func continuesBasal(segment, next map[string]interface{}) bool {
+	if segment["deliveryType"] != next["deliveryType"] || segment["rate"] != next["rate"] {
+		return false
+	}
+	duration, ok := numberValue(segment["duration"])
+	if _, nextOk := numberValue(next["duration"]); !ok || !nextOk {
+		return false
+	}
+	segmentTime, _ := segment["time"].(string)
+	nextTime, _ := next["time"].(string)
+	segmentStart, err := time.Parse(time.RFC3339Nano, segmentTime)
+	if err != nil {
+		return false
+	}
+	nextStart, err := time.Parse(time.RFC3339Nano, nextTime)
+	if err != nil {
+		return false
+	}
+	return segmentStart.Add(time.Duration(duration) * time.Millisecond).Equal(nextStart)
+}
+
+func numberValue(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case float64:
+		return number, true
+	}
+	return 0, false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollapseBasals(t *testing.T) {
+	basal := func(time string, duration int, rate float64, deliveryType string) map[string]interface{} {
+		return map[string]interface{}{"type": "basal", "time": time, "duration": duration, "rate": rate, "deliveryType": deliveryType}
+	}
+	iter := collapseBasals(&testIter{records: []map[string]interface{}{
+		basal("2015-10-10T00:00:00Z", 1800000, 0.5, "scheduled"),
+		basal("2015-10-10T00:30:00Z", 1800000, 0.5, "scheduled"),
+		{"type": "cbg", "time": "2015-10-10T00:45:00Z", "value": 101},
+		basal("2015-10-10T01:00:00Z", 3600000, 0.5, "scheduled"),
+		//rate change
+		basal("2015-10-10T02:00:00Z", 1800000, 0.75, "scheduled"),
+		//same rate but a temp basal
+		basal("2015-10-10T02:30:00Z", 1800000, 0.75, "temp"),
+		//same rate but after a gap
+		basal("2015-10-10T03:30:00Z", 1800000, 0.75, "temp"),
+		basal("2015-10-10T04:00:00Z", 1800000, 0.75, "temp"),
+	}})
+
+	found := []map[string]interface{}{}
+	var record map[string]interface{}
+	for iter.Next(&record) {
+		found = append(found, record)
+		record = nil
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []map[string]interface{}{
+		{"type": "basal", "time": "2015-10-10T00:00:00Z", "duration": 7200000.0, "rate": 0.5, "deliveryType": "scheduled"},
+		{"type": "cbg", "time": "2015-10-10T00:45:00Z", "value": 101},
+		basal("2015-10-10T02:00:00Z", 1800000, 0.75, "scheduled"),
+		basal("2015-10-10T02:30:00Z", 1800000, 0.75, "temp"),
+		{"type": "basal", "time": "2015-10-10T03:30:00Z", "duration": 3600000.0, "rate": 0.75, "deliveryType": "temp"},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected\n%v\nbut got\n%v", expected, found)
+	}
+}
+
+func TestCollapseBasals_empty(t *testing.T) {
+	var record map[string]interface{}
+	if collapseBasals(&testIter{}).Next(&record) {
+		t.Fatalf("expected no records but got %v", record)
+	}
+}
+
+func TestCollapseBasals_timeOrder(t *testing.T) {
+	iter := collapseBasals(&testIter{records: []map[string]interface{}{
+		{"type": "basal", "time": "2015-10-10T00:00:00Z", "duration": 1800000, "rate": 0.5, "deliveryType": "scheduled"},
+		{"type": "cbg", "time": "2015-10-10T00:05:00Z", "value": 101},
+		{"type": "smbg", "time": "2015-10-10T00:10:00Z", "value": 99},
+		{"type": "basal", "time": "2015-10-10T00:30:00Z", "duration": 1800000, "rate": 0.5, "deliveryType": "scheduled"},
+		{"type": "cbg", "time": "2015-10-10T00:35:00Z", "value": 102},
+	}})
+
+	times := []string{}
+	var record map[string]interface{}
+	for iter.Next(&record) {
+		times = append(times, record["time"].(string))
+		record = nil
+	}
+	expected := []string{"2015-10-10T00:00:00Z", "2015-10-10T00:05:00Z", "2015-10-10T00:10:00Z", "2015-10-10T00:35:00Z"}
+	if !reflect.DeepEqual(times, expected) {
+		t.Fatalf("expected the merged basal first then the rest in time order %v but got %v", expected, times)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// the most users one POST /data request can ask for when maxBatchUsers isn't configured
+const DEFAULT_MAX_BATCH_USERS = 20
+
+// how many of a POST /data request's users are queried at once when batchConcurrency isn't configured
+const DEFAULT_BATCH_CONCURRENCY = 4
+
+// the largest POST /data body read, far more than a request's ids and filters need
+const MAX_BATCH_BODY = 64 * 1024
+
+// the body of a POST /data request: the users to fetch and the filters applied to each, which are the
+// /{userID} params of the same names
+type batchRequest struct {
+	UserIds   []string `json:"userIds"`
+	Type      string   `json:"type"`
+	SubType   string   `json:"subtype"`
+	StartDate string   `json:"startdate"`
+	EndDate   string   `json:"enddate"`
+}
+
+// values returns the filters as the query params getParams reads, so they're checked the same way
+func (b batchRequest) values() url.Values {
+	q := url.Values{}
+	for param, value := range map[string]string{"type": b.Type, "subtype": b.SubType, "startdate": b.StartDate, "enddate": b.EndDate} {
+		if value != "" {
+			q.Set(param, value)
+		}
+	}
+	return q
+}
+
+// batchPart is one user's part of a POST /data response, read into memory by a worker while the users before
+// it are still being written. done is closed once it's complete
+type batchPart struct {
+	body bytes.Buffer
+	done chan struct{}
+}
+
+// returned by writeBatchData when the response was abandoned part way through a user's records
+var errBatchStopped = errors.New("batch stopped")
+
+// groupLookup checks the requester can view userToView's data and returns the group id to query, or the
+// error to report. It is lookupGroupId in main, which getGroupId writes the errors of
+type groupLookup func(req *http.Request, userToView string, p *params, serverOnly bool) (string, *detailedError)
+
+// batchHandler returns the data of several users in one response, so a care team view needn't make a request
+// per patient. The response is an object keyed by userID, in the order asked for, whose values are
+// {"data": [...]} or {"error": {...}} for users the requester can't view or whose query failed, so one user
+// doesn't fail the rest. Up to batchConcurrency users are looked up and queried at once, each read into memory
+// and written in turn, so no more than that many users' records are held at a time
+func batchHandler(config *Config, lookup groupLookup, processors []RecordProcessor, find func(query bson.M) resultIter) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		var body batchRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, MAX_BATCH_BODY))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&body); err != nil {
+			jsonError(res, error_invalid_body.setInternalMessage(err), start)
+			return
+		}
+		//the ids are the keys of the response so each can only be there once
+		userIds := []string{}
+		seen := map[string]bool{}
+		for _, userId := range body.UserIds {
+			if !seen[userId] {
+				seen[userId] = true
+				userIds = append(userIds, userId)
+			}
+		}
+		maxUsers := config.MaxBatchUsers
+		if maxUsers <= 0 {
+			maxUsers = DEFAULT_MAX_BATCH_USERS
+		}
+		if len(userIds) == 0 || len(userIds) > maxUsers {
+			usersError := invalidParam("userIds", fmt.Sprint(len(userIds)), fmt.Sprintf("between 1 and %d users", maxUsers))
+			jsonError(res, usersError, start)
+			return
+		}
+
+		p, paramsError := getParams(body.values(), config)
+		if paramsError != nil {
+			jsonError(res, *paramsError, start)
+			return
+		}
+
+		concurrency := config.BatchConcurrency
+		if concurrency <= 0 {
+			concurrency = DEFAULT_BATCH_CONCURRENCY
+		}
+		parts := make([]*batchPart, len(userIds))
+		for i := range parts {
+			parts[i] = &batchPart{done: make(chan struct{})}
+		}
+		//a slot is taken before a user is queried and given back once their part is written
+		slots := make(chan struct{}, concurrency)
+		stop := make(chan struct{})
+		//the session can only be closed once every worker is done with it
+		var workers sync.WaitGroup
+		defer workers.Wait()
+		defer close(stop)
+
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i, userToView := range userIds {
+				select {
+				case slots <- struct{}{}:
+				case <-stop:
+					return
+				}
+				workers.Add(1)
+				go func(part *batchPart, userToView string) {
+					defer workers.Done()
+					defer close(part.done)
+					writeBatchUser(&part.body, req, userToView, p, lookup, processors, find, config, stop)
+				}(parts[i], userToView)
+			}
+		}()
+
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte("{"))
+		for i, userToView := range userIds {
+			select {
+			case <-parts[i].done:
+			case <-req.Context().Done():
+				log.Println(DATA_API_PREFIX, fmt.Sprintf("batch stopped after [%d] users as the client went away", i))
+				return
+			}
+
+			key, _ := json.Marshal(userToView)
+			if i > 0 {
+				res.Write([]byte(","))
+			}
+			res.Write(append(key, ':'))
+			if _, err := res.Write(parts[i].body.Bytes()); err != nil {
+				log.Println(DATA_API_PREFIX, fmt.Sprintf("batch stopped at user [%s]: %s", userToView, err))
+				return
+			}
+			parts[i].body.Reset()
+			<-slots
+		}
+		res.Write([]byte("}"))
+	})
+}
+
+// writeBatchUser writes one user's part of the response: their records, or the error that means they aren't
+// returned. Each user's permissions can restrict the params differently so p is copied
+func writeBatchUser(w io.Writer, req *http.Request, userToView string, p *params, lookup groupLookup, processors []RecordProcessor, find func(query bson.M) resultIter, config *Config, stop <-chan struct{}) {
+	userParams := *p
+	groupId, groupError := lookup(req, userToView, &userParams, false)
+	if groupError != nil {
+		writeBatchError(w, *groupError, userToView)
+		return
+	}
+	userParams.groupId = groupId
+
+	query, err := generateMongoQuery(&userParams)
+	if err != nil {
+		writeBatchError(w, error_incorrect_params.setInternalMessage(err), userToView)
+		return
+	}
+	writeBatchData(w, find(query), processors, config, stop)
+}
+
+// writeBatchData writes a user's records as {"data": [...]}. A query that fails part way through still ends
+// the array, with the error after it, so the rest of the response can be read. An error is returned only
+// when the response can't be written or stop is closed
+func writeBatchData(res io.Writer, iter resultIter, processors []RecordProcessor, config *Config, stop <-chan struct{}) error {
+	if _, err := res.Write([]byte(`{"data":[`)); err != nil {
+		iter.Close()
+		return err
+	}
+	var results map[string]interface{}
+	first := true
+	var failure *detailedError
+	for iter.Next(&results) {
+		select {
+		case <-stop:
+			iter.Close()
+			return errBatchStopped
+		default:
+		}
+
+		record, err := processRecord(results, processors)
+		if err == nil && record == nil {
+			continue
+		}
+		var bytes []byte
+		if err == nil {
+			roundValues(record, config.ValueDecimals)
+			bytes, err = marshalOrdered(record, config.FieldOrder)
+		}
+		if err != nil {
+			processError := error_loading_events.setInternalMessage(err)
+			failure = &processError
+			break
+		}
+		if !first {
+			bytes = append([]byte(","), bytes...)
+		}
+		first = false
+		if _, err := res.Write(bytes); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil && failure == nil {
+		queryError := error_running_query.setInternalMessage(err)
+		failure = &queryError
+	}
+
+	if failure == nil {
+		_, err := res.Write([]byte("]}"))
+		return err
+	}
+	log.Println(DATA_API_PREFIX, fmt.Sprintf("[%s] batch query failed: %s", failure.Code, failure.InternalMessage))
+	errorBytes, _ := json.Marshal(failure)
+	_, err := res.Write(append(append([]byte(`],"error":`), errorBytes...), '}'))
+	return err
+}
+
+// writeBatchError writes {"error": {...}} for a user whose data isn't returned
+func writeBatchError(res io.Writer, userError detailedError, userToView string) {
+	log.Println(DATA_API_PREFIX, fmt.Sprintf("[%s] batch user [%s] not returned: %s", userError.Code, userToView, userError.InternalMessage))
+	errorBytes, _ := json.Marshal(userError)
+	res.Write(append(append([]byte(`{"error":`), errorBytes...), '}'))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func allowGroups(req *http.Request, userToView string, p *params, serverOnly bool) (string, *detailedError) {
+	if userToView == "stranger" {
+		viewError := error_no_view_permisson
+		return "", &viewError
+	}
+	return "group-" + userToView, nil
+}
+
+type batchResult struct {
+	Data  []map[string]interface{} `json:"data"`
+	Error *detailedError           `json:"error"`
+}
+
+func postBatch(t *testing.T, handler http.Handler, body string) (*httptest.ResponseRecorder, map[string]batchResult) {
+	req := httptest.NewRequest("POST", "/data", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	results := map[string]batchResult{}
+	if res.Code == http.StatusOK {
+		if err := json.Unmarshal(res.Body.Bytes(), &results); err != nil {
+			t.Fatalf("expected a json object but got %s", res.Body.String())
+		}
+	}
+	return res, results
+}
+
+func TestBatchHandler(t *testing.T) {
+	collection := fakeCollection{
+		{"_groupId": "group-alice", "_active": true, "_schemaVersion": 0, "type": "cbg", "time": "2015-10-10T15:00:00.000Z", "value": 101},
+		{"_groupId": "group-alice", "_active": true, "_schemaVersion": 0, "type": "smbg", "time": "2015-10-10T16:00:00.000Z", "value": 5.5},
+		{"_groupId": "group-bob", "_active": true, "_schemaVersion": 0, "type": "cbg", "time": "2015-10-10T15:00:00.000Z", "value": 202},
+	}
+	handler := batchHandler(&Config{}, allowGroups, nil, func(query bson.M) resultIter {
+		return collection.find(query)
+	})
+
+	res, results := postBatch(t, handler, `{"userIds": ["alice", "stranger", "bob", "carol", "alice"], "type": "cbg"}`)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected a json 200 but got %d with %s", res.Code, res.Body.String())
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected a result per distinct user but got %v", results)
+	}
+	if alice := results["alice"]; len(alice.Data) != 1 || alice.Data[0]["value"] != float64(101) || alice.Error != nil {
+		t.Errorf("expected alice's cbg but got %+v", alice)
+	}
+	if bob := results["bob"]; len(bob.Data) != 1 || bob.Data[0]["value"] != float64(202) {
+		t.Errorf("expected bob's cbg but got %+v", bob)
+	}
+	if carol := results["carol"]; carol.Data == nil || len(carol.Data) != 0 || carol.Error != nil {
+		t.Errorf("expected an empty array for a user without data but got %+v", carol)
+	}
+	if stranger := results["stranger"]; stranger.Data != nil || stranger.Error == nil || stranger.Error.Code != error_no_view_permisson.Code {
+		t.Errorf("expected the stranger flagged rather than failing the request but got %+v", stranger)
+	}
+	if body := res.Body.String(); strings.Index(body, `"alice"`) > strings.Index(body, `"stranger"`) || strings.Index(body, `"stranger"`) > strings.Index(body, `"bob"`) {
+		t.Errorf("expected the users in the order asked for but got %s", body)
+	}
+}
+
+func TestBatchHandler_queryFails(t *testing.T) {
+	handler := batchHandler(&Config{}, allowGroups, nil, func(query bson.M) resultIter {
+		if query["_groupId"] == "group-alice" {
+			return &testIter{records: []map[string]interface{}{{"type": "cbg"}}, err: errors.New("cursor not found")}
+		}
+		return &testIter{records: []map[string]interface{}{{"type": "smbg"}}}
+	})
+
+	res, results := postBatch(t, handler, `{"userIds": ["alice", "bob"]}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected a 200 but got %d", res.Code)
+	}
+	if alice := results["alice"]; len(alice.Data) != 1 || alice.Error == nil || alice.Error.Code != error_running_query.Code {
+		t.Errorf("expected alice's records read before the failure and the error but got %+v", alice)
+	}
+	if bob := results["bob"]; len(bob.Data) != 1 || bob.Error != nil {
+		t.Errorf("expected bob unaffected but got %+v", bob)
+	}
+}
+
+func TestBatchHandler_invalid(t *testing.T) {
+	handler := batchHandler(&Config{}, allowGroups, nil, func(query bson.M) resultIter {
+		t.Fatal("an invalid request shouldn't be queried")
+		return nil
+	})
+
+	for body, code := range map[string]string{
+		`{"userIds": ["alice"`:                             error_invalid_body.Code,
+		`{"userIds": ["alice"], "limit": 10}`:              error_invalid_body.Code,
+		`{"userIds": []}`:                                  error_invalid_param.Code,
+		`{"userIds": ["alice"], "startdate": "yesterday"}`: error_invalid_date.Code,
+	} {
+		res, _ := postBatch(t, handler, body)
+		if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), code) {
+			t.Errorf("%s: expected a 400 %s but got %d with %s", body, code, res.Code, res.Body.String())
+		}
+	}
+
+	userIds := []string{}
+	for i := 0; i <= DEFAULT_MAX_BATCH_USERS; i++ {
+		userIds = append(userIds, string(rune('a'+i)))
+	}
+	body, _ := json.Marshal(batchRequest{UserIds: userIds})
+	if res, _ := postBatch(t, handler, string(body)); res.Code != http.StatusBadRequest {
+		t.Errorf("expected more than %d users rejected but got %d", DEFAULT_MAX_BATCH_USERS, res.Code)
+	}
+}
+
+func TestBatchHandler_maxBatchUsers(t *testing.T) {
+	config := &Config{MaxBatchUsers: 2}
+	handler := batchHandler(config, allowGroups, nil, func(query bson.M) resultIter { return &testIter{} })
+
+	if res, _ := postBatch(t, handler, `{"userIds": ["alice", "bob"]}`); res.Code != http.StatusOK {
+		t.Errorf("expected the configured number of users allowed but got %d", res.Code)
+	}
+	res, _ := postBatch(t, handler, `{"userIds": ["alice", "bob", "carol"]}`)
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "between 1 and 2 users") {
+		t.Errorf("expected more than the configured 2 users rejected but got %d with %s", res.Code, res.Body.String())
+	}
+}
+
+// trackedIter reports when it's closed, so a test can count the queries in progress
+type trackedIter struct {
+	resultIter
+	closed func()
+}
+
+func (i *trackedIter) Close() error {
+	i.closed()
+	return i.resultIter.Close()
+}
+
+func TestBatchHandler_concurrency(t *testing.T) {
+	var mutex sync.Mutex
+	running, most := 0, 0
+	config := &Config{BatchConcurrency: 2}
+	handler := batchHandler(config, allowGroups, nil, func(query bson.M) resultIter {
+		mutex.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mutex.Unlock()
+		//slow enough that the queries overlap
+		time.Sleep(20 * time.Millisecond)
+		records := []map[string]interface{}{{"type": "cbg", "value": query["_groupId"]}}
+		return &trackedIter{resultIter: &testIter{records: records}, closed: func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			running--
+		}}
+	})
+
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank"}
+	body, _ := json.Marshal(batchRequest{UserIds: users})
+	res, results := postBatch(t, handler, string(body))
+	if res.Code != http.StatusOK || len(results) != len(users) {
+		t.Fatalf("expected every user's data but got %d with %s", res.Code, res.Body.String())
+	}
+	previous := -1
+	for _, user := range users {
+		if result := results[user]; len(result.Data) != 1 || result.Data[0]["value"] != "group-"+user {
+			t.Errorf("expected %s's own data but got %+v", user, result)
+		}
+		at := strings.Index(res.Body.String(), `"`+user+`"`)
+		if at < previous {
+			t.Errorf("expected the users in the order asked for but got %s", res.Body.String())
+		}
+		previous = at
+	}
+	if most != 2 {
+		t.Errorf("expected 2 users queried at once but at most %d were", most)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// the number of records transposed into each chunk of a columnar response
+const COLUMNAR_CHUNK_SIZE = 1000
+
+// checkLayout validates the layout param. The columnar layout only makes sense when every record has
+// the same shape, so it needs exactly one type and the json format
+func checkLayout(layout string, types string, format string) error {
+	switch layout {
+	case "", "rows":
+		return nil
+	case "columnar":
+		if types == "" || strings.Contains(types, ",") {
+			return fmt.Errorf("layout=columnar needs a single type, got [%s]", types)
+		}
+		if format != "" && format != "json" {
+			return fmt.Errorf("layout=columnar can't be used with format [%s]", format)
+		}
+		return nil
+	}
+	return fmt.Errorf("layout must be rows or columnar, got [%s]", layout)
+}
+
+// transposeRecords turns the records into parallel arrays, one per field found in any of the records, e.g.
+// {"time": ["2015-10-10T15:00:00Z", ...], "value": [101, ...]}. Records missing a field get null in its array
+func transposeRecords(records []map[string]interface{}) ([]byte, error) {
+	columns := map[string][]interface{}{}
+	for i, record := range records {
+		for field, value := range record {
+			column, ok := columns[field]
+			if !ok {
+				column = make([]interface{}, len(records))
+				columns[field] = column
+			}
+			column[i] = value
+		}
+	}
+	return json.Marshal(columns)
+}
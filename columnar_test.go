@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProcessResults_columnar(t *testing.T) {
+	records := []map[string]interface{}{}
+	for i := 0; i < COLUMNAR_CHUNK_SIZE+2; i++ {
+		record := map[string]interface{}{"type": "cbg", "time": time.Unix(int64(i*300), 0).UTC().Format(time.RFC3339), "value": float64(100 + i%50)}
+		if i == 1 {
+			record["annotations"] = "flat"
+		}
+		records = append(records, record)
+	}
+
+	res := httptest.NewRecorder()
+	processResults(res, &testIter{records: records}, resultOptions{emptyStatus: http.StatusOK, columnarChunkSize: COLUMNAR_CHUNK_SIZE}, time.Now())
+
+	var chunks []map[string][]interface{}
+	if err := json.Unmarshal(res.Body.Bytes(), &chunks); err != nil {
+		t.Fatalf("couldn't parse %s: %s", res.Body.String(), err)
+	}
+	if len(chunks) != 2 || len(chunks[0]["time"]) != COLUMNAR_CHUNK_SIZE || len(chunks[1]["time"]) != 2 {
+		t.Fatalf("expected a full chunk and a chunk of 2 but got %d chunks", len(chunks))
+	}
+	if _, ok := chunks[1]["annotations"]; ok {
+		t.Fatal("the second chunk has no annotations so shouldn't have the column")
+	}
+
+	//putting the rows back together should give the original records
+	row := 0
+	for _, chunk := range chunks {
+		for i := range chunk["time"] {
+			rebuilt := map[string]interface{}{}
+			for field, column := range chunk {
+				if column[i] != nil {
+					rebuilt[field] = column[i]
+				}
+			}
+			if !reflect.DeepEqual(rebuilt, records[row]) {
+				t.Fatalf("row %d: expected %v but got %v", row, records[row], rebuilt)
+			}
+			row++
+		}
+	}
+	if row != len(records) {
+		t.Fatalf("expected %d rows but got %d", len(records), row)
+	}
+}
+
+func TestCheckLayout(t *testing.T) {
+	if err := checkLayout("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLayout("columnar", "cbg", "json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLayout("columnar", "", ""); err == nil {
+		t.Fatal("should need a type")
+	}
+	if err := checkLayout("columnar", "cbg,smbg", ""); err == nil {
+		t.Fatal("should need a single type")
+	}
+	if err := checkLayout("columnar", "cbg", "zip"); err == nil {
+		t.Fatal("should reject zip")
+	}
+	if err := checkLayout("wide", "cbg", ""); err == nil {
+		t.Fatal("should reject an unknown layout")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the most clauses the params of one request can add when maxQueryClauses isn't configured
+const DEFAULT_MAX_QUERY_CLAUSES = 100
+
+// queryClauses counts the values the request's params add to its query, each of which becomes a clause,
+// an $in entry or an alternative that mongo has to consider for every candidate object
+func queryClauses(p *params) int {
+	clauses := 0
+	for _, list := range []string{p.types, p.subTypes, p.deviceIds, p.uploadIds, p.times} {
+		if list != "" {
+			clauses += len(strings.Split(list, ","))
+		}
+	}
+	for _, criteria := range p.settings {
+		clauses += len(criteria)
+	}
+	clauses += len(p.typeSubTypes) + len(p.exists) + len(p.search)
+	return clauses
+}
+
+// maxParams turns away requests with more than max query params, counting each value of a repeated param.
+// No endpoint takes more than a couple of dozen so many more is a client building an expensive query
+// rather than a real request. Zero is unlimited
+func maxParams(h http.Handler, max int) http.Handler {
+	if max <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		count := 0
+		for _, values := range req.URL.Query() {
+			count += len(values)
+		}
+		if count > max {
+			jsonError(res, error_too_many_params.setInternalMessage(fmt.Errorf("%d query params given, the most allowed is %d", count, max)), time.Now())
+			return
+		}
+		h.ServeHTTP(res, req)
+	})
+}
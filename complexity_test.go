@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryClauses(t *testing.T) {
+	p, paramsError := getParams(url.Values{
+		"startdate":   {"2015-10-01T00:00:00Z"},
+		"type":        {"cbg,smbg"},
+		"typeSubtype": {"bolus:normal,basal:scheduled,basal:temp"},
+		"settings":    {"bgTarget.low:80,bgTarget.high:140"},
+		"exists":      {"carbInput:true"},
+	}, &Config{})
+	if paramsError != nil {
+		t.Fatalf("unexpected error %v", paramsError)
+	}
+	if clauses := queryClauses(p); clauses != 8 {
+		t.Fatalf("expected 8 clauses but got %d", clauses)
+	}
+}
+
+func TestGetParams_tooComplex(t *testing.T) {
+	times := []string{}
+	start := time.Date(2015, 10, 10, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 150; i++ {
+		times = append(times, start.Add(time.Duration(i)*5*time.Minute).Format(time.RFC3339))
+	}
+	query := url.Values{"times": {strings.Join(times, ",")}}
+
+	_, paramsError := getParams(query, &Config{})
+	if paramsError == nil || paramsError.Code != error_query_too_complex.Code || paramsError.Status != 400 {
+		t.Fatalf("expected 150 times to be rejected by the default cap but got %v", paramsError)
+	}
+
+	if _, paramsError := getParams(query, &Config{MaxQueryClauses: 200}); paramsError != nil {
+		t.Fatalf("expected a larger configured cap to allow 150 times but got %v", paramsError)
+	}
+
+	query.Set("type", strings.Repeat("cbg,", 60)+"smbg")
+	if _, paramsError := getParams(query, &Config{MaxQueryClauses: 200}); paramsError == nil {
+		t.Fatal("expected the clauses of every param to count towards the cap")
+	}
+}
+
+func TestMaxParams(t *testing.T) {
+	served := false
+	handler := maxParams(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) { served = true }), 3)
+
+	for query, allowed := range map[string]bool{
+		"":                                 true,
+		"type=cbg&startdate=x&enddate=y":   true,
+		"type=cbg&type=smbg&type=basal":    true,
+		"type=cbg&startdate=x&enddate=y&a": false,
+		"type=cbg&type=smbg&type=basal&type=bolus": false,
+	} {
+		served = false
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/abc123?"+query, nil))
+		if served != allowed {
+			t.Errorf("[%s]: expected served to be %v", query, allowed)
+		}
+		if !allowed && (res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), error_too_many_params.Code)) {
+			t.Errorf("[%s]: expected a 400 %s but got %d %s", query, error_too_many_params.Code, res.Code, res.Body.String())
+		}
+	}
+
+	served = false
+	maxParams(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) { served = true }), 0).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abc123?a&b&c&d&e&f", nil))
+	if !served {
+		t.Error("expected no cap when maxQueryParams isn't set")
+	}
+}
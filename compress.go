@@ -0,0 +1,16 @@
+//go:build !zstd
+// +build !zstd
+
+package main
+
+import (
+	"net/http"
+
+	httpgzip "github.com/daaku/go.httpgzip"
+)
+
+// newCompressor returns the wrapper that compresses data responses. Only gzip is available in this
+// build, build with the zstd tag to add zstd
+func newCompressor(config *Config) (func(http.Handler) http.Handler, error) {
+	return httpgzip.NewHandler, nil
+}
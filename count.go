@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// the body of a /{userID}/count response
+type objectCount struct {
+	Count int `json:"count"`
+}
+
+// countHandler answers how many objects /{userID} would return for the type, subtype and date params, with
+// the same permission checks. count runs the query as a count so no objects are read or marshalled
+func countHandler(config *Config, authorize authorizer, count func(query bson.M) (int, error)) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		userToView := req.URL.Query().Get(":userID")
+
+		p, paramsError := getParams(req.URL.Query(), config)
+		if paramsError != nil {
+			jsonError(res, *paramsError, start)
+			return
+		}
+
+		groupId, ok := authorize(res, req, userToView, p, false, start)
+		if !ok {
+			return
+		}
+		p.groupId = groupId
+
+		groupDataQuery, err := generateMongoQuery(p)
+		if err != nil {
+			jsonError(res, error_incorrect_params.setInternalMessage(err), start)
+			return
+		}
+
+		n, err := count(groupDataQuery)
+		if err != nil {
+			jsonError(res, error_running_query.setInternalMessage(err), start)
+			return
+		}
+
+		bytes, err := json.Marshal(objectCount{Count: n})
+		if err != nil {
+			jsonError(res, error_loading_events.setInternalMessage(err), start)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(bytes)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestCountHandler(t *testing.T) {
+	collection := fakeCollection{
+		{"_groupId": "group-abc123", "_active": true, "_schemaVersion": 0, "type": "cbg", "time": "2015-10-10T15:00:00Z"},
+		{"_groupId": "group-abc123", "_active": true, "_schemaVersion": 0, "type": "cbg", "time": "2015-10-11T15:00:00Z"},
+		{"_groupId": "group-abc123", "_active": true, "_schemaVersion": 0, "type": "smbg", "time": "2015-10-11T16:00:00Z"},
+		{"_groupId": "group-other", "_active": true, "_schemaVersion": 0, "type": "cbg", "time": "2015-10-11T15:00:00Z"},
+	}
+	count := func(query bson.M) (int, error) {
+		n := 0
+		for _, record := range collection {
+			if collection.matches(record, query) {
+				n++
+			}
+		}
+		return n, nil
+	}
+	handler := countHandler(&Config{}, allowAll, count)
+
+	for query, expected := range map[string]string{
+		"type=cbg":      `{"count":2}`,
+		"type=cbg,smbg": `{"count":3}`,
+		"type=cbg&startdate=2015-10-11T00:00:00Z": `{"count":1}`,
+		"type=basal": `{"count":0}`,
+		"type=cbg&enddate=2015-10-10T23:59:59.999Z": `{"count":1}`,
+	} {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/abc123/count?:userID=abc123&"+query, nil))
+		if res.Code != http.StatusOK || res.Body.String() != expected {
+			t.Errorf("%s: expected %s but got %d %s", query, expected, res.Code, res.Body.String())
+		}
+	}
+
+	//the same permission checks as the data endpoint
+	counted := false
+	denied := countHandler(&Config{}, func(res http.ResponseWriter, req *http.Request, userToView string, p *params, serverOnly bool, start time.Time) (string, bool) {
+		jsonError(res, error_no_view_permisson, start)
+		return "", false
+	}, func(query bson.M) (int, error) {
+		counted = true
+		return 0, nil
+	})
+	res := httptest.NewRecorder()
+	denied.ServeHTTP(res, httptest.NewRequest("GET", "/abc123/count?:userID=abc123&type=cbg", nil))
+	if counted || res.Code != http.StatusForbidden {
+		t.Errorf("expected the count to be refused but got %d %s", res.Code, res.Body.String())
+	}
+
+	failing := countHandler(&Config{}, allowAll, func(query bson.M) (int, error) { return 0, errors.New("no reachable servers") })
+	res = httptest.NewRecorder()
+	failing.ServeHTTP(res, httptest.NewRequest("GET", "/abc123/count?:userID=abc123", nil))
+	if res.Code != http.StatusInternalServerError || !strings.Contains(res.Body.String(), error_running_query.Code) {
+		t.Errorf("expected a query error but got %d %s", res.Code, res.Body.String())
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"labix.org/v2/mgo/bson"
+)
+
+// countByTypePipeline counts the objects matching the query for each type in a single aggregation
+func countByTypePipeline(query bson.M) []bson.M {
+	return []bson.M{
+		{"$match": query},
+		{"$group": bson.M{"_id": "$type", "count": bson.M{"$sum": 1}}},
+	}
+}
+
+// typeCounts reads the results of countByTypePipeline into a map of type to count
+func typeCounts(iter resultIter) (map[string]int, error) {
+	counts := map[string]int{}
+
+	var result map[string]interface{}
+	for iter.Next(&result) {
+		objType, _ := result["_id"].(string)
+		switch count := result["count"].(type) {
+		case int:
+			counts[objType] = count
+		case int64:
+			counts[objType] = int(count)
+		case float64:
+			counts[objType] = int(count)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
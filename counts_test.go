@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// group does what the $group stage of countByTypePipeline does in mongo
+func group(iter resultIter) resultIter {
+	counts := map[string]int{}
+	order := []string{}
+	var record map[string]interface{}
+	for iter.Next(&record) {
+		objType := record["type"].(string)
+		if _, ok := counts[objType]; !ok {
+			order = append(order, objType)
+		}
+		counts[objType]++
+	}
+	grouped := []map[string]interface{}{}
+	for _, objType := range order {
+		grouped = append(grouped, map[string]interface{}{"_id": objType, "count": counts[objType]})
+	}
+	return &testIter{records: grouped}
+}
+
+func TestCountByType(t *testing.T) {
+	data := fakeCollection{}
+	add := func(objType string, times ...string) {
+		for _, recordTime := range times {
+			data = append(data, map[string]interface{}{"_groupId": "abc123", "_active": true, "_schemaVersion": 1, "type": objType, "time": recordTime})
+		}
+	}
+	add("cbg", "2015-10-10T15:00:00Z", "2015-10-10T15:05:00Z", "2015-10-10T15:10:00Z", "2015-10-01T15:00:00Z")
+	add("bolus", "2015-10-10T15:02:00Z", "2015-10-01T12:00:00Z")
+	add("smbg", "2015-10-01T08:00:00Z")
+
+	query, err := generateMongoQuery(&params{groupId: "abc123", minSchemaVersion: 1, maxSchemaVersion: 1, startDate: "2015-10-10T00:00:00.000Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := countByTypePipeline(query)
+	if !reflect.DeepEqual(pipeline[0], bson.M{"$match": query}) {
+		t.Fatalf("expected the pipeline to match the query but got %v", pipeline[0])
+	}
+
+	counts, err := typeCounts(group(data.find(pipeline[0]["$match"].(bson.M))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//smbg only has data before the startdate
+	expected := map[string]int{"cbg": 3, "bolus": 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("expected %v but got %v", expected, counts)
+	}
+}
+
+func TestTypeCounts_iterError(t *testing.T) {
+	if _, err := typeCounts(&testIter{err: errors.New("cursor lost")}); err == nil {
+		t.Fatal("expected the iterator error")
+	}
+}
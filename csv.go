@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// how many records the csv columns are worked out from when the fields param isn't given
+const CSV_SAMPLE_SIZE = 1000
+
+// the column holding, as a json object, the fields of records that weren't in the sample the columns came from
+const CSV_OTHER_COLUMN = "_other"
+
+// the characters that make a spreadsheet read a cell as a formula, including the tab and carriage return
+// some read past first
+const CSV_FORMULA_STARTS = "=+-@\t\r"
+
+// fields asked for are field names, or dotted paths into nested objects e.g. payload.note
+var fieldPath = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// parseFields reads the fields param, the only fields returned and, for csv, the columns in order. Internal
+// fields, including any starting with _, can't be asked for
+func parseFields(fields string) ([]string, error) {
+	if fields == "" {
+		return nil, nil
+	}
+	internal := map[string]bool{}
+	for _, field := range internalFields {
+		internal[field] = true
+	}
+	paths := strings.Split(fields, ",")
+	for _, path := range paths {
+		if !fieldPath.MatchString(path) {
+			return nil, fmt.Errorf("fields must be comma separated field names, got [%s]", path)
+		}
+		if field := strings.Split(path, ".")[0]; strings.HasPrefix(field, "_") || internal[field] {
+			return nil, fmt.Errorf("[%s] is internal and can't be returned", path)
+		}
+	}
+	return paths, nil
+}
+
+// csvStream writes records as csv rows. With the fields param the columns are known and every row is written
+// as it comes. Otherwise the columns are the fields of the first CSV_SAMPLE_SIZE records, held back until
+// they're known, and the fields of later records that aren't columns go into CSV_OTHER_COLUMN, so the
+// results are still streamed rather than all held to find every field. Nested objects in the sample are
+// expanded into dotted columns e.g. payload.transmitterId up to flattenDepth levels down, deeper ones are
+// json encoded in their column
+type csvStream struct {
+	w            *csv.Writer
+	columns      []string
+	fieldOrder   []string
+	flattenDepth int
+	sample       []map[string]interface{}
+	started      bool
+	//the columns and the objects with columns inside them, to find what of a record goes in CSV_OTHER_COLUMN
+	covered map[string]bool
+	parents map[string]bool
+}
+
+func newCSVStream(w io.Writer, fields []string, fieldOrder []string, flattenDepth int) *csvStream {
+	writer := csv.NewWriter(w)
+	//as RFC 4180 and spreadsheets expect
+	writer.UseCRLF = true
+	return &csvStream{w: writer, columns: fields, fieldOrder: fieldOrder, flattenDepth: flattenDepth}
+}
+
+// add writes the record's row, or holds it until the columns are known. The stream keeps the record so the
+// caller mustn't reuse it
+func (s *csvStream) add(record map[string]interface{}) error {
+	if s.columns == nil {
+		s.sample = append(s.sample, record)
+		if len(s.sample) < CSV_SAMPLE_SIZE {
+			return nil
+		}
+		return s.writeSample()
+	}
+	return s.writeRow(record)
+}
+
+// close writes whatever is held back and flushes the rows. Nothing is written when there were no records
+// and no fields were given
+func (s *csvStream) close() error {
+	if s.columns == nil && len(s.sample) > 0 {
+		if err := s.writeSample(); err != nil {
+			return err
+		}
+	}
+	if s.columns != nil {
+		if err := s.writeHeader(); err != nil {
+			return err
+		}
+	}
+	s.w.Flush()
+	return s.w.Error()
+}
+
+func (s *csvStream) writeSample() error {
+	s.columns = append(sampleColumns(s.sample, s.fieldOrder, s.flattenDepth), CSV_OTHER_COLUMN)
+	s.covered, s.parents = map[string]bool{}, map[string]bool{}
+	for _, column := range s.columns {
+		s.covered[column] = true
+		names := strings.Split(column, ".")
+		for i := 1; i < len(names); i++ {
+			s.parents[strings.Join(names[:i], ".")] = true
+		}
+	}
+	for _, record := range s.sample {
+		if err := s.writeRow(record); err != nil {
+			return err
+		}
+	}
+	s.sample = nil
+	return nil
+}
+
+func (s *csvStream) writeHeader() error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	return s.w.Write(s.columns)
+}
+
+func (s *csvStream) writeRow(record map[string]interface{}) error {
+	if err := s.writeHeader(); err != nil {
+		return err
+	}
+
+	row := make([]string, len(s.columns))
+	for i, column := range s.columns {
+		if column == CSV_OTHER_COLUMN {
+			continue
+		}
+		cell, err := csvCell(lookupPath(record, column))
+		if err != nil {
+			return err
+		}
+		row[i] = cell
+	}
+	if last := len(s.columns) - 1; s.columns[last] == CSV_OTHER_COLUMN {
+		if other := s.uncovered(record, ""); len(other) > 0 {
+			cell, err := csvCell(other)
+			if err != nil {
+				return err
+			}
+			row[last] = cell
+		}
+	}
+	return s.w.Write(row)
+}
+
+// uncovered returns the fields of the record no column holds, with the objects that have columns inside them
+// cut down to their fields that aren't columns. prefix is the path of the record within the top level one
+func (s *csvStream) uncovered(record map[string]interface{}, prefix string) map[string]interface{} {
+	other := map[string]interface{}{}
+	for field, value := range record {
+		path := prefix + field
+		if s.covered[path] {
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok && s.parents[path] {
+			if rest := s.uncovered(nested, path+"."); len(rest) > 0 {
+				other[field] = rest
+			}
+			continue
+		}
+		other[field] = value
+	}
+	return other
+}
+
+// sampleColumns is every field of the records, those in order first and then the rest sorted by name. Nested
+// objects are expanded into the dotted paths of their fields up to depth levels down
+func sampleColumns(records []map[string]interface{}, order []string, depth int) []string {
+	seen := map[string]bool{}
+	for _, record := range records {
+		addColumns(record, "", depth, seen)
+	}
+	columns := []string{}
+	for _, field := range order {
+		paths := []string{}
+		for path := range seen {
+			if path == field || strings.HasPrefix(path, field+".") {
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			columns = append(columns, path)
+			delete(seen, path)
+		}
+	}
+	rest := []string{}
+	for field := range seen {
+		rest = append(rest, field)
+	}
+	sort.Strings(rest)
+	return append(columns, rest...)
+}
+
+func addColumns(record map[string]interface{}, prefix string, depth int, seen map[string]bool) {
+	for field, value := range record {
+		if nested, ok := value.(map[string]interface{}); ok && depth > 0 && len(nested) > 0 {
+			addColumns(nested, prefix+field+".", depth-1, seen)
+			continue
+		}
+		seen[prefix+field] = true
+	}
+}
+
+// lookupPath finds a field, or a dotted path into nested objects, in the record. A record without it, or
+// with something other than an object part way along the path, gives nil so its cell is left empty
+func lookupPath(record map[string]interface{}, path string) interface{} {
+	var value interface{} = record
+	for _, name := range strings.Split(path, ".") {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = nested[name]
+	}
+	return value
+}
+
+// csvCell formats a value for a cell. Missing values are empty and objects and arrays are json encoded.
+// Strings a spreadsheet would take as a formula are prefixed with ' so opening an export can't run one
+func csvCell(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		if value != "" && strings.ContainsRune(CSV_FORMULA_STARTS, rune(value[0])) {
+			return "'" + value, nil
+		}
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case int, int64, bool:
+		return fmt.Sprint(value), nil
+	}
+	bytes, err := json.Marshal(value)
+	return string(bytes), err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readCSV(t *testing.T, body string) [][]string {
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("expected csv but got %s: %s", body, err)
+	}
+	return rows
+}
+
+func TestProcessResults_csv(t *testing.T) {
+	records := []map[string]interface{}{
+		{"type": "smbg", "time": "2015-10-10T15:00:00Z", "value": 5.5, "units": "mmol/L"},
+		{"type": "cbg", "time": "2015-10-10T15:05:00Z", "value": 101, "payload": map[string]interface{}{"note": "after, lunch"}},
+	}
+
+	res := httptest.NewRecorder()
+	processResults(res, &testIter{records: records}, resultOptions{emptyStatus: http.StatusOK, csv: true, fieldOrder: []string{"type", "time"}}, time.Now())
+	if contentType := res.Header().Get("Content-Type"); contentType != "text/csv" {
+		t.Fatalf("expected the csv content type but got [%s]", contentType)
+	}
+	expected := [][]string{
+		{"type", "time", "payload", "units", "value", CSV_OTHER_COLUMN},
+		{"smbg", "2015-10-10T15:00:00Z", "", "mmol/L", "5.5", ""},
+		{"cbg", "2015-10-10T15:05:00Z", `{"note":"after, lunch"}`, "", "101", ""},
+	}
+	if rows := readCSV(t, res.Body.String()); fmt.Sprint(rows) != fmt.Sprint(expected) {
+		t.Fatalf("expected\n%v\nbut got\n%v", expected, rows)
+	}
+
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{records: records}, resultOptions{emptyStatus: http.StatusOK, csv: true, csvFields: []string{"time", "value", "payload.note"}}, time.Now())
+	expected = [][]string{
+		{"time", "value", "payload.note"},
+		{"2015-10-10T15:00:00Z", "5.5", ""},
+		{"2015-10-10T15:05:00Z", "101", "after, lunch"},
+	}
+	if rows := readCSV(t, res.Body.String()); fmt.Sprint(rows) != fmt.Sprint(expected) {
+		t.Fatalf("expected\n%v\nbut got\n%v", expected, rows)
+	}
+
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{}, resultOptions{emptyStatus: http.StatusOK, csv: true, csvFields: []string{"time", "value"}}, time.Now())
+	if res.Code != http.StatusOK || res.Body.String() != "time,value\r\n" {
+		t.Fatalf("expected just the header but got %d %q", res.Code, res.Body.String())
+	}
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{}, resultOptions{emptyStatus: http.StatusNoContent, csv: true}, time.Now())
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 but got %d", res.Code)
+	}
+}
+
+func TestCSVStream_alignedRows(t *testing.T) {
+	var out bytes.Buffer
+	stream := newCSVStream(&out, []string{"time", "type", "value", "units", "payload.note"}, nil, 0)
+	for _, record := range []map[string]interface{}{
+		{"time": "2015-10-10T15:00:00Z", "type": "smbg", "value": 5.5, "units": "mmol/L", "payload": map[string]interface{}{"note": "before"}},
+		{"time": "2015-10-10T15:05:00Z", "value": 101},
+		{"type": "basal", "units": "U/hr", "payload": "not an object"},
+		{"payload": map[string]interface{}{"note": "only a note"}},
+		{},
+	} {
+		if err := stream.add(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"time", "type", "value", "units", "payload.note"},
+		{"2015-10-10T15:00:00Z", "smbg", "5.5", "mmol/L", "before"},
+		{"2015-10-10T15:05:00Z", "", "101", "", ""},
+		{"", "basal", "", "U/hr", ""},
+		{"", "", "", "", "only a note"},
+		{"", "", "", "", ""},
+	}
+	if rows := readCSV(t, out.String()); fmt.Sprint(rows) != fmt.Sprint(expected) {
+		t.Fatalf("expected every row aligned to the header\n%v\nbut got\n%v", expected, rows)
+	}
+}
+
+func TestCSVStream_pastSample(t *testing.T) {
+	var out bytes.Buffer
+	stream := newCSVStream(&out, nil, nil, 0)
+
+	for i := 0; i < CSV_SAMPLE_SIZE; i++ {
+		if err := stream.add(map[string]interface{}{"time": fmt.Sprint(i), "value": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the columns are known and the sample written as soon as it's full
+	if out.Len() == 0 {
+		t.Fatalf("expected the sample to be written once it was full")
+	}
+	if err := stream.add(map[string]interface{}{"time": "late", "value": 1, "annotations": []interface{}{"x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := readCSV(t, out.String())
+	if len(rows) != CSV_SAMPLE_SIZE+2 || fmt.Sprint(rows[0]) != fmt.Sprint([]string{"time", "value", CSV_OTHER_COLUMN}) {
+		t.Fatalf("unexpected header %v or %d rows", rows[0], len(rows))
+	}
+	if last := rows[len(rows)-1]; fmt.Sprint(last) != fmt.Sprint([]string{"late", "1", `{"annotations":["x"]}`}) {
+		t.Fatalf("expected the new field in the other column but got %v", last)
+	}
+}
+
+func TestCSVStream_flatten(t *testing.T) {
+	records := func() []map[string]interface{} {
+		return []map[string]interface{}{
+			{"type": "cbg", "value": 101, "payload": map[string]interface{}{"transmitterId": "ABC", "trend": map[string]interface{}{"rate": 1.5}}},
+			{"type": "smbg", "value": 5.5, "payload": map[string]interface{}{"note": "before"}},
+		}
+	}
+	for depth, expected := range map[int][][]string{
+		0: {
+			{"type", "payload", "value", CSV_OTHER_COLUMN},
+			{"cbg", `{"transmitterId":"ABC","trend":{"rate":1.5}}`, "101", ""},
+			{"smbg", `{"note":"before"}`, "5.5", ""},
+		},
+		1: {
+			{"type", "payload.note", "payload.transmitterId", "payload.trend", "value", CSV_OTHER_COLUMN},
+			{"cbg", "", "ABC", `{"rate":1.5}`, "101", ""},
+			{"smbg", "before", "", "", "5.5", ""},
+		},
+		2: {
+			{"type", "payload.note", "payload.transmitterId", "payload.trend.rate", "value", CSV_OTHER_COLUMN},
+			{"cbg", "", "ABC", "1.5", "101", ""},
+			{"smbg", "before", "", "", "5.5", ""},
+		},
+	} {
+		var out bytes.Buffer
+		stream := newCSVStream(&out, nil, []string{"type"}, depth)
+		for _, record := range records() {
+			if err := stream.add(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := stream.close(); err != nil {
+			t.Fatal(err)
+		}
+		if rows := readCSV(t, out.String()); fmt.Sprint(rows) != fmt.Sprint(expected) {
+			t.Errorf("depth %d: expected\n%v\nbut got\n%v", depth, expected, rows)
+		}
+	}
+}
+
+func TestCSVStream_flattenPastSample(t *testing.T) {
+	var out bytes.Buffer
+	stream := newCSVStream(&out, nil, nil, 1)
+
+	for i := 0; i < CSV_SAMPLE_SIZE; i++ {
+		if err := stream.add(map[string]interface{}{"time": fmt.Sprint(i), "payload": map[string]interface{}{"note": "x"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	late := map[string]interface{}{"time": "late", "payload": map[string]interface{}{"note": "y", "transmitterId": "ABC"}}
+	if err := stream.add(late); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := readCSV(t, out.String())
+	if fmt.Sprint(rows[0]) != fmt.Sprint([]string{"payload.note", "time", CSV_OTHER_COLUMN}) {
+		t.Fatalf("unexpected header %v", rows[0])
+	}
+	if last := rows[len(rows)-1]; fmt.Sprint(last) != fmt.Sprint([]string{"y", "late", `{"payload":{"transmitterId":"ABC"}}`}) {
+		t.Fatalf("expected the nested field that isn't a column in the other column but got %v", last)
+	}
+}
+
+func TestCSVCell_formulas(t *testing.T) {
+	for value, expected := range map[interface{}]string{
+		"=HYPERLINK(\"http://example.com\")": "'=HYPERLINK(\"http://example.com\")",
+		"+1+1":                               "'+1+1",
+		"-2+3":                               "'-2+3",
+		"@SUM(A1:A2)":                        "'@SUM(A1:A2)",
+		"\t=1":                               "'\t=1",
+		"site change":                        "site change",
+		"a=b":                                "a=b",
+		"":                                   "",
+		-5.5:                                 "-5.5",
+	} {
+		if cell, err := csvCell(value); err != nil || cell != expected {
+			t.Errorf("%q: expected %q but got %q %v", value, expected, cell, err)
+		}
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	if fields, err := parseFields("time,value,payload.note"); err != nil || len(fields) != 3 {
+		t.Fatalf("expected 3 fields but got %v %v", fields, err)
+	}
+	for _, bad := range []string{"time,,value", "payload..note", "time;drop", "value,"} {
+		if _, err := parseFields(bad); err == nil {
+			t.Errorf("should have rejected fields [%s]", bad)
+		}
+	}
+
+	for _, internal := range []string{"_groupId", "time,_id", "modifiedTime", "_source.x"} {
+		if _, err := parseFields(internal); err == nil {
+			t.Errorf("should have refused internal fields [%s]", internal)
+		}
+		_, paramsError := parseDataRequest(url.Values{"fields": {internal}}, "", &Config{})
+		if paramsError == nil || paramsError.Code != error_invalid_param.Code {
+			t.Errorf("expected internal fields [%s] to be an invalid param but got %v", internal, paramsError)
+		}
+	}
+	if r, paramsError := parseDataRequest(url.Values{"fields": {"time,value,type"}}, "", &Config{}); paramsError != nil || r.format != "json" || len(r.fields) != 3 {
+		t.Fatalf("expected fields with json but got %+v %v", r, paramsError)
+	}
+	r, paramsError := parseDataRequest(url.Values{"fields": {"time,value"}}, "text/csv", &Config{})
+	if paramsError != nil || r.format != "csv" || len(r.fields) != 2 {
+		t.Fatalf("expected csv from the Accept header but got %+v %v", r, paramsError)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// pageCursor is the position of an object in time then _id order. _id breaks ties between objects with the same
+// time, so every object has its own position and one inserted while a client pages is either before the
+// cursor, and was never going to be on a later page, or after it and on a later page. Unlike an offset, nothing
+// already returned moves onto the next page and nothing is skipped
+type pageCursor struct {
+	time string
+	id   bson.ObjectId
+}
+
+// cursorAt is the position of a record read from mongo, false when it has no time or _id
+func cursorAt(record map[string]interface{}) (*pageCursor, bool) {
+	timeString, _ := record["time"].(string)
+	id, _ := record["_id"].(bson.ObjectId)
+	if timeString == "" || id == "" {
+		return nil, false
+	}
+	return &pageCursor{time: timeString, id: id}, true
+}
+
+// encode makes the cursor an opaque, url safe string for the next-cursor trailer
+func (c *pageCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.time + " " + c.id.Hex()))
+}
+
+// parseCursor reads a cursor from the cursor param, as encode made it
+func parseCursor(encoded string) (*pageCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(decoded), " ")
+	if len(parts) != 2 || !bson.IsObjectIdHex(parts[1]) {
+		return nil, fmt.Errorf("cursor [%s] isn't a time and id", encoded)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+		return nil, err
+	}
+	return &pageCursor{time: parts[0], id: bson.ObjectIdHex(parts[1])}, nil
+}
+
+// after is the alternatives matching the objects after the cursor
+func (c *pageCursor) after() []bson.M {
+	return []bson.M{
+		{"time": bson.M{"$gt": c.time}},
+		{"time": c.time, "_id": bson.M{"$gt": c.id}},
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestParseCursor(t *testing.T) {
+	cursor := &pageCursor{time: "2015-10-10T15:00:00Z", id: bson.ObjectIdHex("5620f9bd8e9d3c4ab7e5c9a1")}
+	parsed, err := parseCursor(cursor.encode())
+	if err != nil || *parsed != *cursor {
+		t.Fatalf("expected %v back but got %v %v", cursor, parsed, err)
+	}
+
+	for _, bad := range []string{"", "not base64!", "MjAxNS0xMC0xMFQxNTowMDowMFo", cursor.encode()[:10]} {
+		if _, err := parseCursor(bad); err == nil {
+			t.Errorf("expected cursor [%s] to be rejected", bad)
+		}
+	}
+
+	if _, paramsError := parseDataRequest(url.Values{"limit": {"10"}, "cursor": {"nonsense"}}, "", &Config{}); paramsError == nil || paramsError.Code != error_invalid_param.Code {
+		t.Errorf("expected a bad cursor to be an invalid param but got %v", paramsError)
+	}
+	if _, paramsError := parseDataRequest(url.Values{"limit": {"10"}, "offset": {"10"}, "cursor": {cursor.encode()}}, "", &Config{}); paramsError == nil {
+		t.Error("expected a cursor to be rejected with an offset")
+	}
+}
+
+// page runs a limit and cursor request against the collection as the /{userID} handler does, returning
+// the records and the next cursor
+func page(t *testing.T, collection fakeCollection, limit int, cursor string) ([]map[string]interface{}, string) {
+	query := url.Values{"limit": {fmt.Sprint(limit)}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	r, paramsError := parseDataRequest(query, "", &Config{})
+	if paramsError != nil {
+		t.Fatal(paramsError)
+	}
+	if !r.cursor {
+		t.Fatal("expected a limit without an offset or sort to page with a cursor")
+	}
+	r.params.groupId = "abc123"
+	mongoQuery, err := generateMongoQuery(r.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//sorted by time then _id and limited, as mongo would
+	found := []map[string]interface{}{}
+	iter := collection.find(mongoQuery)
+	var record map[string]interface{}
+	for iter.Next(&record) {
+		copied := map[string]interface{}{}
+		for field, value := range record {
+			copied[field] = value
+		}
+		found = append(found, copied)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i]["time"] != found[j]["time"] {
+			return found[i]["time"].(string) < found[j]["time"].(string)
+		}
+		return found[i]["_id"].(bson.ObjectId).Hex() < found[j]["_id"].(bson.ObjectId).Hex()
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	processors, _ := loadRecordProcessors(nil)
+	res := httptest.NewRecorder()
+	processResults(res, &testIter{records: found}, resultOptions{emptyStatus: 200, cursor: true, processors: processors}, time.Now())
+
+	returned := []map[string]interface{}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &returned); err != nil {
+		t.Fatalf("expected records but got %s", res.Body.String())
+	}
+	for _, record := range returned {
+		if _, ok := record["_id"]; ok {
+			t.Fatalf("expected the _id to be removed but got %v", record)
+		}
+	}
+	return returned, res.Result().Trailer.Get(CURSOR_TRAILER)
+}
+
+func TestPageCursor_insertsWhilePaging(t *testing.T) {
+	object := func(id string, objectTime string, value int) map[string]interface{} {
+		return map[string]interface{}{
+			"_id": bson.ObjectIdHex(id), "_groupId": "abc123", "_active": true, "_schemaVersion": 0,
+			"type": "cbg", "time": objectTime, "value": value,
+		}
+	}
+	collection := fakeCollection{
+		object("5620f9bd8e9d3c4ab7e5c9a1", "2015-10-10T15:00:00Z", 1),
+		object("5620f9bd8e9d3c4ab7e5c9a3", "2015-10-10T15:05:00Z", 3),
+		object("5620f9bd8e9d3c4ab7e5c9a2", "2015-10-10T15:05:00Z", 2),
+		object("5620f9bd8e9d3c4ab7e5c9a4", "2015-10-10T15:10:00Z", 4),
+		object("5620f9bd8e9d3c4ab7e5c9a5", "2015-10-10T15:15:00Z", 5),
+	}
+
+	values := []int{}
+	add := func(records []map[string]interface{}) {
+		for _, record := range records {
+			values = append(values, int(record["value"].(float64)))
+		}
+	}
+
+	first, cursor := page(t, collection, 2, "")
+	add(first)
+	if cursor == "" {
+		t.Fatal("expected a cursor for the next page")
+	}
+
+	//uploaded between pages: one earlier than the cursor, one with the same time, one later
+	collection = append(collection,
+		object("5620f9bd8e9d3c4ab7e5c9a0", "2015-10-10T14:55:00Z", 100),
+		object("5620f9bd8e9d3c4ab7e5c9a9", "2015-10-10T15:05:00Z", 6),
+		object("5620f9bd8e9d3c4ab7e5c9b0", "2015-10-10T15:20:00Z", 7),
+	)
+
+	for pages := 0; cursor != "" && pages < 10; pages++ {
+		records, next := page(t, collection, 2, cursor)
+		add(records)
+		if len(records) < 2 {
+			break
+		}
+		cursor = next
+	}
+
+	//nothing returned twice or skipped, and the object inserted before the cursor isn't on a later page
+	expected := []int{1, 2, 3, 6, 4, 5, 7}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Fatalf("expected values %v but got %v", expected, values)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"labix.org/v2/mgo/bson"
+)
+
+// the latest object seen from a device
+type deviceStatus struct {
+	Time string `json:"time"`
+	Type string `json:"type"`
+}
+
+// deviceStatusPipeline finds the latest object from each device among the objects matching the query
+func deviceStatusPipeline(query bson.M) []bson.M {
+	match := bson.M{}
+	for field, criteria := range query {
+		match[field] = criteria
+	}
+	match["deviceId"] = bson.M{"$exists": true}
+
+	return []bson.M{
+		{"$match": match},
+		{"$sort": bson.M{"time": -1}},
+		{"$group": bson.M{"_id": "$deviceId", "time": bson.M{"$first": "$time"}, "type": bson.M{"$first": "$type"}}},
+	}
+}
+
+// latestByDevice reads the results of deviceStatusPipeline into a map of deviceId to its latest object
+func latestByDevice(iter resultIter) (map[string]deviceStatus, error) {
+	devices := map[string]deviceStatus{}
+
+	var result map[string]interface{}
+	for iter.Next(&result) {
+		deviceId, _ := result["_id"].(string)
+		latest, _ := result["time"].(string)
+		objType, _ := result["type"].(string)
+		devices[deviceId] = deviceStatus{Time: latest, Type: objType}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
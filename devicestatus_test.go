@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// latestPerDevice does what the $sort and $group stages of deviceStatusPipeline do in mongo
+func latestPerDevice(iter resultIter) resultIter {
+	records := []map[string]interface{}{}
+	var record map[string]interface{}
+	for iter.Next(&record) {
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i]["time"].(string) > records[j]["time"].(string) })
+
+	seen := map[string]bool{}
+	grouped := []map[string]interface{}{}
+	for _, record := range records {
+		deviceId := record["deviceId"].(string)
+		if !seen[deviceId] {
+			seen[deviceId] = true
+			grouped = append(grouped, map[string]interface{}{"_id": deviceId, "time": record["time"], "type": record["type"]})
+		}
+	}
+	return &testIter{records: grouped}
+}
+
+func TestDeviceStatus(t *testing.T) {
+	data := fakeCollection{}
+	add := func(deviceId, objType string, times ...string) {
+		for _, recordTime := range times {
+			data = append(data, map[string]interface{}{"_groupId": "abc123", "_active": true, "_schemaVersion": 1, "deviceId": deviceId, "type": objType, "time": recordTime})
+		}
+	}
+	add("DexG5_123", "cbg", "2015-10-10T15:00:00Z", "2015-10-10T15:05:00Z", "2015-10-01T15:00:00Z")
+	add("DexG5_123", "calibration", "2015-10-10T15:03:00Z")
+	add("Omnipod_456", "bolus", "2015-10-09T12:00:00Z")
+	add("Omnipod_456", "basal", "2015-10-09T18:30:00Z", "2015-10-09T08:00:00Z")
+	add("Contour_789", "smbg", "2015-09-20T08:00:00Z")
+	//objects without a device, e.g. notes, aren't a device
+	data = append(data, map[string]interface{}{"_groupId": "abc123", "_active": true, "_schemaVersion": 1, "type": "note", "time": "2015-10-11T08:00:00Z"})
+
+	query, err := generateMongoQuery(&params{groupId: "abc123", minSchemaVersion: 1, maxSchemaVersion: 1, startDate: "2015-10-01T00:00:00.000Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := deviceStatusPipeline(query)
+	match := pipeline[0]["$match"].(bson.M)
+	if !reflect.DeepEqual(match["deviceId"], bson.M{"$exists": true}) || !reflect.DeepEqual(match["time"], query["time"]) {
+		t.Fatalf("expected the pipeline to match the query's objects with a deviceId but got %v", match)
+	}
+	if _, ok := query["deviceId"]; ok {
+		t.Fatal("the query shouldn't be changed")
+	}
+
+	//the fake collection can't check $exists so the deviceless note is left out here
+	withDevice := fakeCollection{}
+	for _, record := range data {
+		if _, ok := record["deviceId"]; ok {
+			withDevice = append(withDevice, record)
+		}
+	}
+	delete(match, "deviceId")
+
+	devices, err := latestByDevice(latestPerDevice(withDevice.find(match)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]deviceStatus{
+		"DexG5_123":   {Time: "2015-10-10T15:05:00Z", Type: "cbg"},
+		"Omnipod_456": {Time: "2015-10-09T18:30:00Z", Type: "basal"},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Fatalf("expected %v but got %v", expected, devices)
+	}
+
+	if _, err := latestByDevice(&testIter{err: errors.New("cursor killed")}); err == nil {
+		t.Fatal("expected the iterator's error to be returned")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the ways a bucket's values can be combined
+var bucketAggregates = map[string]bool{"avg": true, "min": true, "max": true, "last": true}
+
+// the values of one interval, combined into one
+type valueBucket struct {
+	Time  string  `json:"time"`
+	Value float64 `json:"value"`
+	Count int     `json:"count"`
+}
+
+// parseBucket validates the bucket and agg params, returning the interval (zero when not downsampling)
+// and the aggregate, avg by default. Averaging different types makes no sense so one type is needed
+func parseBucket(bucket string, agg string, types string) (time.Duration, string, error) {
+	if bucket == "" {
+		if agg != "" {
+			return 0, "", fmt.Errorf("agg needs a bucket")
+		}
+		return 0, "", nil
+	}
+
+	interval, err := time.ParseDuration(bucket)
+	if err != nil || interval < time.Minute {
+		return 0, "", fmt.Errorf("bucket must be an interval of at least 1m e.g. 15m, got [%s]", bucket)
+	}
+	if agg == "" {
+		agg = "avg"
+	}
+	if !bucketAggregates[agg] {
+		return 0, "", fmt.Errorf("agg must be avg, min, max or last, got [%s]", agg)
+	}
+	if types == "" || strings.Contains(types, ",") {
+		return 0, "", fmt.Errorf("bucket needs a single type, got [%s]", types)
+	}
+	return interval, agg, nil
+}
+
+// downsample scans objects in time order and combines the values in each interval, with the intervals
+// aligned to the UTC clock e.g. 15m buckets start on the hour and at :15, :30 and :45. Intervals without
+// objects are left out, as are objects without a parsable time or a numeric value
+func downsample(iter resultIter, interval time.Duration, agg string) ([]valueBucket, error) {
+	buckets := []valueBucket{}
+
+	var current *valueBucket
+	var bucketStart time.Time
+	var sum float64
+
+	var result map[string]interface{}
+	for iter.Next(&result) {
+		timeString, _ := result["time"].(string)
+		recordTime, err := time.Parse(time.RFC3339Nano, timeString)
+		if err != nil {
+			continue
+		}
+		var value float64
+		switch v := result["value"].(type) {
+		case float64:
+			value = v
+		case int:
+			value = float64(v)
+		case int64:
+			value = float64(v)
+		default:
+			continue
+		}
+
+		if start := recordTime.UTC().Truncate(interval); current == nil || !start.Equal(bucketStart) {
+			buckets = append(buckets, valueBucket{Time: start.Format(time.RFC3339Nano), Value: value})
+			current = &buckets[len(buckets)-1]
+			bucketStart = start
+			sum = 0
+		}
+
+		sum += value
+		current.Count++
+		switch agg {
+		case "avg":
+			current.Value = sum / float64(current.Count)
+		case "min":
+			if value < current.Value {
+				current.Value = value
+			}
+		case "max":
+			if value > current.Value {
+				current.Value = value
+			}
+		case "last":
+			current.Value = value
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	records := []map[string]interface{}{
+		{"time": "2015-10-10T15:00:00Z", "value": 100.0},
+		{"time": "2015-10-10T15:05:00Z", "value": 120.0},
+		{"time": "2015-10-10T15:14:59.999Z", "value": 110},
+		//on the boundary so starts the next bucket
+		{"time": "2015-10-10T15:15:00Z", "value": 90.0},
+		{"time": "2015-10-10T15:20:00Z", "value": "high"},
+		//no data between 15:30 and 16:00
+		{"time": "2015-10-10T16:01:00Z", "value": 200.0},
+	}
+
+	expected := map[string][]valueBucket{
+		"avg": {
+			{Time: "2015-10-10T15:00:00Z", Value: 110, Count: 3},
+			{Time: "2015-10-10T15:15:00Z", Value: 90, Count: 1},
+			{Time: "2015-10-10T16:00:00Z", Value: 200, Count: 1},
+		},
+		"min": {
+			{Time: "2015-10-10T15:00:00Z", Value: 100, Count: 3},
+			{Time: "2015-10-10T15:15:00Z", Value: 90, Count: 1},
+			{Time: "2015-10-10T16:00:00Z", Value: 200, Count: 1},
+		},
+		"max": {
+			{Time: "2015-10-10T15:00:00Z", Value: 120, Count: 3},
+			{Time: "2015-10-10T15:15:00Z", Value: 90, Count: 1},
+			{Time: "2015-10-10T16:00:00Z", Value: 200, Count: 1},
+		},
+		"last": {
+			{Time: "2015-10-10T15:00:00Z", Value: 110, Count: 3},
+			{Time: "2015-10-10T15:15:00Z", Value: 90, Count: 1},
+			{Time: "2015-10-10T16:00:00Z", Value: 200, Count: 1},
+		},
+	}
+
+	for agg, want := range expected {
+		buckets, err := downsample(&testIter{records: records}, 15*time.Minute, agg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(buckets, want) {
+			t.Errorf("%s: expected %v but got %v", agg, want, buckets)
+		}
+	}
+}
+
+func TestDownsample_hourlyInOtherZone(t *testing.T) {
+	//buckets are aligned to UTC whatever the zone of the times
+	buckets, err := downsample(&testIter{records: []map[string]interface{}{
+		{"time": "2015-10-10T10:59:00-05:00", "value": 5.0},
+		{"time": "2015-10-10T11:01:00-05:00", "value": 7.0},
+	}}, time.Hour, "avg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets[0].Time != "2015-10-10T15:00:00Z" || buckets[1].Time != "2015-10-10T16:00:00Z" {
+		t.Fatalf("expected buckets at 15:00 and 16:00 UTC but got %v", buckets)
+	}
+}
+
+func TestDownsample_iterError(t *testing.T) {
+	if _, err := downsample(&testIter{err: errors.New("cursor lost")}, time.Hour, "avg"); err == nil {
+		t.Fatal("expected the iterator error")
+	}
+}
+
+func TestParseBucket(t *testing.T) {
+	interval, agg, err := parseBucket("15m", "", "cbg")
+	if err != nil || interval != 15*time.Minute || agg != "avg" {
+		t.Fatalf("expected 15m avg but got %s %s %v", interval, agg, err)
+	}
+	if interval, _, err := parseBucket("", "", ""); err != nil || interval != 0 {
+		t.Fatalf("expected no bucket but got %s %v", interval, err)
+	}
+
+	rejected := [][]string{
+		{"", "max", "cbg"},
+		{"15", "avg", "cbg"},
+		{"30s", "avg", "cbg"},
+		{"15m", "median", "cbg"},
+		{"15m", "avg", ""},
+		{"15m", "avg", "cbg,smbg"},
+	}
+	for _, r := range rejected {
+		if _, _, err := parseBucket(r[0], r[1], r[2]); err == nil {
+			t.Errorf("should have rejected bucket=%s agg=%s type=%s", r[0], r[1], r[2])
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// duplicateParams applies the duplicateParams policy to requests that give a query param more than once.
+// Every param takes a single (possibly comma separated) value, so only one of them can be used:
+// "" or "first" uses the first as url.Values.Get does, "last" the last, and "reject" turns the request away
+func duplicateParams(h http.Handler, policy string) http.Handler {
+	if policy == "" || policy == "first" {
+		return h
+	}
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		duplicated := []string{}
+		for name, values := range query {
+			if len(values) > 1 {
+				duplicated = append(duplicated, name)
+			}
+		}
+		if len(duplicated) == 0 {
+			h.ServeHTTP(res, req)
+			return
+		}
+		sort.Strings(duplicated)
+
+		if policy == "reject" {
+			jsonError(res, error_duplicate_params.setInternalMessage(fmt.Errorf("%v given more than once", duplicated)), time.Now())
+			return
+		}
+
+		for _, name := range duplicated {
+			query.Set(name, query[name][len(query[name])-1])
+		}
+		req.URL.RawQuery = query.Encode()
+		h.ServeHTTP(res, req)
+	})
+}
+
+// duplicateValues applies the duplicateValues policy to the comma separated lists in the params, e.g.
+// type=cbg,cbg, which only bloat the $in they become: "" leaves them as they are, "dedupe" keeps the first
+// of each value and "reject" returns an error naming the repeated value
+func duplicateValues(p *params, policy string) error {
+	if policy == "" {
+		return nil
+	}
+	for _, list := range []struct {
+		name   string
+		values *string
+	}{
+		{"type", &p.types},
+		{"subtype", &p.subTypes},
+		{"deviceId", &p.deviceIds},
+		{"uploadId", &p.uploadIds},
+		{"times", &p.times},
+	} {
+		if *list.values == "" {
+			continue
+		}
+		seen := map[string]bool{}
+		unique := []string{}
+		for _, value := range strings.Split(*list.values, ",") {
+			if seen[value] {
+				if policy == "reject" {
+					return fmt.Errorf("%s [%s] is given more than once", list.name, value)
+				}
+				continue
+			}
+			seen[value] = true
+			unique = append(unique, value)
+		}
+		*list.values = strings.Join(unique, ",")
+	}
+	return nil
+}
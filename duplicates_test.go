@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestDuplicateParams(t *testing.T) {
+	var startdate, enddate string
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		startdate = req.URL.Query().Get("startdate")
+		enddate = req.URL.Query().Get("enddate")
+	})
+	url := "/abc123?startdate=2015-10-01T00:00:00Z&enddate=2015-10-31T00:00:00Z&startdate=2015-10-10T00:00:00Z"
+
+	for policy, expected := range map[string]string{"": "2015-10-01T00:00:00Z", "first": "2015-10-01T00:00:00Z", "last": "2015-10-10T00:00:00Z"} {
+		startdate, enddate = "", ""
+		duplicateParams(handler, policy).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+		if startdate != expected || enddate != "2015-10-31T00:00:00Z" {
+			t.Errorf("policy [%s]: expected startdate %s but got %s and enddate %s", policy, expected, startdate, enddate)
+		}
+	}
+
+	startdate = ""
+	res := httptest.NewRecorder()
+	duplicateParams(handler, "reject").ServeHTTP(res, httptest.NewRequest("GET", url, nil))
+	var body detailedError
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if startdate != "" || body.Code != error_duplicate_params.Code || body.Status != http.StatusBadRequest {
+		t.Fatalf("expected the request to be rejected but got %s", res.Body.String())
+	}
+
+	//single params are let through
+	duplicateParams(handler, "reject").ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abc123?startdate=2015-10-01T00:00:00Z", nil))
+	if startdate != "2015-10-01T00:00:00Z" {
+		t.Fatalf("expected the request to be handled but got startdate %s", startdate)
+	}
+}
+
+func TestDuplicateValues(t *testing.T) {
+	query := url.Values{"type": {"cbg,smbg,cbg,cbg"}, "subtype": {"a"}, "deviceId": {"pump,meter,pump"}}
+
+	p, paramsError := getParams(query, &Config{})
+	if paramsError != nil || p.types != "cbg,smbg,cbg,cbg" || p.deviceIds != "pump,meter,pump" {
+		t.Fatalf("expected the repeats to be left by default but got %+v %v", p, paramsError)
+	}
+
+	p, paramsError = getParams(query, &Config{DuplicateValues: "dedupe"})
+	if paramsError != nil || p.types != "cbg,smbg" || p.subTypes != "a" || p.deviceIds != "pump,meter" {
+		t.Fatalf("expected the repeats to be dropped but got %+v %v", p, paramsError)
+	}
+	mongoQuery, err := generateMongoQuery(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types := mongoQuery["type"].(bson.M)["$in"].([]string); len(types) != 2 {
+		t.Fatalf("expected a type $in of 2 but got %v", types)
+	}
+
+	_, paramsError = getParams(query, &Config{DuplicateValues: "reject"})
+	if paramsError == nil || paramsError.Code != error_duplicate_values.Code || paramsError.Status != http.StatusBadRequest {
+		t.Fatalf("expected the repeats to be rejected but got %v", paramsError)
+	}
+	if p, paramsError := getParams(url.Values{"type": {"cbg,smbg"}, "times": {"2015-10-10T15:00:00Z"}}, &Config{DuplicateValues: "reject"}); paramsError != nil || p.types != "cbg,smbg" {
+		t.Fatalf("expected lists without repeats to be accepted but got %v", paramsError)
+	}
+}
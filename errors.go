@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// the status and message returned with an error code
+type errorTemplate struct {
+	Status  int
+	Message string
+}
+
+// errorCatalog is every error code the service returns, so clients can rely on a documented set.
+// Codes are stable: add new entries rather than renaming or reusing existing ones
+var errorCatalog = map[string]errorTemplate{
+	"data_status_check":    {Status: http.StatusInternalServerError, Message: "checking of the status endpoint showed an error"},
+	"data_cant_view":       {Status: http.StatusForbidden, Message: "user is not authorized to view data"},
+	"data_perms_error":     {Status: http.StatusInternalServerError, Message: "error finding permissons for user"},
+	"data_store_error":     {Status: http.StatusInternalServerError, Message: "internal server error"},
+	"data_marshal_error":   {Status: http.StatusInternalServerError, Message: "internal server error"},
+	"params":               {Status: http.StatusInternalServerError, Message: "incorrect parameters"},
+	"data_too_busy":        {Status: http.StatusServiceUnavailable, Message: "too many requests in progress, try again shortly"},
+	"too_many_requests":    {Status: http.StatusTooManyRequests, Message: "you have too many requests in progress, wait for one to finish"},
+	"https_required":       {Status: http.StatusForbidden, Message: "data must be requested over https"},
+	"invalid_user_id":      {Status: http.StatusBadRequest, Message: "userID is not a valid Tidepool id"},
+	"unknown_params":       {Status: http.StatusBadRequest, Message: "unknown parameters"},
+	"date_not_utc":         {Status: http.StatusBadRequest, Message: "startdate and enddate must be UTC e.g. 2015-10-10T15:00:00.000Z"},
+	"data_server_only":     {Status: http.StatusForbidden, Message: "only servers can view this data"},
+	"date_window_required": {Status: http.StatusBadRequest, Message: "a startdate is required for this type"},
+	"duplicate_params":     {Status: http.StatusBadRequest, Message: "parameters can only be given once"},
+	"sort_not_allowed":     {Status: http.StatusBadRequest, Message: "objects can't be sorted by that field"},
+	"query_too_complex":    {Status: http.StatusBadRequest, Message: "too many values in the parameters, split the request up"},
+	"invalid_date":         {Status: http.StatusBadRequest, Message: "dates must be ISO 8601 date/times e.g. 2015-10-10T15:00:00.000Z"},
+	"invalid_param":        {Status: http.StatusBadRequest, Message: "a parameter has an invalid value"},
+	"duplicate_values":     {Status: http.StatusBadRequest, Message: "each value can only be given once in a parameter"},
+	"no_uploads":           {Status: http.StatusNotFound, Message: "the user hasn't uploaded any data"},
+	"too_many_params":      {Status: http.StatusBadRequest, Message: "too many query parameters"},
+	"query_timeout":        {Status: http.StatusGatewayTimeout, Message: "the query took too long, narrow the date range or split the request up"},
+	"invalid_body":         {Status: http.StatusBadRequest, Message: "the request body isn't valid json for this endpoint"},
+}
+
+// catalogError builds the detailedError for a code in the catalog. An unknown code is a programming
+// error, so it panics when the package vars below are initialised rather than at request time
+func catalogError(code string) detailedError {
+	template, ok := errorCatalog[code]
+	if !ok {
+		panic(fmt.Sprintf("error code [%s] isn't in the catalog", code))
+	}
+	return detailedError{Status: template.Status, Code: code, Message: template.Message}
+}
+
+// invalidDate is error_invalid_date with a message naming the param that couldn't be parsed. It isn't translated
+// so the param name isn't lost
+func invalidDate(param string, value string) detailedError {
+	dateError := error_invalid_date.setInternalMessage(fmt.Errorf("%s [%s] can't be parsed", param, value))
+	dateError.Message = fmt.Sprintf("%s must be an ISO 8601 date/time e.g. 2015-10-10T15:00:00.000Z, got [%s]", param, value)
+	return dateError
+}
+
+// invalidParam is error_invalid_param with a message naming the param and what it must be. Like invalidDate it isn't
+// translated
+func invalidParam(param string, value string, must string) detailedError {
+	paramError := error_invalid_param.setInternalMessage(fmt.Errorf("%s [%s] is invalid", param, value))
+	paramError.Message = fmt.Sprintf("%s must be %s, got [%s]", param, must, value)
+	return paramError
+}
+
+var (
+	error_status_check = catalogError("data_status_check")
+
+	error_no_view_permisson = catalogError("data_cant_view")
+	error_no_permissons     = catalogError("data_perms_error")
+	error_running_query     = catalogError("data_store_error")
+	error_loading_events    = catalogError("data_marshal_error")
+	error_incorrect_params  = catalogError("params")
+	error_too_busy          = catalogError("data_too_busy")
+	error_too_many_requests = catalogError("too_many_requests")
+	error_https_required    = catalogError("https_required")
+	error_invalid_user_id   = catalogError("invalid_user_id")
+	error_unknown_params    = catalogError("unknown_params")
+	error_date_not_utc      = catalogError("date_not_utc")
+	error_server_only       = catalogError("data_server_only")
+	error_window_required   = catalogError("date_window_required")
+	error_duplicate_params  = catalogError("duplicate_params")
+	error_sort_not_allowed  = catalogError("sort_not_allowed")
+	error_query_too_complex = catalogError("query_too_complex")
+	error_invalid_date      = catalogError("invalid_date")
+	error_invalid_param     = catalogError("invalid_param")
+	error_duplicate_values  = catalogError("duplicate_values")
+	error_no_uploads        = catalogError("no_uploads")
+	error_too_many_params   = catalogError("too_many_params")
+	error_query_timeout     = catalogError("query_timeout")
+	error_invalid_body      = catalogError("invalid_body")
+)
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCatalogError(t *testing.T) {
+	for code, template := range errorCatalog {
+		err := catalogError(code)
+		if err.Code != code || err.Status != template.Status || err.Message != template.Message {
+			t.Errorf("%s: expected %d %s but got %v", code, template.Status, template.Message, err)
+		}
+		if err.Status < http.StatusBadRequest || err.Message == "" {
+			t.Errorf("%s: expected an error status and a message but got %v", code, err)
+		}
+	}
+
+	expected := map[string]int{
+		"data_cant_view":       http.StatusForbidden,
+		"data_too_busy":        http.StatusServiceUnavailable,
+		"invalid_user_id":      http.StatusBadRequest,
+		"date_window_required": http.StatusBadRequest,
+	}
+	for code, status := range expected {
+		if err := catalogError(code); err.Status != status {
+			t.Errorf("%s: expected status %d but got %d", code, status, err.Status)
+		}
+	}
+}
+
+func TestCatalogError_unknown(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected an unknown code to panic")
+		}
+	}()
+	catalogError("no_such_code")
+}
+
+func TestJsonError_status(t *testing.T) {
+	for _, expected := range []detailedError{
+		error_status_check,
+		error_no_view_permisson,
+		error_no_permissons,
+		error_running_query,
+		error_loading_events,
+		error_incorrect_params,
+		error_too_busy,
+		error_too_many_requests,
+		error_https_required,
+		error_invalid_user_id,
+		error_unknown_params,
+		error_date_not_utc,
+		error_server_only,
+		error_window_required,
+		error_duplicate_params,
+		error_sort_not_allowed,
+		error_query_too_complex,
+		error_invalid_date,
+		error_invalid_param,
+		error_duplicate_values,
+		error_no_uploads,
+		error_too_many_params,
+		error_query_timeout,
+		error_invalid_body,
+	} {
+		res := httptest.NewRecorder()
+		jsonError(res, expected, time.Now())
+
+		if res.Code != expected.Status || res.Code != errorCatalog[expected.Code].Status {
+			t.Errorf("%s: expected status %d but got %d", expected.Code, expected.Status, res.Code)
+		}
+		if contentType := res.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: expected a json content type but got [%s]", expected.Code, contentType)
+		}
+		var body detailedError
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || body.Code != expected.Code || body.Status != expected.Status {
+			t.Errorf("%s: expected the error in the body but got %s", expected.Code, res.Body.String())
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// how often the events endpoint looks for changed objects when eventPollSeconds isn't configured
+const DEFAULT_EVENT_POLL_INTERVAL = 10 * time.Second
+
+// the layout of modifiedTime, which is compared as a string so the time the snapshot was taken must match it
+const MODIFIED_TIME_LAYOUT = "2006-01-02T15:04:05.000Z07:00"
+
+// failedIter is a resultIter for a query that couldn't be run
+type failedIter struct {
+	err error
+}
+
+func (i failedIter) Next(result interface{}) bool { return false }
+func (i failedIter) Close() error                 { return i.err }
+
+// eventStream writes objects as server-sent events, remembering the latest modifiedTime it has sent so
+// the next poll only asks for objects changed since. modifiedTime is only to the millisecond, so polls ask
+// for objects modified at or after it and the ids already sent at that millisecond are skipped
+type eventStream struct {
+	w          io.Writer
+	flush      func()
+	processors []RecordProcessor
+	//the latest modifiedTime sent, or the time the snapshot was taken until an object modified later is sent
+	lastModified string
+	//ids of the objects sent that were modified at lastModified
+	sentAtLast map[string]bool
+	//how many events have been written
+	sent int
+}
+
+// send writes each of the iterator's objects as an event of the given name, with the modifiedTime as its id
+func (s *eventStream) send(event string, iter resultIter) error {
+	var record map[string]interface{}
+	for iter.Next(&record) {
+		modified, _ := record["modifiedTime"].(string)
+		id, _ := record["id"].(string)
+		if modified == s.lastModified && id != "" && s.sentAtLast[id] {
+			record = nil
+			continue
+		}
+		if modified > s.lastModified {
+			s.lastModified = modified
+			s.sentAtLast = map[string]bool{}
+		}
+		if modified == s.lastModified && id != "" {
+			s.sentAtLast[id] = true
+		}
+		delete(record, "modifiedTime")
+
+		processed, err := processRecord(record, s.processors)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		//the driver decodes into the same map each time unless it's reset
+		record = nil
+		if processed == nil {
+			continue
+		}
+
+		bytes, err := json.Marshal(processed)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		if _, err := fmt.Fprintf(s.w, "event: %s\nid: %s\ndata: %s\n\n", event, modified, bytes); err != nil {
+			iter.Close()
+			return err
+		}
+		s.sent++
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+// streamEvents sends every object fetch returns as a snapshot event, then on each tick sends the objects
+// modified since the latest one sent as update events until done is closed. fetch is given the modifiedTime
+// to look from, empty for the snapshot. Polls start from snapshotAt, the time the snapshot was taken, so
+// objects without a modifiedTime don't make every poll fetch everything again. A comment is sent on ticks
+// with no changes so a client that has gone away is noticed
+func streamEvents(s *eventStream, fetch func(since string) resultIter, snapshotAt time.Time, ticks <-chan time.Time, done <-chan struct{}) error {
+	s.lastModified = snapshotAt.UTC().Format(MODIFIED_TIME_LAYOUT)
+	s.sentAtLast = map[string]bool{}
+	if err := s.send("snapshot", fetch("")); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(s.w, "event: ready\ndata: {}\n\n"); err != nil {
+		return err
+	}
+	s.flush()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticks:
+			before := s.sent
+			if err := s.send("update", fetch(s.lastModified)); err != nil {
+				return err
+			}
+			if s.sent == before {
+				if _, err := io.WriteString(s.w, ": no changes\n\n"); err != nil {
+					return err
+				}
+				s.flush()
+			}
+		}
+	}
+}
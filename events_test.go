@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fetchFrom is a fetch for streamEvents over the collection, recording what each poll was given
+func fetchFrom(collection *[]map[string]interface{}, sinces *[]string, fetched chan struct{}) func(since string) resultIter {
+	return func(since string) resultIter {
+		defer func() { fetched <- struct{}{} }()
+		*sinces = append(*sinces, since)
+		found := []map[string]interface{}{}
+		for _, record := range *collection {
+			if modified, _ := record["modifiedTime"].(string); since == "" || modified >= since {
+				copied := map[string]interface{}{}
+				for field, value := range record {
+					copied[field] = value
+				}
+				found = append(found, copied)
+			}
+		}
+		if since != "" {
+			sort.SliceStable(found, func(i, j int) bool {
+				return found[i]["modifiedTime"].(string) < found[j]["modifiedTime"].(string)
+			})
+		}
+		return &testIter{records: found}
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	processors, err := loadRecordProcessors(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collection := []map[string]interface{}{
+		{"id": "a", "type": "cbg", "value": 101, "_groupId": "abc123", "modifiedTime": "2015-10-10T15:00:00.000Z"},
+		{"id": "b", "type": "cbg", "value": 102, "_groupId": "abc123", "modifiedTime": "2015-10-10T15:05:00.000Z"},
+	}
+	sinces := []string{}
+	fetched := make(chan struct{}, 10)
+
+	var out bytes.Buffer
+	flushes := 0
+	stream := &eventStream{w: &out, flush: func() { flushes++ }, processors: processors}
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	finished := make(chan error)
+	snapshotAt := time.Date(2015, 10, 10, 14, 0, 0, 0, time.UTC)
+	go func() {
+		finished <- streamEvents(stream, fetchFrom(&collection, &sinces, fetched), snapshotAt, ticks, done)
+	}()
+
+	<-fetched
+	//nothing changes, the object modified at the last millisecond sent isn't sent again
+	ticks <- time.Now()
+	<-fetched
+	//a record arrives and one is modified between polls
+	collection = append(collection, map[string]interface{}{"id": "c", "type": "smbg", "value": 99, "modifiedTime": "2015-10-10T15:07:00.000Z"})
+	collection[0]["value"] = 100
+	collection[0]["modifiedTime"] = "2015-10-10T15:08:00.000Z"
+	ticks <- time.Now()
+	<-fetched
+	//another is written in the same millisecond as the last one sent
+	collection = append(collection, map[string]interface{}{"id": "d", "type": "cbg", "value": 103, "modifiedTime": "2015-10-10T15:08:00.000Z"})
+	ticks <- time.Now()
+	<-fetched
+	close(done)
+	if err := <-finished; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "event: snapshot\nid: 2015-10-10T15:00:00.000Z\ndata: {\"id\":\"a\",\"type\":\"cbg\",\"value\":101}\n\n" +
+		"event: snapshot\nid: 2015-10-10T15:05:00.000Z\ndata: {\"id\":\"b\",\"type\":\"cbg\",\"value\":102}\n\n" +
+		"event: ready\ndata: {}\n\n" +
+		": no changes\n\n" +
+		"event: update\nid: 2015-10-10T15:07:00.000Z\ndata: {\"id\":\"c\",\"type\":\"smbg\",\"value\":99}\n\n" +
+		"event: update\nid: 2015-10-10T15:08:00.000Z\ndata: {\"id\":\"a\",\"type\":\"cbg\",\"value\":100}\n\n" +
+		"event: update\nid: 2015-10-10T15:08:00.000Z\ndata: {\"id\":\"d\",\"type\":\"cbg\",\"value\":103}\n\n"
+	if out.String() != expected {
+		t.Fatalf("expected\n%s\nbut got\n%s", expected, out.String())
+	}
+	if expectedSinces := []string{"", "2015-10-10T15:05:00.000Z", "2015-10-10T15:05:00.000Z", "2015-10-10T15:08:00.000Z"}; strings.Join(sinces, ",") != strings.Join(expectedSinces, ",") {
+		t.Fatalf("expected polls from %v but got %v", expectedSinces, sinces)
+	}
+	if flushes < 4 {
+		t.Fatalf("expected each batch of events to be flushed but got %d flushes", flushes)
+	}
+}
+
+func TestStreamEvents_noModifiedTime(t *testing.T) {
+	collection := []map[string]interface{}{
+		{"id": "a", "type": "cbg", "value": 101},
+	}
+	sinces := []string{}
+	fetched := make(chan struct{}, 10)
+
+	var out bytes.Buffer
+	stream := &eventStream{w: &out, flush: func() {}}
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	finished := make(chan error)
+	snapshotAt := time.Date(2015, 10, 10, 14, 0, 0, 0, time.UTC)
+	go func() {
+		finished <- streamEvents(stream, fetchFrom(&collection, &sinces, fetched), snapshotAt, ticks, done)
+	}()
+
+	<-fetched
+	ticks <- time.Now()
+	<-fetched
+	close(done)
+	if err := <-finished; err != nil {
+		t.Fatal(err)
+	}
+
+	if expectedSinces := []string{"", "2015-10-10T14:00:00.000Z"}; strings.Join(sinces, ",") != strings.Join(expectedSinces, ",") {
+		t.Fatalf("expected polls from the snapshot time %v but got %v", expectedSinces, sinces)
+	}
+	if strings.Contains(out.String(), "event: update") {
+		t.Fatalf("expected the legacy object not to be sent again but got\n%s", out.String())
+	}
+}
+
+func TestStreamEvents_error(t *testing.T) {
+	var out bytes.Buffer
+	stream := &eventStream{w: &out, flush: func() {}}
+	err := streamEvents(stream, func(since string) resultIter {
+		return &testIter{err: errors.New("cursor killed")}
+	}, time.Now(), nil, nil)
+	if err == nil || out.Len() != 0 {
+		t.Fatalf("expected the snapshot's error to end the stream but got %v and %s", err, out.String())
+	}
+}
+
+func TestStreamEvents_limited(t *testing.T) {
+	streams := newLimiter(2)
+	started := make(chan struct{}, 10)
+	handler := streams.limit(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		fetch := func(since string) resultIter { return &testIter{} }
+		streamEvents(&eventStream{w: res, flush: func() {}}, fetch, time.Now(), nil, req.Context().Done())
+	}))
+
+	open := func() (context.CancelFunc, chan *httptest.ResponseRecorder) {
+		ctx, disconnect := context.WithCancel(context.Background())
+		res := httptest.NewRecorder()
+		finished := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			handler.ServeHTTP(res, httptest.NewRequest("GET", "/abc123/events", nil).WithContext(ctx))
+			finished <- res
+		}()
+		return disconnect, finished
+	}
+
+	disconnectFirst, firstFinished := open()
+	<-started
+	disconnectSecond, _ := open()
+	<-started
+	defer disconnectSecond()
+
+	//a third stream is over the cap
+	_, refused := open()
+	select {
+	case res := <-refused:
+		if res.Code != http.StatusServiceUnavailable || !strings.Contains(res.Body.String(), error_too_busy.Code) {
+			t.Fatalf("expected the third stream to be refused but got %d %s", res.Code, res.Body.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the third stream to be refused straight away")
+	}
+
+	//the first client going away frees its slot
+	disconnectFirst()
+	select {
+	case <-firstFinished:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stream to stop when its client disconnected")
+	}
+	if len(streams) != 1 {
+		t.Fatalf("expected one stream still open but got %d", len(streams))
+	}
+	disconnectThird, _ := open()
+	defer disconnectThird()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("expected a new stream to be let in once one had closed")
+	}
+}
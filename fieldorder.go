@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// marshalOrdered marshals the record with the fields in order first, then the rest sorted by name.
+// encoding/json already sorts the keys of maps, including nested ones, so only the top level needs ordering
+func marshalOrdered(record map[string]interface{}, order []string) ([]byte, error) {
+	if len(order) == 0 {
+		return json.Marshal(record)
+	}
+
+	listed := map[string]bool{}
+	keys := []string{}
+	for _, key := range order {
+		if _, ok := record[key]; ok && !listed[key] {
+			keys = append(keys, key)
+		}
+		listed[key] = true
+	}
+	rest := []string{}
+	for key := range record {
+		if !listed[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	keys = append(keys, rest...)
+
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(record[key])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(name)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
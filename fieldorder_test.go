@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMarshalOrdered(t *testing.T) {
+	record := map[string]interface{}{
+		"value":    101,
+		"units":    "mg/dL",
+		"deviceId": "abc",
+		"time":     "2015-10-10T15:00:00Z",
+		"type":     "cbg",
+		"payload":  map[string]interface{}{"z": 1, "a": 2},
+	}
+
+	expected := `{"type":"cbg","time":"2015-10-10T15:00:00Z","value":101,"deviceId":"abc","payload":{"a":2,"z":1},"units":"mg/dL"}`
+	for i := 0; i < 20; i++ {
+		bytes, err := marshalOrdered(record, []string{"type", "time", "subType", "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bytes) != expected {
+			t.Fatalf("run %d: expected %s but got %s", i, expected, bytes)
+		}
+	}
+
+	//without an order every field is sorted
+	bytes, err := marshalOrdered(record, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"deviceId":"abc","payload":{"a":2,"z":1},"time":"2015-10-10T15:00:00Z","type":"cbg","units":"mg/dL","value":101}`
+	if string(bytes) != expected {
+		t.Fatalf("expected %s but got %s", expected, bytes)
+	}
+}
+
+func TestProcessResults_fieldOrder(t *testing.T) {
+	records := []map[string]interface{}{
+		{"value": 5.5, "type": "smbg", "time": "2015-10-10T15:00:00Z"},
+		{"time": "2015-10-10T16:00:00Z", "value": 6.1, "type": "smbg"},
+	}
+
+	res := httptest.NewRecorder()
+	processResults(res, &testIter{records: records}, resultOptions{emptyStatus: http.StatusOK, fieldOrder: []string{"type", "time"}}, time.Now())
+
+	expected := "[{\"type\":\"smbg\",\"time\":\"2015-10-10T15:00:00Z\",\"value\":5.5},\n{\"type\":\"smbg\",\"time\":\"2015-10-10T16:00:00Z\",\"value\":6.1}]"
+	if res.Body.String() != expected {
+		t.Fatalf("expected %s but got %s", expected, res.Body.String())
+	}
+}
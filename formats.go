@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// the formats /{userID} can respond in, keyed by format param, with the media type clients can ask for in Accept
+var responseFormats = map[string]string{
+	"json":   "application/json",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv",
+	"zip":    "application/zip",
+}
+
+// checkFormat reports whether the format is one /{userID} can respond in
+func checkFormat(format string) error {
+	if _, ok := responseFormats[format]; !ok {
+		names := []string{}
+		for name := range responseFormats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("format must be one of %v, got [%s]", names, format)
+	}
+	return nil
+}
+
+// responseFormat picks the format of a response: the format param when there is one, otherwise the first
+// media type in the Accept header with a format, otherwise the configured default, otherwise json.
+// Wildcards and media types refused with q=0 are passed over
+func responseFormat(param string, accept string, defaultFormat string) (string, error) {
+	if param != "" {
+		return param, checkFormat(param)
+	}
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		parts := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+		refused := false
+		for _, param := range parts[1:] {
+			if q := strings.Replace(param, " ", "", -1); q == "q=0" || q == "q=0.0" {
+				refused = true
+			}
+		}
+		if refused {
+			continue
+		}
+		for format, formatType := range responseFormats {
+			if mediaType == formatType {
+				return format, nil
+			}
+		}
+	}
+
+	if defaultFormat != "" {
+		return defaultFormat, nil
+	}
+	return "json", nil
+}
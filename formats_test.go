@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResponseFormat(t *testing.T) {
+	for _, test := range []struct {
+		param, accept, defaultFormat string
+		expected                     string
+	}{
+		{"", "", "", "json"},
+		{"", "", "zip", "zip"},
+		{"", "*/*", "zip", "zip"},
+		{"", "text/html,application/xhtml+xml,*/*;q=0.8", "zip", "zip"},
+		{"", "application/json", "zip", "json"},
+		{"", "application/zip", "", "zip"},
+		{"", "text/html, application/zip;q=0.9, application/json", "json", "zip"},
+		{"", "application/zip;q=0, application/json", "zip", "json"},
+		{"", "application/zip; q=0.0", "json", "json"},
+		{"json", "application/zip", "zip", "json"},
+		{"zip", "application/json", "json", "zip"},
+		{"", "application/x-ndjson", "", "ndjson"},
+		{"", "application/x-ndjson;q=0, application/json", "", "json"},
+		{"ndjson", "application/json", "json", "ndjson"},
+		{"", "text/csv, application/json;q=0.5", "", "csv"},
+	} {
+		format, err := responseFormat(test.param, test.accept, test.defaultFormat)
+		if err != nil {
+			t.Errorf("unexpected error for %+v: %s", test, err)
+		}
+		if format != test.expected {
+			t.Errorf("expected %s for %+v but got %s", test.expected, test, format)
+		}
+	}
+
+	if _, err := responseFormat("xml", "", "json"); err == nil {
+		t.Error("should have rejected an unknown format param")
+	}
+	if err := checkFormat("xml"); err == nil {
+		t.Error("should have rejected an unknown default format")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+)
+
+// the gap threshold used when gapThresholdMinutes isn't configured
+const DEFAULT_GAP_THRESHOLD = time.Hour
+
+// a period with no data
+type dataGap struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// findGaps scans objects in time order and returns the periods longer than threshold that have no
+// data, including from startDate to the first object and from the last object to endDate when those
+// are given. Objects without a parsable time are skipped
+func findGaps(iter resultIter, startDate string, endDate string, threshold time.Duration) ([]dataGap, error) {
+	gaps := []dataGap{}
+
+	addGap := func(from, to time.Time) {
+		if to.Sub(from) > threshold {
+			gaps = append(gaps, dataGap{Start: from.UTC().Format(time.RFC3339Nano), End: to.UTC().Format(time.RFC3339Nano)})
+		}
+	}
+
+	var previous time.Time
+	if startDate != "" {
+		previous, _ = time.Parse(time.RFC3339Nano, startDate)
+	}
+
+	var result map[string]interface{}
+	for iter.Next(&result) {
+		timeString, _ := result["time"].(string)
+		current, err := time.Parse(time.RFC3339Nano, timeString)
+		if err != nil {
+			continue
+		}
+		if !previous.IsZero() {
+			addGap(previous, current)
+		}
+		previous = current
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	if endDate != "" && !previous.IsZero() {
+		if end, err := time.Parse(time.RFC3339Nano, endDate); err == nil {
+			addGap(previous, end)
+		}
+	}
+
+	return gaps, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindGaps(t *testing.T) {
+	iter := &testIter{records: []map[string]interface{}{
+		{"time": "2015-10-08T15:00:00.000Z"},
+		{"time": "2015-10-08T15:05:00.000Z"},
+		{"time": "2015-10-08T15:10:00.000Z"},
+		//no uploads for most of a day
+		{"time": "2015-10-09T11:00:00.000Z"},
+		{"time": "2015-10-09T11:05:00.000Z"},
+	}}
+
+	gaps, err := findGaps(iter, "", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []dataGap{{Start: "2015-10-08T15:10:00Z", End: "2015-10-09T11:00:00Z"}}
+	if !reflect.DeepEqual(gaps, expected) {
+		t.Fatalf("expected %v but got %v", expected, gaps)
+	}
+}
+
+func TestFindGaps_dateRange(t *testing.T) {
+	iter := &testIter{records: []map[string]interface{}{
+		{"time": "2015-10-08T15:00:00.000Z"},
+		{"time": "2015-10-08T15:30:00.000Z"},
+	}}
+
+	gaps, err := findGaps(iter, "2015-10-08T12:00:00.000Z", "2015-10-08T16:00:00.000Z", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the leading three hours are a gap, the trailing half hour is under the threshold
+	expected := []dataGap{{Start: "2015-10-08T12:00:00Z", End: "2015-10-08T15:00:00Z"}}
+	if !reflect.DeepEqual(gaps, expected) {
+		t.Fatalf("expected %v but got %v", expected, gaps)
+	}
+}
+
+func TestFindGaps_iterError(t *testing.T) {
+	if _, err := findGaps(&testIter{err: errors.New("cursor lost")}, "", "", time.Hour); err == nil {
+		t.Fatal("should have returned the iterator error")
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+
+	"labix.org/v2/mgo"
+)
+
+// indexKey returns the key of the named index so a query can be hinted to use it. Hinting an index that
+// doesn't exist fails the query, so the name is checked against the collection's indexes first
+func indexKey(indexes []mgo.Index, name string) ([]string, error) {
+	for _, index := range indexes {
+		if index.Name == name {
+			return index.Key, nil
+		}
+	}
+	return nil, fmt.Errorf("there is no index named [%s]", name)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"labix.org/v2/mgo"
+)
+
+func TestIndexKey(t *testing.T) {
+	indexes := []mgo.Index{
+		{Name: "_id_", Key: []string{"_id"}},
+		{Name: "_groupId_1__active_1__schemaVersion_1", Key: []string{"_groupId", "_active", "_schemaVersion"}},
+		{Name: "groupTime", Key: []string{"_groupId", "-time"}},
+	}
+
+	key, err := indexKey(indexes, "groupTime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"_groupId", "-time"}; !reflect.DeepEqual(key, expected) {
+		t.Fatalf("expected the hint %v but got %v", expected, key)
+	}
+
+	if _, err := indexKey(indexes, "_groupId_1"); err == nil {
+		t.Fatal("should have rejected an index that doesn't exist")
+	}
+}
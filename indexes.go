@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"labix.org/v2/mgo"
+)
+
+// the indexes the queries rely on, ensured at startup and by POST /indexes. Index based on sort and where keys
+var deviceDataIndexes = []mgo.Index{
+	{Key: []string{"_groupId", "_active", "_schemaVersion"}, Background: true},
+}
+
+// indexes that make queries faster but would take a long time to build on a large collection, so aren't built at
+// startup. They're created by POST /indexes or by an operator, see the README. time serves the default sort
+var maintenanceIndexes = []mgo.Index{
+	{Key: []string{"_groupId", "_active", "time"}, Background: true},
+}
+
+// allIndexes is every index the queries are written for, those built at startup and the maintenance ones
+func allIndexes() []mgo.Index {
+	return append(append([]mgo.Index{}, deviceDataIndexes...), maintenanceIndexes...)
+}
+
+// the part of *mgo.Collection used to ensure indexes
+type indexCollection interface {
+	Indexes() ([]mgo.Index, error)
+	EnsureIndex(index mgo.Index) error
+}
+
+// the part of *mgo.Collection used to prepare it at startup
+type startupCollection interface {
+	indexCollection
+	Create(info *mgo.CollectionInfo) error
+}
+
+// the code mongo gives operations on a database or collection that doesn't exist
+const NAMESPACE_NOT_FOUND = 26
+
+// isNamespaceNotFound reports whether err is mongo saying the database or collection doesn't exist, which
+// older servers only give as a message
+func isNamespaceNotFound(err error) bool {
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		if e.Code == NAMESPACE_NOT_FOUND {
+			return true
+		}
+	case *mgo.LastError:
+		if e.Code == NAMESPACE_NOT_FOUND {
+			return true
+		}
+	}
+	message := err.Error()
+	return strings.Contains(message, "ns not found") || strings.Contains(message, "ns does not exist") || strings.Contains(message, "NamespaceNotFound")
+}
+
+// prepareCollection ensures the collection's indexes at startup. A collection that doesn't exist yet, as on a
+// new deployment or with the wrong database in the connection string, is created when missing is "create".
+// Otherwise the error says which collection is missing and how to fix it rather than mongo's "ns not found"
+func prepareCollection(collection startupCollection, name string, indexes []mgo.Index, missing string) ([]indexResult, error) {
+	results, err := ensureIndexes(collection, indexes)
+	if err == nil || !isNamespaceNotFound(err) {
+		return results, err
+	}
+	if missing != "create" {
+		return nil, fmt.Errorf("collection [%s] doesn't exist: check the database in the mongo connection string, or set missingCollection to \"create\" to create it at startup", name)
+	}
+	if err := collection.Create(&mgo.CollectionInfo{}); err != nil {
+		return nil, fmt.Errorf("collection [%s] doesn't exist and creating it failed: %v", name, err)
+	}
+	return ensureIndexes(collection, indexes)
+}
+
+// what happened to one index when ensuring them
+type indexResult struct {
+	Key     []string `json:"key"`
+	Created bool     `json:"created"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// ensureIndexes creates those of the indexes the collection doesn't already have, reporting for each
+// whether it was created. A failure to create one is reported against it and the rest are still tried
+func ensureIndexes(collection indexCollection, indexes []mgo.Index) ([]indexResult, error) {
+	existing, err := collection.Indexes()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []indexResult{}
+	for _, index := range indexes {
+		result := indexResult{Key: index.Key}
+		if !hasIndexKey(existing, index.Key) {
+			if err := collection.EnsureIndex(index); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Created = true
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func hasIndexKey(indexes []mgo.Index, key []string) bool {
+	for _, index := range indexes {
+		if reflect.DeepEqual(index.Key, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"labix.org/v2/mgo"
+)
+
+type fakeIndexCollection struct {
+	indexes []mgo.Index
+	failKey []string
+	ensured [][]string
+	listErr error
+}
+
+func (c *fakeIndexCollection) Indexes() ([]mgo.Index, error) {
+	return c.indexes, c.listErr
+}
+
+func (c *fakeIndexCollection) EnsureIndex(index mgo.Index) error {
+	c.ensured = append(c.ensured, index.Key)
+	if reflect.DeepEqual(index.Key, c.failKey) {
+		return errors.New("index build failed")
+	}
+	c.indexes = append(c.indexes, index)
+	return nil
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	indexes := []mgo.Index{
+		{Key: []string{"_groupId", "_active", "_schemaVersion"}},
+		{Key: []string{"_groupId", "time"}},
+		{Key: []string{"_groupId", "deviceId"}},
+	}
+	collection := &fakeIndexCollection{
+		indexes: []mgo.Index{{Key: []string{"_id"}}, {Key: []string{"_groupId", "_active", "_schemaVersion"}}},
+		failKey: []string{"_groupId", "deviceId"},
+	}
+
+	results, err := ensureIndexes(collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []indexResult{
+		{Key: []string{"_groupId", "_active", "_schemaVersion"}},
+		{Key: []string{"_groupId", "time"}, Created: true},
+		{Key: []string{"_groupId", "deviceId"}, Error: "index build failed"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("expected %+v but got %+v", expected, results)
+	}
+	if expectedEnsured := [][]string{{"_groupId", "time"}, {"_groupId", "deviceId"}}; !reflect.DeepEqual(collection.ensured, expectedEnsured) {
+		t.Fatalf("expected only the missing indexes to be created but got %v", collection.ensured)
+	}
+
+	//once created an index is left alone
+	collection.ensured = nil
+	collection.failKey = nil
+	results, err = ensureIndexes(collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collection.ensured) != 1 || !results[2].Created || results[1].Created {
+		t.Fatalf("expected only the failed index to be retried but got %+v", results)
+	}
+
+	if _, err := ensureIndexes(&fakeIndexCollection{listErr: errors.New("not authorized")}, indexes); err == nil {
+		t.Fatal("expected the error listing indexes to be returned")
+	}
+}
+
+type fakeStartupCollection struct {
+	fakeIndexCollection
+	missing   bool
+	createErr error
+}
+
+func (c *fakeStartupCollection) Indexes() ([]mgo.Index, error) {
+	if c.missing {
+		return nil, &mgo.QueryError{Code: NAMESPACE_NOT_FOUND, Message: "ns does not exist"}
+	}
+	return c.fakeIndexCollection.Indexes()
+}
+
+func (c *fakeStartupCollection) Create(info *mgo.CollectionInfo) error {
+	if c.createErr == nil {
+		c.missing = false
+	}
+	return c.createErr
+}
+
+func TestPrepareCollection_missing(t *testing.T) {
+	indexes := []mgo.Index{{Key: []string{"_groupId", "time"}}}
+
+	for _, missing := range []string{"", "warn", "fail"} {
+		_, err := prepareCollection(&fakeStartupCollection{missing: true}, "deviceData", indexes, missing)
+		if err == nil || !strings.Contains(err.Error(), "collection [deviceData] doesn't exist") || !strings.Contains(err.Error(), "missingCollection") {
+			t.Errorf("%s: expected a message naming the missing collection but got %v", missing, err)
+		}
+	}
+
+	collection := &fakeStartupCollection{missing: true}
+	results, err := prepareCollection(collection, "deviceData", indexes, "create")
+	if err != nil || len(results) != 1 || !results[0].Created || collection.missing {
+		t.Errorf("expected the collection created and indexed but got %v %v", results, err)
+	}
+
+	_, err = prepareCollection(&fakeStartupCollection{missing: true, createErr: errors.New("not authorized")}, "deviceData", indexes, "create")
+	if err == nil || !strings.Contains(err.Error(), "creating it failed: not authorized") {
+		t.Errorf("expected the create failure but got %v", err)
+	}
+
+	_, err = prepareCollection(&fakeStartupCollection{fakeIndexCollection: fakeIndexCollection{listErr: errors.New("not authorized")}}, "deviceData", indexes, "create")
+	if err == nil || err.Error() != "not authorized" {
+		t.Errorf("expected other errors returned as they are but got %v", err)
+	}
+}
+
+func TestIsNamespaceNotFound(t *testing.T) {
+	for _, err := range []error{
+		&mgo.QueryError{Code: NAMESPACE_NOT_FOUND, Message: "ns does not exist: data.deviceData"},
+		&mgo.LastError{Code: NAMESPACE_NOT_FOUND, Err: "NamespaceNotFound"},
+		errors.New("ns not found"),
+	} {
+		if !isNamespaceNotFound(err) {
+			t.Errorf("expected [%v] to be namespace not found", err)
+		}
+	}
+	if isNamespaceNotFound(&mgo.QueryError{Code: 13, Message: "not authorized"}) {
+		t.Error("expected other errors not to be namespace not found")
+	}
+}
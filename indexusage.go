@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// indexUsage counts the filter shapes of a sample of /{userID} queries and whether mongo's plan for each used
+// an index, so the indexes added are the ones real queries need. It's safe to use from many goroutines
+type indexUsage struct {
+	mutex sync.Mutex
+	//keyed by shape then whether an index was used
+	shapes map[string]map[bool]int64
+}
+
+func newIndexUsage() *indexUsage {
+	return &indexUsage{shapes: map[string]map[bool]int64{}}
+}
+
+func (u *indexUsage) record(shape string, indexed bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.shapes[shape] == nil {
+		u.shapes[shape] = map[bool]int64{}
+	}
+	u.shapes[shape][indexed]++
+}
+
+// writeMetrics writes the counts in the prometheus text format, for /metrics
+func (u *indexUsage) writeMetrics(w io.Writer) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	shapes := []string{}
+	for shape := range u.shapes {
+		shapes = append(shapes, shape)
+	}
+	sort.Strings(shapes)
+
+	fmt.Fprintln(w, "# TYPE tidewhisperer_query_shapes_total counter")
+	for _, shape := range shapes {
+		for _, indexed := range []bool{false, true} {
+			if count, ok := u.shapes[shape][indexed]; ok {
+				fmt.Fprintf(w, "tidewhisperer_query_shapes_total{shape=%q,indexed=\"%t\"} %d\n", shape, indexed, count)
+			}
+		}
+	}
+}
+
+// queryShape is the sorted fields the query filters on, including those inside $or and $and, e.g.
+// _active,_groupId,time,type. The values and operators are left out so the same filters give the same shape
+func queryShape(query bson.M) string {
+	fields := map[string]bool{}
+	addQueryFields(query, fields)
+
+	shape := []string{}
+	for field := range fields {
+		shape = append(shape, field)
+	}
+	sort.Strings(shape)
+	return strings.Join(shape, ",")
+}
+
+func addQueryFields(query bson.M, fields map[string]bool) {
+	for field, value := range query {
+		if !strings.HasPrefix(field, "$") {
+			fields[field] = true
+			continue
+		}
+		if clauses, ok := value.([]bson.M); ok {
+			for _, clause := range clauses {
+				addQueryFields(clause, fields)
+			}
+		}
+	}
+}
+
+// usedIndex reads an explain result, which before mongo 3.0 names the cursor used e.g. BtreeCursor _groupId_1
+// and from 3.0 has a queryPlanner with the winning plan's stages, where IXSCAN is an index scan
+func usedIndex(explain bson.M) bool {
+	if cursor, ok := explain["cursor"].(string); ok {
+		return strings.HasPrefix(cursor, "BtreeCursor")
+	}
+	if planner, ok := explain["queryPlanner"].(bson.M); ok {
+		return hasIndexScan(planner["winningPlan"])
+	}
+	return false
+}
+
+// hasIndexScan looks through a plan stage and those under it for an index scan
+func hasIndexScan(stage interface{}) bool {
+	switch stage := stage.(type) {
+	case bson.M:
+		if stage["stage"] == "IXSCAN" {
+			return true
+		}
+		for _, child := range []string{"inputStage", "inputStages"} {
+			if hasIndexScan(stage[child]) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range stage {
+			if hasIndexScan(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestQueryShape(t *testing.T) {
+	for query, expected := range map[string]string{
+		"type=cbg":                          "_active,_groupId,_schemaVersion,type",
+		"type=cbg,smbg&subtype=x":           "_active,_groupId,_schemaVersion,subType,type",
+		"deviceId=pump-1&uploadId=upload-1": "_active,_groupId,_schemaVersion,deviceId,uploadId",
+		"startdate=2015-10-10T00:00:00Z":    "_active,_groupId,_schemaVersion,time",
+		"type=cbg&startdate=2015-10-10T00:00:00Z&enddate=2015-10-11T00:00:00Z": "_active,_groupId,_schemaVersion,time,type",
+	} {
+		q, _ := url.ParseQuery(query)
+		p, paramsError := getParams(q, &Config{})
+		if paramsError != nil {
+			t.Fatalf("%s: %v", query, paramsError)
+		}
+		p.groupId = "group-abc123"
+		groupDataQuery, err := generateMongoQuery(p)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if shape := queryShape(groupDataQuery); shape != expected {
+			t.Errorf("%s: expected the shape [%s] but got [%s]", query, expected, shape)
+		}
+	}
+
+	//the fields of $or and $and alternatives are part of the shape, but not their values or operators
+	first := queryShape(bson.M{"_groupId": "a", "$and": []bson.M{{"$or": []bson.M{{"time": bson.M{"$gt": "x"}}, {"_id": bson.M{"$gt": "y"}}}}}})
+	second := queryShape(bson.M{"_groupId": "b", "$and": []bson.M{{"$or": []bson.M{{"time": "z"}, {"_id": "w"}}}}})
+	if first != "_groupId,_id,time" || first != second {
+		t.Errorf("expected the same shape for the same fields but got [%s] and [%s]", first, second)
+	}
+}
+
+func TestUsedIndex(t *testing.T) {
+	for _, test := range []struct {
+		explain bson.M
+		indexed bool
+	}{
+		{bson.M{"cursor": "BtreeCursor _groupId_1__active_1_time_1"}, true},
+		{bson.M{"cursor": "BasicCursor"}, false},
+		{bson.M{"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "FETCH", "inputStage": bson.M{"stage": "IXSCAN"}}}}, true},
+		{bson.M{"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "SORT", "inputStage": bson.M{"stage": "OR", "inputStages": []interface{}{bson.M{"stage": "COLLSCAN"}, bson.M{"stage": "IXSCAN"}}}}}}, true},
+		{bson.M{"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "COLLSCAN"}}}, false},
+		{bson.M{}, false},
+	} {
+		if indexed := usedIndex(test.explain); indexed != test.indexed {
+			t.Errorf("%v: expected indexed %t but got %t", test.explain, test.indexed, indexed)
+		}
+	}
+}
+
+func TestIndexUsage_writeMetrics(t *testing.T) {
+	usage := newIndexUsage()
+	usage.record("_active,_groupId,time,type", true)
+	usage.record("_active,_groupId,time,type", true)
+	usage.record("_active,_groupId,deviceId", false)
+
+	var out bytes.Buffer
+	usage.writeMetrics(&out)
+	for _, expected := range []string{
+		`tidewhisperer_query_shapes_total{shape="_active,_groupId,deviceId",indexed="false"} 1`,
+		`tidewhisperer_query_shapes_total{shape="_active,_groupId,time,type",indexed="true"} 2`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected [%s] in\n%s", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), `shape="_active,_groupId,time,type",indexed="false"`) {
+		t.Errorf("expected only the outcomes seen but got\n%s", out.String())
+	}
+}
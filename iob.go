@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+)
+
+// the insulin action used when insulinAction isn't configured, rapid acting insulin in adults
+const (
+	DEFAULT_INSULIN_DURATION = 6 * time.Hour
+	DEFAULT_INSULIN_PEAK     = 75 * time.Minute
+)
+
+// basal and extended boluses are delivered over time, so are counted as a dose every this often
+const DOSE_SLICE = 5 * time.Minute
+
+// the longest a basal or extended bolus runs, so how much further back doses are read for ones started before
+// the window that are still delivering in it
+const MAX_DOSE_DURATION = 24 * time.Hour
+
+// insulinCurve is the exponential insulin action model used by Loop and oref0, given by how long the
+// insulin acts and when its activity peaks
+type insulinCurve struct {
+	tau, a, s float64
+	duration  time.Duration
+}
+
+func newInsulinCurve(duration time.Duration, peak time.Duration) (*insulinCurve, error) {
+	if duration <= 0 || peak <= 0 || 2*peak >= duration {
+		return nil, fmt.Errorf("the insulin peak must be less than half its duration, got peak [%s] duration [%s]", peak, duration)
+	}
+	td := duration.Minutes()
+	tp := peak.Minutes()
+	tau := tp * (1 - tp/td) / (1 - 2*tp/td)
+	a := 2 * tau / td
+	s := 1 / (1 - a + (1+a)*math.Exp(-td/tau))
+	return &insulinCurve{tau: tau, a: a, s: s, duration: duration}, nil
+}
+
+// remaining is the fraction of a dose still on board the given time after it was delivered
+func (c *insulinCurve) remaining(elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 1
+	}
+	if elapsed >= c.duration {
+		return 0
+	}
+	t := elapsed.Minutes()
+	td := c.duration.Minutes()
+	return 1 - c.s*(1-c.a)*((t*t/(c.tau*td*(1-c.a))-t/c.tau-1)*math.Exp(-t/c.tau)+1)
+}
+
+// insulin delivered at a time, or evenly over a duration
+type insulinDose struct {
+	start    time.Time
+	duration time.Duration
+	units    float64
+}
+
+// the insulin on board at a time
+type iobPoint struct {
+	Time string  `json:"time"`
+	IOB  float64 `json:"iob"`
+}
+
+// computeIOB works out the insulin on board every interval from from to to. Doses delivered over time are
+// split into DOSE_SLICE pieces, each counted from the middle of its slice. Doses after a point don't count
+func computeIOB(doses []insulinDose, curve *insulinCurve, from time.Time, to time.Time, interval time.Duration) []iobPoint {
+	type delivery struct {
+		at    time.Time
+		units float64
+	}
+	deliveries := []delivery{}
+	for _, dose := range doses {
+		if dose.duration <= 0 {
+			deliveries = append(deliveries, delivery{at: dose.start, units: dose.units})
+			continue
+		}
+		for offset := time.Duration(0); offset < dose.duration; offset += DOSE_SLICE {
+			slice := DOSE_SLICE
+			if offset+slice > dose.duration {
+				slice = dose.duration - offset
+			}
+			units := dose.units * float64(slice) / float64(dose.duration)
+			deliveries = append(deliveries, delivery{at: dose.start.Add(offset + slice/2), units: units})
+		}
+	}
+
+	points := []iobPoint{}
+	for at := from; !at.After(to); at = at.Add(interval) {
+		iob := 0.0
+		for _, d := range deliveries {
+			if !d.at.After(at) {
+				iob += d.units * curve.remaining(at.Sub(d.at))
+			}
+		}
+		points = append(points, iobPoint{Time: at.UTC().Format(time.RFC3339Nano), IOB: math.Round(iob*1000) / 1000})
+	}
+	return points
+}
+
+// dosesFromRecords reads the insulin delivered by bolus and basal objects. Boluses are given as normal
+// units now and extended units over their duration, basals as a rate in units per hour over their duration,
+// with durations in milliseconds. Objects without a parsable time are skipped
+func dosesFromRecords(iter resultIter) ([]insulinDose, error) {
+	number := func(value interface{}) float64 {
+		switch v := value.(type) {
+		case float64:
+			return v
+		case int:
+			return float64(v)
+		case int64:
+			return float64(v)
+		}
+		return 0
+	}
+
+	doses := []insulinDose{}
+	var result map[string]interface{}
+	for iter.Next(&result) {
+		timeString, _ := result["time"].(string)
+		start, err := time.Parse(time.RFC3339Nano, timeString)
+		if err != nil {
+			continue
+		}
+		duration := time.Duration(number(result["duration"])) * time.Millisecond
+
+		switch result["type"] {
+		case "bolus":
+			if normal := number(result["normal"]); normal > 0 {
+				doses = append(doses, insulinDose{start: start, units: normal})
+			}
+			if extended := number(result["extended"]); extended > 0 && duration > 0 {
+				doses = append(doses, insulinDose{start: start, duration: duration, units: extended})
+			}
+		case "basal":
+			if rate := number(result["rate"]); rate > 0 && duration > 0 {
+				doses = append(doses, insulinDose{start: start, duration: duration, units: rate * duration.Hours()})
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return doses, nil
+}
+
+// clipDoses keeps the part of each dose delivered from from to to, dropping those delivered entirely outside
+// it. A dose over time that's cut short keeps the units delivered in the part that's left
+func clipDoses(doses []insulinDose, from time.Time, to time.Time) []insulinDose {
+	clipped := []insulinDose{}
+	for _, dose := range doses {
+		if dose.duration <= 0 {
+			if !dose.start.Before(from) && !dose.start.After(to) {
+				clipped = append(clipped, dose)
+			}
+			continue
+		}
+		start, end := dose.start, dose.start.Add(dose.duration)
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			continue
+		}
+		units := dose.units * float64(end.Sub(start)) / float64(dose.duration)
+		clipped = append(clipped, insulinDose{start: start, duration: end.Sub(start), units: units})
+	}
+	return clipped
+}
+
+// iobParams returns the /{userID}/iob request's params as the query it runs, bolus and basal objects over the
+// dates asked for or else the last day, so they're checked as queried rather than as the type params given
+func iobParams(q url.Values, now time.Time) url.Values {
+	params := url.Values{}
+	for param, values := range q {
+		params[param] = values
+	}
+	params.Set("type", "bolus,basal")
+	params.Del("subtype")
+	if params.Get("startdate") == "" && params.Get("isoWeek") == "" && params.Get("month") == "" {
+		end := now.UTC()
+		if endDate, err := time.Parse(time.RFC3339Nano, params.Get("enddate")); err == nil {
+			end = endDate
+		}
+		params.Set("startdate", end.Add(-24*time.Hour).Format(time.RFC3339Nano))
+	}
+	return params
+}
+
+// the most points one iob request can ask for
+const MAX_IOB_POINTS = 10000
+
+// iobWindow works out when the insulin on board is wanted from the startdate, enddate and interval params.
+// Without dates it's the last day, every 5 minutes
+func iobWindow(startDate string, endDate string, interval string, now time.Time) (from time.Time, to time.Time, step time.Duration, err error) {
+	to = now.UTC()
+	if endDate != "" {
+		if to, err = time.Parse(time.RFC3339Nano, endDate); err != nil {
+			return
+		}
+	}
+	from = to.Add(-24 * time.Hour)
+	if startDate != "" {
+		if from, err = time.Parse(time.RFC3339Nano, startDate); err != nil {
+			return
+		}
+	}
+	step = 5 * time.Minute
+	if interval != "" {
+		if step, err = time.ParseDuration(interval); err != nil || step < time.Minute {
+			err = fmt.Errorf("interval must be at least 1m e.g. 5m, got [%s]", interval)
+			return
+		}
+	}
+	if to.Before(from) {
+		err = fmt.Errorf("enddate [%s] is before startdate [%s]", endDate, startDate)
+		return
+	}
+	if points := to.Sub(from) / step; points > MAX_IOB_POINTS {
+		err = fmt.Errorf("at most %d points can be requested, the dates and interval give %d", MAX_IOB_POINTS, points)
+	}
+	return
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInsulinCurve(t *testing.T) {
+	curve, err := newInsulinCurve(DEFAULT_INSULIN_DURATION, DEFAULT_INSULIN_PEAK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the fractions remaining for rapid acting insulin from the published exponential model
+	expected := map[time.Duration]float64{
+		0:                  1,
+		30 * time.Minute:   0.9295,
+		60 * time.Minute:   0.7793,
+		75 * time.Minute:   0.6943,
+		120 * time.Minute:  0.4498,
+		180 * time.Minute:  0.2082,
+		240 * time.Minute:  0.0727,
+		300 * time.Minute:  0.0139,
+		360 * time.Minute:  0,
+		-10 * time.Minute:  1,
+		1000 * time.Minute: 0,
+	}
+	for elapsed, fraction := range expected {
+		if got := curve.remaining(elapsed); math.Abs(got-fraction) > 0.0001 {
+			t.Errorf("after %s expected %.4f remaining but got %.4f", elapsed, fraction, got)
+		}
+	}
+
+	for _, bad := range [][]time.Duration{{6 * time.Hour, 3 * time.Hour}, {6 * time.Hour, 0}, {0, time.Hour}} {
+		if _, err := newInsulinCurve(bad[0], bad[1]); err == nil {
+			t.Errorf("should have rejected duration %s peak %s", bad[0], bad[1])
+		}
+	}
+}
+
+func TestComputeIOB(t *testing.T) {
+	curve, _ := newInsulinCurve(DEFAULT_INSULIN_DURATION, DEFAULT_INSULIN_PEAK)
+	from := time.Date(2015, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	doses := []insulinDose{
+		{start: from, units: 4},
+		{start: from.Add(time.Hour), units: 2},
+	}
+	points := computeIOB(doses, curve, from.Add(-time.Hour), from.Add(3*time.Hour), time.Hour)
+
+	expected := []iobPoint{
+		//nothing delivered yet
+		{Time: "2015-10-10T11:00:00Z", IOB: 0},
+		{Time: "2015-10-10T12:00:00Z", IOB: 4},
+		//4 * 0.7793 + 2
+		{Time: "2015-10-10T13:00:00Z", IOB: 5.117},
+		//4 * 0.4498 + 2 * 0.7793
+		{Time: "2015-10-10T14:00:00Z", IOB: 3.358},
+		//4 * 0.2082 + 2 * 0.4498
+		{Time: "2015-10-10T15:00:00Z", IOB: 1.732},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Fatalf("expected %v but got %v", expected, points)
+	}
+}
+
+func TestComputeIOB_overTime(t *testing.T) {
+	curve, _ := newInsulinCurve(DEFAULT_INSULIN_DURATION, DEFAULT_INSULIN_PEAK)
+	from := time.Date(2015, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	//1 U/hr for an hour is 12 slices of 1/12 U, the last at 12:57:30
+	points := computeIOB([]insulinDose{{start: from, duration: time.Hour, units: 1}}, curve, from, from.Add(time.Hour), 30*time.Minute)
+	if points[0].IOB != 0 {
+		t.Fatalf("expected nothing on board at the start but got %v", points[0])
+	}
+	if points[1].IOB <= 0.4 || points[1].IOB >= 0.5 {
+		t.Fatalf("expected a little under half a unit after half an hour but got %v", points[1])
+	}
+	if points[2].IOB <= 0.85 || points[2].IOB >= 1 {
+		t.Fatalf("expected most of the unit on board after an hour but got %v", points[2])
+	}
+}
+
+func TestDosesFromRecords(t *testing.T) {
+	doses, err := dosesFromRecords(&testIter{records: []map[string]interface{}{
+		{"type": "bolus", "subType": "normal", "time": "2015-10-10T12:00:00Z", "normal": 3.5},
+		{"type": "bolus", "subType": "dual/square", "time": "2015-10-10T13:00:00Z", "normal": 1, "extended": 2.0, "duration": 7200000},
+		{"type": "basal", "deliveryType": "scheduled", "time": "2015-10-10T00:00:00Z", "rate": 0.5, "duration": 10800000},
+		{"type": "basal", "deliveryType": "suspend", "time": "2015-10-10T03:00:00Z", "duration": 1800000},
+		{"type": "bolus", "time": "not a time", "normal": 10.0},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(s string) time.Time {
+		parsed, _ := time.Parse(time.RFC3339, s)
+		return parsed
+	}
+	expected := []insulinDose{
+		{start: at("2015-10-10T12:00:00Z"), units: 3.5},
+		{start: at("2015-10-10T13:00:00Z"), units: 1},
+		{start: at("2015-10-10T13:00:00Z"), duration: 2 * time.Hour, units: 2},
+		{start: at("2015-10-10T00:00:00Z"), duration: 3 * time.Hour, units: 1.5},
+	}
+	if !reflect.DeepEqual(doses, expected) {
+		t.Fatalf("expected %v but got %v", expected, doses)
+	}
+
+	if _, err := dosesFromRecords(&testIter{err: errors.New("cursor lost")}); err == nil {
+		t.Fatal("expected the iterator error")
+	}
+}
+
+func TestIobWindow(t *testing.T) {
+	now := time.Date(2015, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	from, to, step, err := iobWindow("", "", "", now)
+	if err != nil || !from.Equal(now.Add(-24*time.Hour)) || !to.Equal(now) || step != 5*time.Minute {
+		t.Fatalf("expected the last day every 5 minutes but got %s %s %s %v", from, to, step, err)
+	}
+
+	from, to, step, err = iobWindow("2015-10-01T00:00:00Z", "2015-10-01T06:00:00Z", "15m", now)
+	if err != nil || from.Hour() != 0 || to.Hour() != 6 || step != 15*time.Minute {
+		t.Fatalf("expected 6 hours every 15 minutes but got %s %s %s %v", from, to, step, err)
+	}
+
+	rejected := [][]string{
+		{"yesterday", "", ""},
+		{"", "", "30s"},
+		{"2015-10-02T00:00:00Z", "2015-10-01T00:00:00Z", ""},
+		{"2014-10-01T00:00:00Z", "2015-10-01T00:00:00Z", "1m"},
+	}
+	for _, r := range rejected {
+		if _, _, _, err := iobWindow(r[0], r[1], r[2], now); err == nil {
+			t.Errorf("should have rejected startdate [%s] enddate [%s] interval [%s]", r[0], r[1], r[2])
+		}
+	}
+}
+
+func TestClipDoses(t *testing.T) {
+	from := time.Date(2015, 10, 10, 0, 0, 0, 0, time.UTC)
+	to := from.Add(6 * time.Hour)
+
+	doses := []insulinDose{
+		{start: from.Add(-time.Hour), units: 5},
+		{start: from.Add(time.Hour), units: 2},
+		{start: from.Add(-2 * time.Hour), duration: 4 * time.Hour, units: 4},
+		{start: from.Add(5 * time.Hour), duration: 2 * time.Hour, units: 1},
+		{start: from.Add(-3 * time.Hour), duration: time.Hour, units: 1},
+	}
+	clipped := clipDoses(doses, from, to)
+	if len(clipped) != 3 {
+		t.Fatalf("expected 3 doses left in the window but got %+v", clipped)
+	}
+	if !clipped[0].start.Equal(from.Add(time.Hour)) || clipped[0].units != 2 {
+		t.Errorf("expected the bolus in the window kept as is but got %+v", clipped[0])
+	}
+	if !clipped[1].start.Equal(from) || clipped[1].duration != 2*time.Hour || clipped[1].units != 2 {
+		t.Errorf("expected the basal started before the window to keep its last 2 hours but got %+v", clipped[1])
+	}
+	if !clipped[2].start.Equal(from.Add(5*time.Hour)) || clipped[2].duration != time.Hour || clipped[2].units != 0.5 {
+		t.Errorf("expected the basal running past the window cut at its end but got %+v", clipped[2])
+	}
+}
+
+func TestIobParams(t *testing.T) {
+	now := time.Date(2015, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	q, _ := url.ParseQuery("type=cbg&subtype=scheduled&interval=15m")
+	params := iobParams(q, now)
+	if params.Get("type") != "bolus,basal" || params.Get("subtype") != "" || params.Get("interval") != "15m" {
+		t.Errorf("expected the bolus and basal query but got %v", params)
+	}
+	if params.Get("startdate") != "2015-10-09T12:00:00Z" {
+		t.Errorf("expected the last day when no dates are given but got %v", params)
+	}
+	if q.Get("type") != "cbg" {
+		t.Error("expected the request's own query to be left alone")
+	}
+
+	q, _ = url.ParseQuery("enddate=2015-10-01T06:00:00Z")
+	if params := iobParams(q, now); params.Get("startdate") != "2015-09-30T06:00:00Z" {
+		t.Errorf("expected the day before the end date but got %v", params)
+	}
+
+	q, _ = url.ParseQuery("month=2015-09")
+	if params := iobParams(q, now); params.Get("startdate") != "" {
+		t.Errorf("expected a month to be left to set the dates but got %v", params)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errorMessages holds the translated messages of the error catalog, keyed by language then code.
+// English is the catalog itself. Codes missing from a language fall back to English
+var errorMessages = map[string]map[string]string{
+	"es": {
+		"data_status_check":    "la comprobación del estado mostró un error",
+		"data_cant_view":       "el usuario no está autorizado para ver los datos",
+		"data_perms_error":     "error al buscar los permisos del usuario",
+		"data_store_error":     "error interno del servidor",
+		"data_marshal_error":   "error interno del servidor",
+		"params":               "parámetros incorrectos",
+		"data_too_busy":        "demasiadas solicitudes en curso, inténtelo de nuevo en breve",
+		"too_many_requests":    "tiene demasiadas solicitudes en curso, espere a que termine una",
+		"https_required":       "los datos deben solicitarse por https",
+		"invalid_user_id":      "el userID no es un id de Tidepool válido",
+		"unknown_params":       "parámetros desconocidos",
+		"date_not_utc":         "startdate y enddate deben estar en UTC, p. ej. 2015-10-10T15:00:00.000Z",
+		"data_server_only":     "solo los servidores pueden ver estos datos",
+		"date_window_required": "se requiere una startdate para este tipo",
+		"duplicate_params":     "los parámetros solo pueden indicarse una vez",
+		"sort_not_allowed":     "los objetos no se pueden ordenar por ese campo",
+		"query_too_complex":    "demasiados valores en los parámetros, divida la solicitud",
+		"duplicate_values":     "cada valor solo puede indicarse una vez en un parámetro",
+		"no_uploads":           "el usuario no ha subido ningún dato",
+		"too_many_params":      "demasiados parámetros de consulta",
+		"query_timeout":        "la consulta tardó demasiado, reduzca el rango de fechas o divida la solicitud",
+		"invalid_body":         "el cuerpo de la solicitud no es un json válido para este endpoint",
+	},
+	"fr": {
+		"data_status_check":    "la vérification de l'état a signalé une erreur",
+		"data_cant_view":       "l'utilisateur n'est pas autorisé à voir les données",
+		"data_perms_error":     "erreur lors de la recherche des autorisations de l'utilisateur",
+		"data_store_error":     "erreur interne du serveur",
+		"data_marshal_error":   "erreur interne du serveur",
+		"params":               "paramètres incorrects",
+		"data_too_busy":        "trop de requêtes en cours, réessayez sous peu",
+		"too_many_requests":    "vous avez trop de requêtes en cours, attendez qu'une se termine",
+		"https_required":       "les données doivent être demandées en https",
+		"invalid_user_id":      "le userID n'est pas un identifiant Tidepool valide",
+		"unknown_params":       "paramètres inconnus",
+		"date_not_utc":         "startdate et enddate doivent être en UTC, par ex. 2015-10-10T15:00:00.000Z",
+		"data_server_only":     "seuls les serveurs peuvent voir ces données",
+		"date_window_required": "une startdate est requise pour ce type",
+		"duplicate_params":     "les paramètres ne peuvent être indiqués qu'une fois",
+		"sort_not_allowed":     "les objets ne peuvent pas être triés selon ce champ",
+		"query_too_complex":    "trop de valeurs dans les paramètres, divisez la requête",
+		"duplicate_values":     "chaque valeur ne peut être indiquée qu'une fois dans un paramètre",
+		"no_uploads":           "l'utilisateur n'a téléversé aucune donnée",
+		"too_many_params":      "trop de paramètres de requête",
+		"query_timeout":        "la requête a pris trop de temps, réduisez la plage de dates ou divisez la requête",
+		"invalid_body":         "le corps de la requête n'est pas un json valide pour ce point d'accès",
+	},
+}
+
+// preferredLanguage picks the first language in the Accept-Language header that there are messages for,
+// matching on the primary tag so fr-CA gets fr. It returns "" for English or when nothing matches
+func preferredLanguage(acceptLanguage string) string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+	languages := []weighted{}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		quality := 1.0
+		for _, field := range fields[1:] {
+			if value := strings.TrimSpace(field); strings.HasPrefix(value, "q=") {
+				if q, err := strconv.ParseFloat(value[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		languages = append(languages, weighted{tag: strings.SplitN(tag, "-", 2)[0], quality: quality})
+	}
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].quality > languages[j].quality })
+
+	for _, language := range languages {
+		if language.quality <= 0 {
+			continue
+		}
+		if language.tag == "en" {
+			return ""
+		}
+		if _, ok := errorMessages[language.tag]; ok {
+			return language.tag
+		}
+	}
+	return ""
+}
+
+// localizedWriter carries the request's language to jsonError
+type localizedWriter struct {
+	http.ResponseWriter
+	language string
+}
+
+func (w *localizedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// localizeErrors makes the errors written by jsonError use the language from the request's Accept-Language.
+// A writer wrapped by another, e.g. to compress, hides the language so the wrapped handler needs localizing too
+func localizeErrors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if language := preferredLanguage(req.Header.Get("Accept-Language")); language != "" {
+			res = &localizedWriter{ResponseWriter: res, language: language}
+		}
+		h.ServeHTTP(res, req)
+	})
+}
+
+// localize replaces the error's message with its translation for the writer's language, if there is one
+func (d detailedError) localize(res http.ResponseWriter) detailedError {
+	if writer, ok := res.(*localizedWriter); ok {
+		if message, ok := errorMessages[writer.language][d.Code]; ok {
+			d.Message = message
+		}
+	}
+	return d
+}
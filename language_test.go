@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPreferredLanguage(t *testing.T) {
+	expected := map[string]string{
+		"":                           "",
+		"fr":                         "fr",
+		"fr-CA,fr;q=0.9":             "fr",
+		"de-DE,de;q=0.9":             "",
+		"de,es;q=0.8,en;q=0.5":       "es",
+		"en-US,en;q=0.9,fr;q=0.8":    "",
+		"fr;q=0.2,es;q=0.7":          "es",
+		"es;q=0,fr;q=0.1":            "fr",
+		"*":                          "",
+		" ES-mx ; q=1 , fr ; q=0.5 ": "es",
+	}
+	for header, language := range expected {
+		if got := preferredLanguage(header); got != language {
+			t.Errorf("Accept-Language [%s]: expected [%s] but got [%s]", header, language, got)
+		}
+	}
+}
+
+func TestLocalizeErrors(t *testing.T) {
+	handler := localizeErrors(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		jsonError(res, error_no_view_permisson, time.Now())
+	}))
+
+	expected := map[string]string{
+		"es-ES,es;q=0.9": "el usuario no está autorizado para ver los datos",
+		"fr":             "l'utilisateur n'est pas autorisé à voir les données",
+		"de":             error_no_view_permisson.Message,
+		"":               error_no_view_permisson.Message,
+	}
+	for header, message := range expected {
+		req := httptest.NewRequest("GET", "/abc123", nil)
+		req.Header.Set("Accept-Language", header)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		var body detailedError
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Message != message || body.Code != error_no_view_permisson.Code {
+			t.Errorf("Accept-Language [%s]: expected [%s] but got %v", header, message, body)
+		}
+	}
+}
+
+func TestErrorMessages_inCatalog(t *testing.T) {
+	for language, messages := range errorMessages {
+		for code := range messages {
+			if _, ok := errorCatalog[code]; !ok {
+				t.Errorf("%s has a message for [%s] which isn't in the catalog", language, code)
+			}
+		}
+	}
+}
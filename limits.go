@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limiter caps how many requests a group of endpoints serves at once. A nil limiter is unlimited
+type limiter chan struct{}
+
+func newLimiter(max int) limiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(limiter, max)
+}
+
+// acquire takes a slot if one is free, it never waits
+func (l limiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// clientLimiter caps how many requests each client IP has in progress at once, so a single client can't
+// take every slot by opening many streaming requests. A nil clientLimiter is unlimited
+type clientLimiter struct {
+	max     int
+	proxies trustedProxies
+
+	mutex    sync.Mutex
+	inFlight map[string]int
+}
+
+func newClientLimiter(max int, proxies trustedProxies) *clientLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &clientLimiter{max: max, proxies: proxies, inFlight: map[string]int{}}
+}
+
+// acquire takes one of the client's slots if it has one free, it never waits
+func (l *clientLimiter) acquire(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.inFlight[ip] >= l.max {
+		return false
+	}
+	l.inFlight[ip]++
+	return true
+}
+
+func (l *clientLimiter) release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.inFlight[ip]--; l.inFlight[ip] <= 0 {
+		delete(l.inFlight, ip)
+	}
+}
+
+// limit wraps a handler so a client's requests beyond its limit are turned away with a 429
+func (l *clientLimiter) limit(h http.Handler) http.Handler {
+	if l == nil {
+		return h
+	}
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ip := l.proxies.clientIP(req)
+		if !l.acquire(ip) {
+			jsonError(res, error_too_many_requests.setInternalMessage(fmt.Errorf("client [%s] already has %d requests in progress", ip, l.max)), time.Now())
+			return
+		}
+		defer l.release(ip)
+		h.ServeHTTP(res, req)
+	})
+}
+
+// limit wraps a handler so requests beyond the limiter's capacity are turned away rather than queued
+func (l limiter) limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !l.acquire() {
+			jsonError(res, error_too_busy, time.Now())
+			return
+		}
+		defer l.release()
+		h.ServeHTTP(res, req)
+	})
+}
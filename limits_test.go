@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimiter_independentLimits(t *testing.T) {
+	raw := newLimiter(2)
+	aggregation := newLimiter(1)
+
+	if !raw.acquire() || !raw.acquire() {
+		t.Fatal("raw limiter should allow two requests")
+	}
+	if raw.acquire() {
+		t.Fatal("raw limiter should be full")
+	}
+
+	//a busy raw limit doesn't hold up aggregation requests
+	if !aggregation.acquire() {
+		t.Fatal("aggregation limiter should allow a request while raw is full")
+	}
+	if aggregation.acquire() {
+		t.Fatal("aggregation limiter should be full")
+	}
+
+	//and releasing aggregation doesn't free a raw slot
+	aggregation.release()
+	if raw.acquire() {
+		t.Fatal("raw limiter should still be full")
+	}
+	raw.release()
+	if !raw.acquire() {
+		t.Fatal("raw limiter should have a free slot after a release")
+	}
+}
+
+func TestLimiter_unlimited(t *testing.T) {
+	unlimited := newLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.acquire() {
+			t.Fatal("a zero limit should be unlimited")
+		}
+	}
+}
+
+func TestLimiter_limit(t *testing.T) {
+	aggregation := newLimiter(1)
+	served := 0
+	handler := aggregation.limit(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		served++
+	}))
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/abc123/gaps", nil))
+	if served != 1 {
+		t.Fatal("request should have been served")
+	}
+
+	aggregation.acquire()
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/abc123/gaps", nil))
+	if served != 1 {
+		t.Fatal("request should have been turned away")
+	}
+	if !strings.Contains(res.Body.String(), error_too_busy.Code) {
+		t.Fatalf("expected a %s error but got %s", error_too_busy.Code, res.Body.String())
+	}
+}
+
+func TestClientLimiter_limit(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := newClientLimiter(2, proxies)
+
+	//requests are held open until released, as streaming requests would be
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := clients.limit(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	request := func(remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/abc123", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	done := make(chan struct{})
+	for _, forwardedFor := range []string{"203.0.113.7", "198.51.100.1, 203.0.113.7"} {
+		go func(forwardedFor string) {
+			request("10.0.0.1:4000", forwardedFor)
+			done <- struct{}{}
+		}(forwardedFor)
+		<-started
+	}
+
+	//the same client through the proxy is at its cap
+	res := request("10.0.0.2:4000", "203.0.113.7")
+	if !strings.Contains(res.Body.String(), error_too_many_requests.Code) {
+		t.Fatalf("expected the third request to be turned away but got %s", res.Body.String())
+	}
+	//a forwarded address from an untrusted client isn't believed
+	go func() {
+		request("203.0.113.99:4000", "203.0.113.7")
+		done <- struct{}{}
+	}()
+	<-started
+	//and other clients behind the same proxy are unaffected
+	go func() {
+		request("10.0.0.1:4000", "198.51.100.20")
+		done <- struct{}{}
+	}()
+	<-started
+
+	close(release)
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	//a finished request frees the client's slot
+	release = make(chan struct{})
+	go func() {
+		request("10.0.0.1:4000", "203.0.113.7")
+		done <- struct{}{}
+	}()
+	<-started
+	close(release)
+	<-done
+}
+
+func TestClientLimiter_unlimited(t *testing.T) {
+	if newClientLimiter(0, nil) != nil {
+		t.Fatal("a zero limit should be unlimited")
+	}
+	served := false
+	newClientLimiter(0, nil).limit(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		served = true
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abc123", nil))
+	if !served {
+		t.Fatal("request should have been served")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"labix.org/v2/mgo/bson"
+)
+
+// a summary of the data an export would return, so clients can decide whether to go ahead
+type manifest struct {
+	Count int    `json:"count"`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	//from the collection's average object size, so only a guide
+	EstimatedBytes int64                  `json:"estimatedBytes"`
+	Types          map[string]typeSummary `json:"types"`
+}
+
+type typeSummary struct {
+	Count int    `json:"count"`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// manifestPipeline counts the objects matching the query and finds their earliest and latest times for each type
+func manifestPipeline(query bson.M) []bson.M {
+	return []bson.M{
+		{"$match": query},
+		{"$group": bson.M{"_id": "$type", "count": bson.M{"$sum": 1}, "start": bson.M{"$min": "$time"}, "end": bson.M{"$max": "$time"}}},
+	}
+}
+
+// buildManifest reads the results of manifestPipeline into a manifest, estimating the size from the
+// average size of the collection's objects
+func buildManifest(iter resultIter, averageObjectSize float64) (*manifest, error) {
+	summary := &manifest{Types: map[string]typeSummary{}}
+
+	var result map[string]interface{}
+	for iter.Next(&result) {
+		objType, _ := result["_id"].(string)
+		typeStart, _ := result["start"].(string)
+		typeEnd, _ := result["end"].(string)
+
+		var count int
+		switch c := result["count"].(type) {
+		case int:
+			count = c
+		case int64:
+			count = int(c)
+		case float64:
+			count = int(c)
+		}
+
+		summary.Types[objType] = typeSummary{Count: count, Start: typeStart, End: typeEnd}
+		summary.Count += count
+		if typeStart != "" && (summary.Start == "" || typeStart < summary.Start) {
+			summary.Start = typeStart
+		}
+		if typeEnd > summary.End {
+			summary.End = typeEnd
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	summary.EstimatedBytes = int64(float64(summary.Count) * averageObjectSize)
+	return summary, nil
+}
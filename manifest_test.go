@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// groupSummaries does what the $group stage of manifestPipeline does in mongo
+func groupSummaries(iter resultIter) resultIter {
+	summaries := map[string]map[string]interface{}{}
+	order := []string{}
+	var record map[string]interface{}
+	for iter.Next(&record) {
+		objType := record["type"].(string)
+		recordTime := record["time"].(string)
+		summary, ok := summaries[objType]
+		if !ok {
+			summary = map[string]interface{}{"_id": objType, "count": 0, "start": recordTime, "end": recordTime}
+			summaries[objType] = summary
+			order = append(order, objType)
+		}
+		summary["count"] = summary["count"].(int) + 1
+		if recordTime < summary["start"].(string) {
+			summary["start"] = recordTime
+		}
+		if recordTime > summary["end"].(string) {
+			summary["end"] = recordTime
+		}
+	}
+	grouped := []map[string]interface{}{}
+	for _, objType := range order {
+		grouped = append(grouped, summaries[objType])
+	}
+	return &testIter{records: grouped}
+}
+
+func TestBuildManifest(t *testing.T) {
+	data := fakeCollection{}
+	add := func(objType string, times ...string) {
+		for _, recordTime := range times {
+			data = append(data, map[string]interface{}{"_groupId": "abc123", "_active": true, "_schemaVersion": 1, "type": objType, "time": recordTime})
+		}
+	}
+	add("cbg", "2015-10-10T15:05:00Z", "2015-10-10T15:00:00Z", "2015-10-12T08:00:00Z")
+	add("bolus", "2015-10-11T12:00:00Z")
+	add("smbg", "2015-09-01T08:00:00Z")
+
+	query, err := generateMongoQuery(&params{groupId: "abc123", minSchemaVersion: 1, maxSchemaVersion: 1, startDate: "2015-10-01T00:00:00.000Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := manifestPipeline(query)
+	if !reflect.DeepEqual(pipeline[0], bson.M{"$match": query}) {
+		t.Fatalf("expected the pipeline to match the query but got %v", pipeline[0])
+	}
+
+	summary, err := buildManifest(groupSummaries(data.find(query)), 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &manifest{
+		Count:          4,
+		Start:          "2015-10-10T15:00:00Z",
+		End:            "2015-10-12T08:00:00Z",
+		EstimatedBytes: 1000,
+		Types: map[string]typeSummary{
+			"cbg":   {Count: 3, Start: "2015-10-10T15:00:00Z", End: "2015-10-12T08:00:00Z"},
+			"bolus": {Count: 1, Start: "2015-10-11T12:00:00Z", End: "2015-10-11T12:00:00Z"},
+		},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected %+v but got %+v", expected, summary)
+	}
+}
+
+func TestBuildManifest_empty(t *testing.T) {
+	summary, err := buildManifest(&testIter{}, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Count != 0 || summary.EstimatedBytes != 0 || len(summary.Types) != 0 || summary.Start != "" {
+		t.Fatalf("expected an empty manifest but got %+v", summary)
+	}
+
+	if _, err := buildManifest(&testIter{err: errors.New("cursor lost")}, 250); err == nil {
+		t.Fatal("expected the iterator error")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the histogram buckets, in seconds, used when metrics.buckets isn't configured
+var defaultMetricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const (
+	OUTCOME_SUCCESS      = "success"
+	OUTCOME_SERVER_ERROR = "server_error"
+	OUTCOME_ERROR        = "error"
+)
+
+// the counts and durations of calls to one downstream client
+type clientStats struct {
+	outcomes map[string]int64
+	buckets  []int64
+	sum      float64
+	count    int64
+}
+
+// clientMetrics records the calls made to downstream services. It's safe to use from many goroutines
+type clientMetrics struct {
+	mutex   sync.Mutex
+	buckets []float64
+	clients map[string]*clientStats
+	//calls given up on, keyed by client then whether the fallback allowed the request
+	fallbacks map[string]map[bool]int64
+}
+
+func newClientMetrics(buckets []float64) *clientMetrics {
+	if len(buckets) == 0 {
+		buckets = defaultMetricsBuckets
+	}
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return &clientMetrics{buckets: sorted, clients: map[string]*clientStats{}, fallbacks: map[string]map[bool]int64{}}
+}
+
+func (m *clientMetrics) record(client, outcome string, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stats, ok := m.clients[client]
+	if !ok {
+		stats = &clientStats{outcomes: map[string]int64{}, buckets: make([]int64, len(m.buckets))}
+		m.clients[client] = stats
+	}
+
+	seconds := duration.Seconds()
+	stats.outcomes[outcome]++
+	stats.sum += seconds
+	stats.count++
+	for i, le := range m.buckets {
+		if seconds <= le {
+			stats.buckets[i]++
+		}
+	}
+}
+
+// recordFallback counts a call to the client that was given up on in favour of a fallback result,
+// so a degraded downstream service shows up even though requests are still answered
+func (m *clientMetrics) recordFallback(client string, allowed bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.fallbacks[client] == nil {
+		m.fallbacks[client] = map[bool]int64{}
+	}
+	m.fallbacks[client][allowed]++
+}
+
+// instrument wraps the transport so each call through it is recorded against the client name
+func (m *clientMetrics) instrument(client string, next http.RoundTripper) http.RoundTripper {
+	return &instrumentedTransport{client: client, next: next, metrics: m}
+}
+
+type instrumentedTransport struct {
+	client  string
+	next    http.RoundTripper
+	metrics *clientMetrics
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+
+	outcome := OUTCOME_SUCCESS
+	if err != nil {
+		outcome = OUTCOME_ERROR
+	} else if res.StatusCode >= http.StatusInternalServerError {
+		outcome = OUTCOME_SERVER_ERROR
+	}
+	t.metrics.record(t.client, outcome, time.Since(start))
+
+	return res, err
+}
+
+// ServeHTTP writes the metrics in the prometheus text format
+func (m *clientMetrics) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := []string{}
+	for name := range m.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(res, "# TYPE tidewhisperer_downstream_requests_total counter")
+	for _, name := range names {
+		outcomes := []string{}
+		for outcome := range m.clients[name].outcomes {
+			outcomes = append(outcomes, outcome)
+		}
+		sort.Strings(outcomes)
+		for _, outcome := range outcomes {
+			fmt.Fprintf(res, "tidewhisperer_downstream_requests_total{client=%q,outcome=%q} %d\n", name, outcome, m.clients[name].outcomes[outcome])
+		}
+	}
+
+	fmt.Fprintln(res, "# TYPE tidewhisperer_downstream_request_duration_seconds histogram")
+	for _, name := range names {
+		stats := m.clients[name]
+		for i, le := range m.buckets {
+			fmt.Fprintf(res, "tidewhisperer_downstream_request_duration_seconds_bucket{client=%q,le=\"%g\"} %d\n", name, le, stats.buckets[i])
+		}
+		fmt.Fprintf(res, "tidewhisperer_downstream_request_duration_seconds_bucket{client=%q,le=\"+Inf\"} %d\n", name, stats.count)
+		fmt.Fprintf(res, "tidewhisperer_downstream_request_duration_seconds_sum{client=%q} %g\n", name, stats.sum)
+		fmt.Fprintf(res, "tidewhisperer_downstream_request_duration_seconds_count{client=%q} %d\n", name, stats.count)
+	}
+
+	fallbackClients := []string{}
+	for name := range m.fallbacks {
+		fallbackClients = append(fallbackClients, name)
+	}
+	sort.Strings(fallbackClients)
+
+	fmt.Fprintln(res, "# TYPE tidewhisperer_downstream_fallbacks_total counter")
+	for _, name := range fallbackClients {
+		for _, allowed := range []bool{false, true} {
+			if count, ok := m.fallbacks[name][allowed]; ok {
+				fmt.Fprintf(res, "tidewhisperer_downstream_fallbacks_total{client=%q,allowed=\"%t\"} %d\n", name, allowed, count)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubTransport struct {
+	status int
+	err    error
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &http.Response{StatusCode: s.status, Body: http.NoBody, Request: req}, nil
+}
+
+func TestClientMetrics(t *testing.T) {
+	metrics := newClientMetrics(nil)
+
+	seagull := &http.Client{Transport: metrics.instrument("seagull", &stubTransport{status: http.StatusOK})}
+	gatekeeper := &http.Client{Transport: metrics.instrument("gatekeeper", &stubTransport{status: http.StatusBadGateway})}
+	shoreline := &http.Client{Transport: metrics.instrument("shoreline", &stubTransport{err: errors.New("connection refused")})}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := seagull.Get("http://seagull/pair"); err == nil {
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if res, err := gatekeeper.Get("http://gatekeeper/access"); err == nil {
+		res.Body.Close()
+	}
+	if _, err := shoreline.Get("http://shoreline/token"); err == nil {
+		t.Fatal("expected the transport error to be returned")
+	}
+
+	res := httptest.NewRecorder()
+	metrics.ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	body := res.Body.String()
+
+	expected := []string{
+		`tidewhisperer_downstream_requests_total{client="seagull",outcome="success"} 10`,
+		`tidewhisperer_downstream_requests_total{client="gatekeeper",outcome="server_error"} 1`,
+		`tidewhisperer_downstream_requests_total{client="shoreline",outcome="error"} 1`,
+		`tidewhisperer_downstream_request_duration_seconds_bucket{client="seagull",le="+Inf"} 10`,
+		`tidewhisperer_downstream_request_duration_seconds_count{client="shoreline"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected [%s] in metrics but got\n%s", line, body)
+		}
+	}
+}
+
+func TestClientMetrics_buckets(t *testing.T) {
+	metrics := newClientMetrics([]float64{1, 0.1})
+	metrics.record("seagull", OUTCOME_SUCCESS, 500*time.Millisecond)
+
+	res := httptest.NewRecorder()
+	metrics.ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	body := res.Body.String()
+
+	if !strings.Contains(body, `{client="seagull",le="0.1"} 0`) || !strings.Contains(body, `{client="seagull",le="1"} 1`) {
+		t.Fatalf("expected the 0.5s call only in the 1s bucket but got\n%s", body)
+	}
+}
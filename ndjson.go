@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// arrayToNDJSON reads a json array, e.g. a saved /{userID} response, and writes each element on a line of its
+// own as format=ndjson does, returning how many it wrote. Elements are read and written one at a time so the
+// array is never all in memory, and each is compacted so a line break inside it can't split it
+func arrayToNDJSON(r io.Reader, w io.Writer) (int, error) {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return 0, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return 0, fmt.Errorf("expected a json array but it starts with [%v]", token)
+	}
+
+	converted := 0
+	var line bytes.Buffer
+	for decoder.More() {
+		var element json.RawMessage
+		if err := decoder.Decode(&element); err != nil {
+			return converted, err
+		}
+		line.Reset()
+		if err := json.Compact(&line, element); err != nil {
+			return converted, err
+		}
+		line.WriteByte('\n')
+		if _, err := w.Write(line.Bytes()); err != nil {
+			return converted, err
+		}
+		converted++
+	}
+	//the closing ] and then nothing more
+	if _, err := decoder.Token(); err != nil {
+		return converted, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return converted, fmt.Errorf("expected the body to end after the array")
+	}
+	return converted, nil
+}
+
+// ndjsonHandler converts the json array posted to it into ndjson, streaming the lines back as the array is
+// read. A body that isn't an array is a 400, one that goes wrong part way through can only be logged
+func ndjsonHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		res.Header().Set("Content-Type", responseFormats["ndjson"])
+		converted, err := arrayToNDJSON(req.Body, res)
+		if err == nil {
+			return
+		}
+		if converted == 0 {
+			res.Header().Del("Content-Type")
+			jsonError(res, error_invalid_body.setInternalMessage(err), start)
+			return
+		}
+		log.Println(DATA_API_PREFIX, fmt.Sprintf("ndjson conversion stopped after [%d] elements: %s", converted, err))
+	})
+}
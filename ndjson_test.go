@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestArrayToNDJSON(t *testing.T) {
+	var out bytes.Buffer
+	converted, err := arrayToNDJSON(strings.NewReader(`[
+		{"type": "cbg", "value": 101},
+		{"type": "smbg",
+		 "value": 5.5, "payload": {"note": "a [bracket], and a \"quote\""}},
+		[1, 2],
+		"late"
+	]`), &out)
+	if err != nil || converted != 4 {
+		t.Fatalf("expected 4 elements converted but got %d %v", converted, err)
+	}
+	expected := `{"type":"cbg","value":101}` + "\n" +
+		`{"type":"smbg","value":5.5,"payload":{"note":"a [bracket], and a \"quote\""}}` + "\n" +
+		`[1,2]` + "\n" +
+		`"late"` + "\n"
+	if out.String() != expected {
+		t.Fatalf("expected\n%s\nbut got\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	if converted, err := arrayToNDJSON(strings.NewReader(`[]`), &out); err != nil || converted != 0 || out.Len() != 0 {
+		t.Fatalf("expected an empty array to give nothing but got %d %v %q", converted, err, out.String())
+	}
+
+	for _, bad := range []string{``, `{"type": "cbg"}`, `[{"type": "cbg"}`, `[{"type": "cbg"}] []`} {
+		if _, err := arrayToNDJSON(strings.NewReader(bad), &bytes.Buffer{}); err == nil {
+			t.Errorf("expected [%s] to be rejected", bad)
+		}
+	}
+}
+
+func TestNDJSONHandler(t *testing.T) {
+	res := httptest.NewRecorder()
+	ndjsonHandler().ServeHTTP(res, httptest.NewRequest("POST", "/ndjson", strings.NewReader(`[{"value": 1}, {"value": 2}]`)))
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/x-ndjson" || res.Body.String() != "{\"value\":1}\n{\"value\":2}\n" {
+		t.Fatalf("expected the array as ndjson but got %d %s %q", res.Code, res.Header().Get("Content-Type"), res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	ndjsonHandler().ServeHTTP(res, httptest.NewRequest("POST", "/ndjson", strings.NewReader(`{"value": 1}`)))
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), error_invalid_body.Code) {
+		t.Fatalf("expected a body that isn't an array to be a 400 but got %d %s", res.Code, res.Body.String())
+	}
+}
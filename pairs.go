@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+// how long a user's own private pair is kept when selfPairCacheMinutes isn't configured
+const DEFAULT_SELF_PAIR_TTL = time.Hour
+
+// the group id queried for users viewing their own data before they've uploaded any, which seagull has no
+// pair for. No objects have it, so each endpoint returns what it would for a user without data
+const NO_UPLOADS_GROUP = "no-uploads"
+
+// pairCache looks up the private pairs users' data is stored under, keeping them for a while rather than asking
+// seagull on every request as a user's pair rarely changes. Users mostly view their own data so their own
+// pairs are kept for selfTTL. Others' are kept for otherTTL, which is 0 and so not kept unless pairCacheMinutes
+// is configured. The permission to view is checked with gatekeeper either way, a pair only says where the data is
+type pairCache struct {
+	seagull  clients.Seagull
+	selfTTL  time.Duration
+	otherTTL time.Duration
+	now      func() time.Time
+
+	mutex sync.Mutex
+	//keyed by userID and hash name
+	pairs map[string]cachedPair
+}
+
+type cachedPair struct {
+	pair      *clients.PrivatePair
+	fetchedAt time.Time
+}
+
+func newPairCache(seagull clients.Seagull, selfTTL time.Duration, otherTTL time.Duration) *pairCache {
+	if selfTTL <= 0 {
+		selfTTL = DEFAULT_SELF_PAIR_TTL
+	}
+	return &pairCache{seagull: seagull, selfTTL: selfTTL, otherTTL: otherTTL, now: time.Now, pairs: map[string]cachedPair{}}
+}
+
+// get returns the user's uploads pair, or nil when seagull doesn't have one
+func (c *pairCache) get(userID string, token string, self bool) *clients.PrivatePair {
+	ttl := c.otherTTL
+	if self {
+		ttl = c.selfTTL
+	}
+	return c.lookup(userID, "uploads", token, ttl)
+}
+
+// lookup returns the pair from the cache if it was fetched within ttl, or else from seagull. Each caller's
+// ttl is checked against when the pair was fetched, so a pair kept for a user's own requests isn't served to
+// others for longer than theirs. Missing pairs aren't kept so a user's first upload is seen straight away,
+// and nothing is kept when ttl isn't positive
+func (c *pairCache) lookup(userID string, hashName string, token string, ttl time.Duration) *clients.PrivatePair {
+	if ttl <= 0 {
+		return c.seagull.GetPrivatePair(userID, hashName, token)
+	}
+
+	key := userID + "/" + hashName
+	c.mutex.Lock()
+	cached, ok := c.pairs[key]
+	c.mutex.Unlock()
+	if ok && c.now().Sub(cached.fetchedAt) < ttl {
+		return cached.pair
+	}
+
+	pair := c.seagull.GetPrivatePair(userID, hashName, token)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dropExpired()
+	if pair == nil {
+		delete(c.pairs, key)
+		return nil
+	}
+	c.pairs[key] = cachedPair{pair: pair, fetchedAt: c.now()}
+	return pair
+}
+
+// dropExpired removes the pairs too old for any caller to be given, so users who stop making requests
+// don't stay in the cache. The mutex must be held
+func (c *pairCache) dropExpired() {
+	longest := c.selfTTL
+	if c.otherTTL > longest {
+		longest = c.otherTTL
+	}
+	now := c.now()
+	for key, cached := range c.pairs {
+		if now.Sub(cached.fetchedAt) >= longest {
+			delete(c.pairs, key)
+		}
+	}
+}
+
+// clear drops every kept pair so the next lookups go to seagull
+func (c *pairCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pairs = map[string]cachedPair{}
+}
+
+// groupId returns the group the user's data is stored under. A user viewing their own data without a pair
+// just hasn't uploaded yet, so noUploads decides what they get: "empty" (the default) the empty result
+// through NO_UPLOADS_GROUP, "notFound" a 404. Without a pair for another user it's an error
+func (c *pairCache) groupId(userID string, token string, self bool, noUploads string) (string, *detailedError) {
+	if pair := c.get(userID, token, self); pair != nil {
+		return pair.ID, nil
+	}
+	if !self {
+		pairError := error_no_permissons.setInternalMessage(fmt.Errorf("no uploads pair for [%s]", userID))
+		return "", &pairError
+	}
+	if noUploads == "notFound" {
+		noUploadsError := error_no_uploads.setInternalMessage(fmt.Errorf("no uploads pair for [%s]", userID))
+		return "", &noUploadsError
+	}
+	return NO_UPLOADS_GROUP, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+type countingSeagull struct {
+	calls map[string]int
+}
+
+func (s *countingSeagull) GetPrivatePair(userID, hashName, token string) *clients.PrivatePair {
+	s.calls[userID]++
+	if userID == "unknown" {
+		return nil
+	}
+	return &clients.PrivatePair{ID: "group-" + userID, Value: "secret"}
+}
+
+func (s *countingSeagull) GetCollection(userID, collectionName, token string, v interface{}) error {
+	return nil
+}
+
+func TestPairCache(t *testing.T) {
+	seagull := &countingSeagull{calls: map[string]int{}}
+	now := time.Date(2015, 10, 10, 15, 0, 0, 0, time.UTC)
+	cache := newPairCache(seagull, time.Minute, 0)
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if pair := cache.get("self", "token", true); pair == nil || pair.ID != "group-self" {
+			t.Fatalf("expected the self pair but got %v", pair)
+		}
+		if pair := cache.get("other", "token", false); pair == nil || pair.ID != "group-other" {
+			t.Fatalf("expected the other pair but got %v", pair)
+		}
+	}
+	if seagull.calls["self"] != 1 {
+		t.Fatalf("expected repeated self access to use the cache but seagull was called %d times", seagull.calls["self"])
+	}
+	if seagull.calls["other"] != 3 {
+		t.Fatalf("expected access to others to bypass the cache but seagull was called %d times", seagull.calls["other"])
+	}
+
+	now = now.Add(2 * time.Minute)
+	cache.get("self", "token", true)
+	if seagull.calls["self"] != 2 {
+		t.Fatalf("expected the expired pair to be fetched again but seagull was called %d times", seagull.calls["self"])
+	}
+
+	//a missing pair isn't cached
+	cache.get("unknown", "token", true)
+	if pair := cache.get("unknown", "token", true); pair != nil || seagull.calls["unknown"] != 2 {
+		t.Fatalf("expected missing pairs to be looked up each time but got %v after %d calls", pair, seagull.calls["unknown"])
+	}
+}
+
+func TestPairCache_others(t *testing.T) {
+	seagull := &countingSeagull{calls: map[string]int{}}
+	now := time.Date(2015, 10, 10, 15, 0, 0, 0, time.UTC)
+	cache := newPairCache(seagull, time.Hour, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if pair := cache.get("other", "token", false); pair == nil || pair.ID != "group-other" {
+			t.Fatalf("expected the other pair but got %v", pair)
+		}
+	}
+	if seagull.calls["other"] != 1 {
+		t.Fatalf("expected repeated access to others to use the cache but seagull was called %d times", seagull.calls["other"])
+	}
+
+	now = now.Add(2 * time.Minute)
+	cache.get("other", "token", false)
+	if seagull.calls["other"] != 2 {
+		t.Fatalf("expected the expired pair to be fetched again but seagull was called %d times", seagull.calls["other"])
+	}
+
+	cache.get("unknown", "token", false)
+	cache.get("unknown", "token", false)
+	if seagull.calls["unknown"] != 2 {
+		t.Fatalf("expected missing pairs to be looked up each time but seagull was called %d times", seagull.calls["unknown"])
+	}
+
+	cache.clear()
+	cache.get("other", "token", false)
+	if seagull.calls["other"] != 3 {
+		t.Fatalf("expected a cleared cache to go to seagull but it was called %d times", seagull.calls["other"])
+	}
+}
+
+func TestPairCache_selfPairServedToOthers(t *testing.T) {
+	seagull := &countingSeagull{calls: map[string]int{}}
+	now := time.Date(2015, 10, 10, 15, 0, 0, 0, time.UTC)
+	cache := newPairCache(seagull, time.Hour, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	//the owner's request keeps the pair for an hour, but others are only given it for a minute
+	cache.get("owner", "token", true)
+	cache.get("owner", "token", false)
+	if seagull.calls["owner"] != 1 {
+		t.Fatalf("expected a fresh pair to be shared but seagull was called %d times", seagull.calls["owner"])
+	}
+	now = now.Add(2 * time.Minute)
+	cache.get("owner", "token", false)
+	if seagull.calls["owner"] != 2 {
+		t.Fatalf("expected others not to be given a pair older than their ttl but seagull was called %d times", seagull.calls["owner"])
+	}
+
+	//pairs older than every ttl are dropped
+	cache.get("viewer", "token", true)
+	now = now.Add(2 * time.Hour)
+	cache.get("other", "token", false)
+	if len(cache.pairs) != 1 {
+		t.Fatalf("expected only the fresh pair to be kept but got %v", cache.pairs)
+	}
+}
+
+func TestPairCache_groupId(t *testing.T) {
+	cache := newPairCache(&countingSeagull{calls: map[string]int{}}, time.Minute, 0)
+
+	if groupId, groupError := cache.groupId("self", "token", true, ""); groupError != nil || groupId != "group-self" {
+		t.Fatalf("expected the user's group but got [%s] %v", groupId, groupError)
+	}
+
+	//a user viewing their own data before uploading any
+	for _, noUploads := range []string{"", "empty"} {
+		groupId, groupError := cache.groupId("unknown", "token", true, noUploads)
+		if groupError != nil || groupId != NO_UPLOADS_GROUP {
+			t.Errorf("%s: expected the empty group but got [%s] %v", noUploads, groupId, groupError)
+		}
+	}
+	groupId, groupError := cache.groupId("unknown", "token", true, "notFound")
+	if groupError == nil || groupError.Code != error_no_uploads.Code || groupError.Status != http.StatusNotFound || groupId != "" {
+		t.Errorf("expected no_uploads but got [%s] %v", groupId, groupError)
+	}
+
+	//someone else's data without a pair is still an error
+	groupId, groupError = cache.groupId("unknown", "token", false, "")
+	if groupError == nil || groupError.Code != error_no_permissons.Code || groupId != "" {
+		t.Errorf("expected the permissions error for another user but got [%s] %v", groupId, groupError)
+	}
+
+	//nothing is stored under the empty group so the data endpoint returns an empty result
+	mongoQuery, err := generateMongoQuery(&params{groupId: NO_UPLOADS_GROUP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection := fakeCollection{{"_groupId": "group-self", "_active": true, "_schemaVersion": 0, "type": "cbg"}}
+	res := httptest.NewRecorder()
+	processResults(res, collection.find(mongoQuery), resultOptions{emptyStatus: http.StatusOK}, time.Now())
+	if res.Code != http.StatusOK || res.Body.String() != "[]" {
+		t.Errorf("expected an empty result but got %d %s", res.Code, res.Body.String())
+	}
+}
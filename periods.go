@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// dates are compared as strings, so the period bounds are written with milliseconds like the stored times
+// or an object at the very start of a period would sort before it
+const PERIOD_DATE_LAYOUT = "2006-01-02T15:04:05.000Z07:00"
+
+// what the timezone and tz params must be, the same wherever they're checked
+const TIME_ZONE_MUST = "a time zone e.g. America/Los_Angeles"
+
+var (
+	isoWeekPattern = regexp.MustCompile(`^(\d{4})-W(\d{2})$`)
+	monthPattern   = regexp.MustCompile(`^(\d{4})-(\d{2})$`)
+)
+
+// isoWeekStart returns the Monday an ISO 8601 week e.g. 2023-W15 starts on, in the zone. Week 1 is the week
+// with the year's first Thursday so it can start in the previous December, and only some years have a week 53
+func isoWeekStart(week string, zone *time.Location) (time.Time, error) {
+	match := isoWeekPattern.FindStringSubmatch(week)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("week [%s] isn't in the form 2023-W15", week)
+	}
+	year, _ := strconv.Atoi(match[1])
+	number, _ := strconv.Atoi(match[2])
+	if number < 1 {
+		return time.Time{}, fmt.Errorf("week [%s] doesn't exist", week)
+	}
+
+	//the 4th of January is always in week 1
+	fourth := time.Date(year, time.January, 4, 0, 0, 0, 0, zone)
+	daysFromMonday := (int(fourth.Weekday()) + 6) % 7
+	start := fourth.AddDate(0, 0, (number-1)*7-daysFromMonday)
+	if weekYear, weekNumber := start.ISOWeek(); weekYear != year || weekNumber != number {
+		return time.Time{}, fmt.Errorf("week [%s] doesn't exist", week)
+	}
+	return start, nil
+}
+
+// monthStart returns the first day of a month e.g. 2023-04, in the zone
+func monthStart(month string, zone *time.Location) (time.Time, error) {
+	match := monthPattern.FindStringSubmatch(month)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("month [%s] isn't in the form 2023-04", month)
+	}
+	year, _ := strconv.Atoi(match[1])
+	number, _ := strconv.Atoi(match[2])
+	if number < 1 || number > 12 {
+		return time.Time{}, fmt.Errorf("month [%s] doesn't exist", month)
+	}
+	return time.Date(year, time.Month(number), 1, 0, 0, 0, 0, zone), nil
+}
+
+// periodDates returns the UTC startdate and enddate covering the period, from its first millisecond to its
+// last. end is the start of the next period, which DST can make other than 7 or a month of days from start
+func periodDates(start time.Time, end time.Time) (string, string) {
+	return start.UTC().Format(PERIOD_DATE_LAYOUT), end.Add(-time.Millisecond).UTC().Format(PERIOD_DATE_LAYOUT)
+}
+
+// calendarPeriod returns the startdate and enddate of the period given by the isoWeek or month param, in the
+// zone of the timezone param or else UTC, so reports can ask for a calendar week or month. Both are empty
+// when neither param was given
+func calendarPeriod(q url.Values) (string, string, *detailedError) {
+	isoWeek, month := q.Get("isoWeek"), q.Get("month")
+	if isoWeek == "" && month == "" {
+		return "", "", nil
+	}
+	if (isoWeek != "" && month != "") || q.Get("startdate") != "" || q.Get("enddate") != "" {
+		param := "isoWeek"
+		if isoWeek == "" {
+			param = "month"
+		}
+		conflictError := invalidParam(param, q.Get(param), "left out with startdate, enddate or the other of isoWeek and month")
+		return "", "", &conflictError
+	}
+
+	zone := time.UTC
+	if timezone := q.Get("timezone"); timezone != "" {
+		var err error
+		if zone, err = time.LoadLocation(timezone); err != nil {
+			zoneError := invalidParam("timezone", timezone, TIME_ZONE_MUST)
+			zoneError.InternalMessage = err.Error()
+			return "", "", &zoneError
+		}
+	}
+
+	if isoWeek != "" {
+		start, err := isoWeekStart(isoWeek, zone)
+		if err != nil {
+			weekError := invalidParam("isoWeek", isoWeek, "an ISO 8601 week e.g. 2023-W15")
+			weekError.InternalMessage = err.Error()
+			return "", "", &weekError
+		}
+		startDate, endDate := periodDates(start, start.AddDate(0, 0, 7))
+		return startDate, endDate, nil
+	}
+	start, err := monthStart(month, zone)
+	if err != nil {
+		monthError := invalidParam("month", month, "a month e.g. 2023-04")
+		monthError.InternalMessage = err.Error()
+		return "", "", &monthError
+	}
+	startDate, endDate := periodDates(start, start.AddDate(0, 1, 0))
+	return startDate, endDate, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCalendarPeriod(t *testing.T) {
+	for _, test := range []struct {
+		query url.Values
+		start string
+		end   string
+	}{
+		{url.Values{"isoWeek": {"2023-W15"}}, "2023-04-10T00:00:00.000Z", "2023-04-16T23:59:59.999Z"},
+		//week 1 can start in the previous year
+		{url.Values{"isoWeek": {"2025-W01"}}, "2024-12-30T00:00:00.000Z", "2025-01-05T23:59:59.999Z"},
+		{url.Values{"isoWeek": {"2020-W53"}}, "2020-12-28T00:00:00.000Z", "2021-01-03T23:59:59.999Z"},
+		{url.Values{"month": {"2023-04"}}, "2023-04-01T00:00:00.000Z", "2023-04-30T23:59:59.999Z"},
+		{url.Values{"month": {"2024-02"}}, "2024-02-01T00:00:00.000Z", "2024-02-29T23:59:59.999Z"},
+		{url.Values{"month": {"2023-12"}}, "2023-12-01T00:00:00.000Z", "2023-12-31T23:59:59.999Z"},
+		{url.Values{"month": {"2023-04"}, "timezone": {"America/Los_Angeles"}}, "2023-04-01T07:00:00.000Z", "2023-05-01T06:59:59.999Z"},
+		//the week the clocks change in is an hour short
+		{url.Values{"isoWeek": {"2023-W12"}, "timezone": {"Europe/Paris"}}, "2023-03-19T23:00:00.000Z", "2023-03-26T21:59:59.999Z"},
+	} {
+		start, end, periodError := calendarPeriod(test.query)
+		if periodError != nil || start != test.start || end != test.end {
+			t.Errorf("%v: expected %s to %s but got %s to %s %v", test.query, test.start, test.end, start, end, periodError)
+		}
+	}
+
+	if start, end, periodError := calendarPeriod(url.Values{"startdate": {"2023-04-01T00:00:00Z"}}); periodError != nil || start != "" || end != "" {
+		t.Errorf("expected no period without isoWeek or month but got %s to %s %v", start, end, periodError)
+	}
+}
+
+func TestCalendarPeriod_invalid(t *testing.T) {
+	for _, test := range []struct {
+		query url.Values
+		code  string
+	}{
+		{url.Values{"isoWeek": {"2023-15"}}, error_invalid_param.Code},
+		{url.Values{"isoWeek": {"2023-W00"}}, error_invalid_param.Code},
+		{url.Values{"isoWeek": {"2023-W53"}}, error_invalid_param.Code},
+		{url.Values{"month": {"2023-4"}}, error_invalid_param.Code},
+		{url.Values{"month": {"2023-13"}}, error_invalid_param.Code},
+		{url.Values{"month": {"2023-04"}, "timezone": {"Mars/Olympus"}}, error_invalid_param.Code},
+		{url.Values{"month": {"2023-04"}, "isoWeek": {"2023-W15"}}, error_invalid_param.Code},
+		{url.Values{"month": {"2023-04"}, "startdate": {"2023-04-01T00:00:00Z"}}, error_invalid_param.Code},
+	} {
+		if _, _, periodError := calendarPeriod(test.query); periodError == nil || periodError.Code != test.code || periodError.Status != http.StatusBadRequest {
+			t.Errorf("%v: expected %s but got %v", test.query, test.code, periodError)
+		}
+	}
+}
+
+func TestTimezone_sameStatus(t *testing.T) {
+	//a bad timezone is the same 400 whether or not it's used for a period
+	_, _, periodError := calendarPeriod(url.Values{"month": {"2023-04"}, "timezone": {"Mars/Olympus"}})
+	_, paramsError := parseDataRequest(url.Values{"timezone": {"Mars/Olympus"}}, "", &Config{})
+	if periodError == nil || paramsError == nil || periodError.Status != http.StatusBadRequest || *periodError != *paramsError {
+		t.Fatalf("expected the same error for the timezone but got %+v and %+v", periodError, paramsError)
+	}
+}
+
+func TestGetParams_period(t *testing.T) {
+	p, paramsError := getParams(url.Values{"month": {"2023-04"}, "type": {"cbg"}}, &Config{DefaultWindowDays: map[string]int{"cbg": 30}})
+	if paramsError != nil || p.startDate != "2023-04-01T00:00:00.000Z" || p.endDate != "2023-04-30T23:59:59.999Z" {
+		t.Fatalf("expected the month's dates rather than the default window but got %v %v", p, paramsError)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+const (
+	GATEKEEPER_FALLBACK_DENY         = "deny"
+	GATEKEEPER_FALLBACK_CACHED_ALLOW = "cachedAllow"
+)
+
+// how long a gatekeeper allow is remembered for the cachedAllow fallback when cacheMinutes isn't configured
+const DEFAULT_ALLOW_CACHE_TTL = time.Hour
+
+// permissionChecker asks gatekeeper whether one user can view another's data. When gatekeeper is slow
+// the check gives up after the timeout rather than holding up the request, and falls back to denying
+// or, for cachedAllow, to allowing viewers gatekeeper allowed recently
+type permissionChecker struct {
+	gatekeeper clients.Gatekeeper
+	timeout    time.Duration
+	fallback   string
+	ttl        time.Duration
+	metrics    *clientMetrics
+	now        func() time.Time
+
+	mutex   sync.Mutex
+	allowed map[[2]string]time.Time
+}
+
+func newPermissionChecker(gatekeeper clients.Gatekeeper, timeout time.Duration, fallback string, ttl time.Duration, metrics *clientMetrics) *permissionChecker {
+	if fallback == "" {
+		fallback = GATEKEEPER_FALLBACK_DENY
+	}
+	if ttl <= 0 {
+		ttl = DEFAULT_ALLOW_CACHE_TTL
+	}
+	return &permissionChecker{
+		gatekeeper: gatekeeper,
+		timeout:    timeout,
+		fallback:   fallback,
+		ttl:        ttl,
+		metrics:    metrics,
+		now:        time.Now,
+		allowed:    map[[2]string]time.Time{},
+	}
+}
+
+type permissionsResult struct {
+	perms map[string]clients.Permissions
+	err   error
+}
+
+// canView reports whether userID can view the data of groupID
+func (c *permissionChecker) canView(userID, groupID string) bool {
+	if userID == groupID {
+		return true
+	}
+
+	//buffered so a late answer doesn't leave the lookup stuck once we've stopped waiting
+	results := make(chan permissionsResult, 1)
+	go func() {
+		perms, err := c.gatekeeper.UserInGroup(userID, groupID)
+		results <- permissionsResult{perms, err}
+	}()
+
+	var timedOut <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			log.Println(DATA_API_PREFIX, "Error looking up user in group", result.err)
+			return false
+		}
+		allowed := !(result.perms["root"] == nil && result.perms["view"] == nil)
+		c.remember(userID, groupID, allowed)
+		return allowed
+	case <-timedOut:
+		allowed := c.fallback == GATEKEEPER_FALLBACK_CACHED_ALLOW && c.recentlyAllowed(userID, groupID)
+		log.Printf("%s gatekeeper took longer than %s, falling back to %s, allowed %t", DATA_API_PREFIX, c.timeout, c.fallback, allowed)
+		if c.metrics != nil {
+			c.metrics.recordFallback("gatekeeper", allowed)
+		}
+		return allowed
+	}
+}
+
+func (c *permissionChecker) remember(userID, groupID string, allowed bool) {
+	if c.fallback != GATEKEEPER_FALLBACK_CACHED_ALLOW {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	//expired allows are dropped here so the map only holds the pairs allowed within the ttl
+	for pair, at := range c.allowed {
+		if now.Sub(at) >= c.ttl {
+			delete(c.allowed, pair)
+		}
+	}
+	if allowed {
+		c.allowed[[2]string{userID, groupID}] = now
+	} else {
+		delete(c.allowed, [2]string{userID, groupID})
+	}
+}
+
+func (c *permissionChecker) recentlyAllowed(userID, groupID string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pair := [2]string{userID, groupID}
+	at, ok := c.allowed[pair]
+	if ok && c.now().Sub(at) >= c.ttl {
+		delete(c.allowed, pair)
+		return false
+	}
+	return ok
+}
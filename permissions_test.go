@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+type slowGatekeeper struct {
+	delay time.Duration
+	view  bool
+}
+
+func (g *slowGatekeeper) UserInGroup(userID, groupID string) (map[string]clients.Permissions, error) {
+	time.Sleep(g.delay)
+	if !g.view {
+		return map[string]clients.Permissions{}, nil
+	}
+	return map[string]clients.Permissions{"view": {}}, nil
+}
+
+func (g *slowGatekeeper) SetPermissions(userID, groupID string, permissions clients.Permissions) (clients.Permissions, error) {
+	return nil, nil
+}
+
+func TestPermissionChecker_timeout(t *testing.T) {
+	gatekeeper := &slowGatekeeper{view: true}
+	metrics := newClientMetrics(nil)
+	deny := newPermissionChecker(gatekeeper, 20*time.Millisecond, "", 0, metrics)
+	cached := newPermissionChecker(gatekeeper, 20*time.Millisecond, GATEKEEPER_FALLBACK_CACHED_ALLOW, time.Minute, metrics)
+	now := time.Date(2015, 10, 10, 15, 0, 0, 0, time.UTC)
+	cached.now = func() time.Time { return now }
+
+	//a prompt gatekeeper answers as usual, and cachedAllow remembers the answer
+	if !deny.canView("viewer", "owner") || !cached.canView("viewer", "owner") {
+		t.Fatal("expected the viewer to be allowed while gatekeeper is prompt")
+	}
+
+	gatekeeper.delay = 200 * time.Millisecond
+	started := time.Now()
+	if deny.canView("viewer", "owner") {
+		t.Fatal("expected the deny fallback to deny")
+	}
+	if time.Since(started) > 100*time.Millisecond {
+		t.Fatalf("expected the check to give up after the timeout but it took %s", time.Since(started))
+	}
+	if !cached.canView("viewer", "owner") {
+		t.Fatal("expected the cachedAllow fallback to allow a recently allowed viewer")
+	}
+	if cached.canView("stranger", "owner") {
+		t.Fatal("expected the cachedAllow fallback to deny a viewer gatekeeper hasn't allowed")
+	}
+	now = now.Add(2 * time.Minute)
+	if cached.canView("viewer", "owner") {
+		t.Fatal("expected the cachedAllow fallback to deny once the allow has expired")
+	}
+
+	//self access never needs gatekeeper
+	if !deny.canView("owner", "owner") {
+		t.Fatal("expected users to always be able to view their own data")
+	}
+
+	res := httptest.NewRecorder()
+	metrics.ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`tidewhisperer_downstream_fallbacks_total{client="gatekeeper",allowed="false"} 3`,
+		`tidewhisperer_downstream_fallbacks_total{client="gatekeeper",allowed="true"} 1`,
+	} {
+		if !strings.Contains(res.Body.String(), line) {
+			t.Errorf("expected metrics to contain %s but got\n%s", line, res.Body.String())
+		}
+	}
+}
+
+func TestPermissionChecker_expiredAllowsDropped(t *testing.T) {
+	checker := newPermissionChecker(&slowGatekeeper{view: true}, time.Second, GATEKEEPER_FALLBACK_CACHED_ALLOW, time.Minute, nil)
+	now := time.Date(2015, 10, 10, 15, 0, 0, 0, time.UTC)
+	checker.now = func() time.Time { return now }
+
+	checker.canView("first", "owner")
+	checker.canView("second", "owner")
+	now = now.Add(2 * time.Minute)
+	checker.canView("third", "owner")
+	if len(checker.allowed) != 1 {
+		t.Fatalf("expected only the allow within the ttl to be kept but got %v", checker.allowed)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if checker.recentlyAllowed("third", "owner") || len(checker.allowed) != 0 {
+		t.Fatalf("expected the expired allow to be dropped when looked up but got %v", checker.allowed)
+	}
+}
+
+func TestPermissionChecker_noTimeout(t *testing.T) {
+	checker := newPermissionChecker(&slowGatekeeper{delay: 30 * time.Millisecond}, 0, GATEKEEPER_FALLBACK_CACHED_ALLOW, 0, nil)
+	if checker.canView("viewer", "owner") {
+		t.Fatal("expected gatekeeper's deny to be waited for and returned")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// RecordProcessor transforms each record before it is returned, so deployment specific changes
+// (unit conversion, redaction, renaming) don't need a fork. Returning a nil record drops it
+type RecordProcessor interface {
+	Process(record map[string]interface{}) (map[string]interface{}, error)
+}
+
+// RecordProcessorFunc lets an ordinary function be used as a RecordProcessor
+type RecordProcessorFunc func(record map[string]interface{}) (map[string]interface{}, error)
+
+func (f RecordProcessorFunc) Process(record map[string]interface{}) (map[string]interface{}, error) {
+	return f(record)
+}
+
+// fields used internally that are never returned to clients
+var internalFields = []string{"_id", "_groupId", "_version", "_active", "_schemaVersion", "createdTime", "modifiedTime", SOURCE_FIELD}
+
+// the field tagSource adds. It's internal so any stored value is dropped rather than mistaken for the tag
+const SOURCE_FIELD = "_source"
+
+// the processors used when recordProcessors isn't configured. normalizeUnits rewrites stored units so clients
+// relying on them as stored aren't given it unless it's configured
+var defaultRecordProcessors = []string{"stripInternalFields"}
+
+// the processors that can be named in the recordProcessors config. Deployments can add their own
+// with registerRecordProcessor from an init func in a file of their own
+var recordProcessors = map[string]RecordProcessor{
+	"stripInternalFields": RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		for _, field := range internalFields {
+			delete(record, field)
+		}
+		return record, nil
+	}),
+	"normalizeUnits": newUnitNormalizer(nil),
+}
+
+func registerRecordProcessor(name string, processor RecordProcessor) {
+	recordProcessors[name] = processor
+}
+
+// loadRecordProcessors looks up the named processors, in the order they should run
+func loadRecordProcessors(names []string) ([]RecordProcessor, error) {
+	if len(names) == 0 {
+		names = defaultRecordProcessors
+	}
+	processors := []RecordProcessor{}
+	for _, name := range names {
+		processor, ok := recordProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown record processor [%s]", name)
+		}
+		processors = append(processors, processor)
+	}
+	return processors, nil
+}
+
+// tagSource returns a processor adding the collection each record was read from, for clients combining
+// records from more than one source
+func tagSource(collection string) RecordProcessor {
+	return RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		record[SOURCE_FIELD] = collection
+		return record, nil
+	})
+}
+
+// processRecord runs the record through each processor in turn, stopping if one drops it
+func processRecord(record map[string]interface{}, processors []RecordProcessor) (map[string]interface{}, error) {
+	var err error
+	for _, processor := range processors {
+		if record, err = processor.Process(record); err != nil || record == nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// internalFieldsProjection excludes the internal fields in the query so they aren't even fetched
+func internalFieldsProjection() bson.M {
+	projection := bson.M{}
+	for _, field := range internalFields {
+		projection[field] = 0
+	}
+	return projection
+}
+
+// fieldsProjection includes only the fields asked for by the fields param, or every field but the internal
+// ones when it wasn't given. parseFields has already refused internal fields
+func fieldsProjection(fields []string) bson.M {
+	if len(fields) == 0 {
+		return internalFieldsProjection()
+	}
+	projection := bson.M{"_id": 0}
+	for _, field := range fields {
+		projection[field] = 1
+	}
+	return projection
+}
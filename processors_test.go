@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestProcessResults_customProcessor(t *testing.T) {
+	registerRecordProcessor("mgdlToMmol", RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		if record["units"] == "mg/dL" {
+			record["value"] = record["value"].(float64) / 18.0
+			record["units"] = "mmol/L"
+		}
+		return record, nil
+	}))
+	registerRecordProcessor("dropCalibrations", RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		if record["type"] == "deviceMeta" {
+			return nil, nil
+		}
+		return record, nil
+	}))
+
+	processors, err := loadRecordProcessors([]string{"stripInternalFields", "mgdlToMmol", "dropCalibrations"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iter := &testIter{records: []map[string]interface{}{
+		{"type": "cbg", "units": "mg/dL", "value": 90.0, "_groupId": "xyz", "_schemaVersion": 1},
+		{"type": "deviceMeta"},
+		{"type": "smbg", "units": "mmol/L", "value": 5.5},
+	}}
+	res := httptest.NewRecorder()
+	processResults(res, iter, resultOptions{emptyStatus: http.StatusOK, processors: processors}, time.Now())
+
+	expected := "[{\"type\":\"cbg\",\"units\":\"mmol/L\",\"value\":5},\n{\"type\":\"smbg\",\"units\":\"mmol/L\",\"value\":5.5}]"
+	if res.Body.String() != expected {
+		t.Fatalf("expected %s but got %s", expected, res.Body.String())
+	}
+}
+
+func TestLoadRecordProcessors(t *testing.T) {
+	processors, err := loadRecordProcessors(nil)
+	if err != nil || len(processors) != 1 {
+		t.Fatalf("expected the default processors but got %v %v", processors, err)
+	}
+
+	record, err := processRecord(map[string]interface{}{"type": "cbg", "units": "mg/dl", "_id": "1", "_active": true, "modifiedTime": "x"}, processors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record) != 2 || record["type"] != "cbg" || record["units"] != "mg/dl" {
+		t.Fatalf("expected the internal fields stripped and the units left as stored but got %v", record)
+	}
+
+	if processors, err = loadRecordProcessors([]string{"stripInternalFields", "normalizeUnits"}); err != nil || len(processors) != 2 {
+		t.Fatalf("expected normalizeUnits to be configurable but got %v %v", processors, err)
+	}
+	if record, err = processRecord(map[string]interface{}{"type": "cbg", "units": "mg/dl"}, processors); err != nil || record["units"] != "mg/dL" {
+		t.Fatalf("expected the units normalized once configured but got %v %v", record, err)
+	}
+
+	if _, err := loadRecordProcessors([]string{"missing"}); err == nil {
+		t.Fatal("should have rejected an unknown processor")
+	}
+}
+
+func TestProcessResults_processorError(t *testing.T) {
+	failing := RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("can't convert")
+	})
+
+	res := httptest.NewRecorder()
+	processResults(res, &testIter{records: []map[string]interface{}{{"type": "cbg"}}}, resultOptions{emptyStatus: http.StatusOK, processors: []RecordProcessor{failing}}, time.Now())
+	if !strings.Contains(res.Body.String(), error_loading_events.Code) {
+		t.Fatalf("expected a %s error but got %s", error_loading_events.Code, res.Body.String())
+	}
+}
+
+func TestProcessResults_tagSource(t *testing.T) {
+	processors, err := loadRecordProcessors(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for source, expected := range map[string]string{
+		"deviceData": "[{\"_source\":\"deviceData\",\"type\":\"cbg\"},\n{\"_source\":\"deviceData\",\"type\":\"smbg\"}]",
+		"tombstones": "[{\"_source\":\"tombstones\",\"type\":\"cbg\"},\n{\"_source\":\"tombstones\",\"type\":\"smbg\"}]",
+	} {
+		//a stored _source is an ordinary internal field and never mistaken for the tag
+		iter := &testIter{records: []map[string]interface{}{
+			{"type": "cbg", "_source": "device", "_groupId": "xyz"},
+			{"type": "smbg"},
+		}}
+		res := httptest.NewRecorder()
+		processResults(res, iter, resultOptions{emptyStatus: http.StatusOK, processors: append(processors, tagSource(source))}, time.Now())
+		if res.Body.String() != expected {
+			t.Errorf("expected %s but got %s", expected, res.Body.String())
+		}
+	}
+}
+
+func TestFieldsProjection(t *testing.T) {
+	expected := bson.M{"_id": 0, "time": 1, "value": 1, "payload.note": 1}
+	if projection := fieldsProjection([]string{"time", "value", "payload.note"}); !reflect.DeepEqual(projection, expected) {
+		t.Fatalf("expected %v but got %v", expected, projection)
+	}
+	if projection := fieldsProjection(nil); !reflect.DeepEqual(projection, internalFieldsProjection()) {
+		t.Fatalf("expected the internal fields excluded without fields but got %v", projection)
+	}
+}
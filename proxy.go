@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// trustedProxies are the networks whose forwarding headers (e.g. X-Forwarded-Proto) are believed.
+// Headers on requests from anywhere else are ignored
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies reads a list of IPs and CIDR ranges e.g. ["10.0.0.0/8", "127.0.0.1"]
+func parseTrustedProxies(entries []string) (trustedProxies, error) {
+	proxies := trustedProxies{}
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy [%s]: %s", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// trusts reports whether a request's RemoteAddr is one of the trusted proxies
+func (t trustedProxies) trusts(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheme returns the scheme the client used, which is X-Forwarded-Proto when the request came
+// through a trusted proxy
+func (t trustedProxies) scheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	if forwarded := req.Header.Get("X-Forwarded-Proto"); forwarded != "" && t.trusts(req.RemoteAddr) {
+		return strings.ToLower(strings.TrimSpace(strings.Split(forwarded, ",")[0]))
+	}
+	return "http"
+}
+
+// clientIP returns the address of the client. For requests through trusted proxies that's the nearest
+// address in X-Forwarded-For that isn't itself a trusted proxy, as anything further along could be made up
+func (t trustedProxies) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !t.trusts(req.RemoteAddr) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		host = ip
+		if !t.trusts(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// requireHTTPS wraps a handler so requests the client made over plain http are either rejected
+// (policy "reject") or redirected to https (policy "redirect"). Any other policy lets them through
+func requireHTTPS(h http.Handler, policy string, proxies trustedProxies) http.Handler {
+	if policy != "reject" && policy != "redirect" {
+		return h
+	}
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if proxies.scheme(req) == "https" {
+			h.ServeHTTP(res, req)
+			return
+		}
+		if policy == "redirect" {
+			http.Redirect(res, req, "https://"+req.Host+req.URL.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		jsonError(res, error_https_required, time.Now())
+	})
+}
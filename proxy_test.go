@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireHTTPS(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := false
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) { served = true })
+
+	request := func(remoteAddr, forwardedProto string) *http.Request {
+		req := httptest.NewRequest("GET", "http://data.example.com/abc123?type=cbg", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", forwardedProto)
+		}
+		return req
+	}
+
+	for _, policy := range []string{"reject", "redirect"} {
+		secured := requireHTTPS(handler, policy, proxies)
+
+		served = false
+		secured.ServeHTTP(httptest.NewRecorder(), request("10.1.2.3:5000", "https"))
+		if !served {
+			t.Fatalf("%s: https forwarded by a trusted proxy should be served", policy)
+		}
+
+		served = false
+		secured.ServeHTTP(httptest.NewRecorder(), request("192.168.1.5:5000", "https"))
+		if !served {
+			t.Fatalf("%s: https forwarded by a trusted proxy ip should be served", policy)
+		}
+
+		for _, req := range []*http.Request{
+			request("10.1.2.3:5000", "http"),
+			//the header can't be trusted from anywhere else
+			request("203.0.113.9:5000", "https"),
+		} {
+			served = false
+			res := httptest.NewRecorder()
+			secured.ServeHTTP(res, req)
+			if served {
+				t.Fatalf("%s: http from %s shouldn't be served", policy, req.RemoteAddr)
+			}
+			if policy == "redirect" {
+				if res.Code != http.StatusMovedPermanently || res.Header().Get("Location") != "https://data.example.com/abc123?type=cbg" {
+					t.Fatalf("expected a redirect to https but got %d to %s", res.Code, res.Header().Get("Location"))
+				}
+			} else if !strings.Contains(res.Body.String(), error_https_required.Code) {
+				t.Fatalf("expected a %s error but got %s", error_https_required.Code, res.Body.String())
+			}
+		}
+	}
+
+	served = false
+	requireHTTPS(handler, "", proxies).ServeHTTP(httptest.NewRecorder(), request("203.0.113.9:5000", "http"))
+	if !served {
+		t.Fatal("http should be served when no policy is configured")
+	}
+}
+
+func TestParseTrustedProxies_invalid(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("should have rejected an invalid range")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		remoteAddr   string
+		forwardedFor []string
+		expected     string
+	}{
+		{"203.0.113.7:4000", nil, "203.0.113.7"},
+		{"203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"10.0.0.1:4000", nil, "10.0.0.1"},
+		{"10.0.0.1:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:4000", []string{"6.6.6.6, 198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"10.0.0.1:4000", []string{"6.6.6.6", "198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:4000", []string{"10.0.0.5"}, "10.0.0.5"},
+	} {
+		req := httptest.NewRequest("GET", "/abc123", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header["X-Forwarded-For"] = test.forwardedFor
+		if ip := proxies.clientIP(req); ip != test.expected {
+			t.Errorf("expected %s from %s forwarding %v but got %s", test.expected, test.remoteAddr, test.forwardedFor, ip)
+		}
+	}
+}
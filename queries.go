@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// an in-flight data request
+type activeQuery struct {
+	RequestId string    `json:"requestId"`
+	UserId    string    `json:"userId"`
+	Started   time.Time `json:"started"`
+	Params    string    `json:"params"`
+}
+
+// queryRegistry tracks the data requests in progress so a runaway query can be found during an incident
+type queryRegistry struct {
+	mutex   sync.Mutex
+	queries map[string]activeQuery
+}
+
+func newQueryRegistry() *queryRegistry {
+	return &queryRegistry{queries: map[string]activeQuery{}}
+}
+
+func (r *queryRegistry) add(query activeQuery) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.queries[query.RequestId] = query
+}
+
+func (r *queryRegistry) remove(requestId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.queries, requestId)
+}
+
+// list returns the queries in progress, longest running first
+func (r *queryRegistry) list() []activeQuery {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	queries := []activeQuery{}
+	for _, query := range r.queries {
+		queries = append(queries, query)
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i].Started.Before(queries[j].Started) })
+	return queries
+}
+
+func (r *queryRegistry) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	bytes, err := json.Marshal(r.list())
+	if err != nil {
+		jsonError(res, error_loading_events.setInternalMessage(err), time.Now())
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(bytes)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryRegistry(t *testing.T) {
+	registry := newQueryRegistry()
+	started := time.Date(2015, 10, 10, 15, 0, 0, 0, time.UTC)
+
+	registry.add(activeQuery{RequestId: "second", UserId: "abc123", Started: started.Add(time.Minute), Params: "type=smbg"})
+	registry.add(activeQuery{RequestId: "first", UserId: "def456", Started: started, Params: "type=cbg"})
+
+	res := httptest.NewRecorder()
+	registry.ServeHTTP(res, httptest.NewRequest("GET", "/queries", nil))
+
+	var listed []activeQuery
+	if err := json.Unmarshal(res.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].RequestId != "first" || listed[0].UserId != "def456" || listed[0].Params != "type=cbg" || listed[1].RequestId != "second" {
+		t.Fatalf("expected both queries, longest running first, but got %v", listed)
+	}
+
+	registry.remove("first")
+	if listed := registry.list(); len(listed) != 1 || listed[0].RequestId != "second" {
+		t.Fatalf("expected the finished query to be removed but got %v", listed)
+	}
+
+	registry.remove("second")
+	res = httptest.NewRecorder()
+	registry.ServeHTTP(res, httptest.NewRequest("GET", "/queries", nil))
+	if res.Body.String() != "[]" {
+		t.Fatalf("expected no queries but got %s", res.Body.String())
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"labix.org/v2/mgo"
+)
+
+// queryOptions is how a /{userID} query is batched, hinted, sorted and paged. The query and the explain of
+// a sampled one are both built from it so the plan explained is the one that was run
+type queryOptions struct {
+	batch int
+	hint  []string
+	sort  []string
+	limit int
+	skip  int
+}
+
+// dataQueryOptions works out the options for the request. pageSize returns the most recent first, a
+// limit, offset or cursor needs _id to break ties between objects with the same time, and collapseBasals
+// needs time order whatever else was asked for
+func dataQueryOptions(r *dataRequest, hintKey []string) queryOptions {
+	options := queryOptions{batch: r.batchSize, hint: hintKey, skip: r.offset}
+
+	switch {
+	case r.collapseBasals:
+		options.sort = []string{"time"}
+	case r.limit > 0 || r.offset > 0 || r.cursor:
+		options.sort = append(append([]string{}, r.sortKeys...), "_id")
+	case len(r.sortKeys) > 0:
+		options.sort = r.sortKeys
+	case r.pageSize > 0:
+		options.sort = []string{"-time"}
+	}
+
+	if r.limit > 0 {
+		options.limit = r.limit
+	} else if r.pageSize > 0 {
+		options.limit = r.pageSize
+	}
+	return options
+}
+
+func (o queryOptions) apply(query *mgo.Query) *mgo.Query {
+	//0 leaves the driver's default
+	if o.batch > 0 {
+		query = query.Batch(o.batch)
+	}
+	if len(o.hint) > 0 {
+		query = query.Hint(o.hint...)
+	}
+	if len(o.sort) > 0 {
+		query = query.Sort(o.sort...)
+	}
+	if o.limit > 0 {
+		query = query.Limit(o.limit)
+	}
+	if o.skip > 0 {
+		query = query.Skip(o.skip)
+	}
+	return query
+}
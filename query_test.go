@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestDataQueryOptions(t *testing.T) {
+	tests := []struct {
+		request  dataRequest
+		expected queryOptions
+	}{
+		{request: dataRequest{}, expected: queryOptions{}},
+		{request: dataRequest{sortKeys: []string{"time"}}, expected: queryOptions{sort: []string{"time"}}},
+		{request: dataRequest{pageSize: 10}, expected: queryOptions{sort: []string{"-time"}, limit: 10}},
+		{
+			request:  dataRequest{sortKeys: []string{"-deviceTime"}, limit: 50, offset: 100},
+			expected: queryOptions{sort: []string{"-deviceTime", "_id"}, limit: 50, skip: 100},
+		},
+		{request: dataRequest{sortKeys: []string{"time"}, cursor: true}, expected: queryOptions{sort: []string{"time", "_id"}}},
+		{request: dataRequest{collapseBasals: true}, expected: queryOptions{sort: []string{"time"}}},
+	}
+	for _, test := range tests {
+		request := test.request
+		if options := dataQueryOptions(&request, nil); !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%+v: expected %+v but got %+v", test.request, test.expected, options)
+		}
+	}
+
+	sortKeys := make([]string, 1, 2)
+	sortKeys[0] = "time"
+	dataQueryOptions(&dataRequest{sortKeys: sortKeys, limit: 10}, nil)
+	if sortKeys[:2][1] != "" {
+		t.Error("expected the _id tie break not to be written into the request's sort keys")
+	}
+
+	if options := dataQueryOptions(&dataRequest{}, []string{"_groupId", "time"}); len(options.hint) != 2 {
+		t.Errorf("expected the hint to be kept but got %+v", options)
+	}
+}
+
+func TestDataQueryOptions_batchSize(t *testing.T) {
+	config := &Config{}
+	config.BatchSize.Default = 500
+	config.BatchSize.Maximum = 1000
+
+	for query, expected := range map[string]int{"": 500, "batchSize=250": 250, "batchSize=5000": 1000} {
+		q, _ := url.ParseQuery(query)
+		r, paramsError := parseDataRequest(q, "", config)
+		if paramsError != nil {
+			t.Fatalf("[%s]: %v", query, paramsError)
+		}
+		if options := dataQueryOptions(r, nil); options.batch != expected {
+			t.Errorf("[%s]: expected the query to be batched by %d but got %d", query, expected, options.batch)
+		}
+	}
+
+	if options := dataQueryOptions(&dataRequest{}, nil); options.batch != 0 {
+		t.Errorf("expected the driver's default batch size without one configured but got %d", options.batch)
+	}
+}
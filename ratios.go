@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// the carb ratio applied by a bolus given for carbs, worked out from what was delivered
+type carbRatio struct {
+	Time      string  `json:"time"`
+	CarbInput float64 `json:"carbInput"`
+	//units delivered for the carbs, the bolus less any correction the wizard recommended
+	Insulin float64 `json:"insulin"`
+	//grams of carbs per unit delivered
+	Ratio float64 `json:"ratio"`
+	//the ratio the wizard was set to, when it recorded one
+	Programmed float64 `json:"programmed,omitempty"`
+}
+
+// computeRatios correlates the wizard objects read from iter with the boluses they led to, which are given by
+// the wizard's bolus field either as the bolus object's id or as the bolus itself. A wizard without carbs or
+// whose bolus isn't found is left out, as are those where the bolus was no more than the correction, since
+// then nothing was given for the carbs. Ratios are in time order
+func computeRatios(iter resultIter) ([]carbRatio, error) {
+	wizards := []map[string]interface{}{}
+	boluses := map[string]map[string]interface{}{}
+
+	var result map[string]interface{}
+	for iter.Next(&result) {
+		switch result["type"] {
+		case "wizard":
+			wizards = append(wizards, result)
+		case "bolus":
+			if id, ok := result["id"].(string); ok {
+				boluses[id] = result
+			}
+		}
+		//the records are kept so the driver mustn't decode into them again
+		result = nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	ratios := []carbRatio{}
+	for _, wizard := range wizards {
+		carbs, _ := numberValue(wizard["carbInput"])
+		if carbs <= 0 {
+			continue
+		}
+		bolus, ok := wizard["bolus"].(map[string]interface{})
+		if !ok {
+			id, _ := wizard["bolus"].(string)
+			if bolus, ok = boluses[id]; !ok {
+				continue
+			}
+		}
+		normal, _ := numberValue(bolus["normal"])
+		extended, _ := numberValue(bolus["extended"])
+		insulin := normal + extended
+		if recommended, ok := wizard["recommended"].(map[string]interface{}); ok {
+			if correction, _ := numberValue(recommended["correction"]); correction > 0 {
+				insulin -= correction
+			}
+		}
+		if insulin <= 0 {
+			continue
+		}
+
+		timeString, _ := wizard["time"].(string)
+		ratio := carbRatio{
+			Time:      timeString,
+			CarbInput: carbs,
+			Insulin:   math.Round(insulin*1000) / 1000,
+			Ratio:     math.Round(carbs/insulin*10) / 10,
+		}
+		ratio.Programmed, _ = numberValue(wizard["insulinCarbRatio"])
+		ratios = append(ratios, ratio)
+	}
+	sort.SliceStable(ratios, func(i, j int) bool { return ratios[i].Time < ratios[j].Time })
+	return ratios, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestComputeRatios(t *testing.T) {
+	records := []map[string]interface{}{
+		//wizard pointing at a bolus by id, with a correction
+		{"type": "wizard", "time": "2015-10-10T12:00:00Z", "carbInput": 60, "insulinCarbRatio": 10, "bolus": "bolus-1",
+			"recommended": map[string]interface{}{"carb": 6.0, "correction": 1.5, "net": 7.5}},
+		{"type": "bolus", "id": "bolus-1", "time": "2015-10-10T12:00:01Z", "normal": 7.5},
+		//a dual wave bolus embedded in the wizard, the user gave less than recommended
+		{"type": "wizard", "time": "2015-10-10T08:00:00Z", "carbInput": 45.0, "insulinCarbRatio": 12,
+			"bolus": map[string]interface{}{"type": "bolus", "normal": 2.0, "extended": 1.0}},
+		//a correction only, no carbs
+		{"type": "wizard", "time": "2015-10-10T15:00:00Z", "carbInput": 0, "bolus": "bolus-2",
+			"recommended": map[string]interface{}{"correction": 2.0}},
+		{"type": "bolus", "id": "bolus-2", "time": "2015-10-10T15:00:01Z", "normal": 2.0},
+		//the bolus was cancelled down to no more than the correction
+		{"type": "wizard", "time": "2015-10-10T18:00:00Z", "carbInput": 30, "bolus": "bolus-3",
+			"recommended": map[string]interface{}{"carb": 3.0, "correction": 1.0}},
+		{"type": "bolus", "id": "bolus-3", "time": "2015-10-10T18:00:01Z", "normal": 0.8},
+		//the bolus isn't in the range read
+		{"type": "wizard", "time": "2015-10-10T23:59:59Z", "carbInput": 20, "bolus": "bolus-4"},
+	}
+
+	ratios, err := computeRatios(&testIter{records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []carbRatio{
+		{Time: "2015-10-10T08:00:00Z", CarbInput: 45, Insulin: 3, Ratio: 15, Programmed: 12},
+		{Time: "2015-10-10T12:00:00Z", CarbInput: 60, Insulin: 6, Ratio: 10, Programmed: 10},
+	}
+	if fmt.Sprint(ratios) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, ratios)
+	}
+
+	ratios, err = computeRatios(&testIter{records: []map[string]interface{}{
+		{"type": "wizard", "time": "2015-10-10T12:00:00Z", "carbInput": 50, "bolus": map[string]interface{}{"normal": 3.0}},
+	}})
+	if err != nil || len(ratios) != 1 || ratios[0].Ratio != 16.7 || ratios[0].Programmed != 0 {
+		t.Fatalf("expected a ratio rounded to 16.7 without a programmed ratio but got %v %v", ratios, err)
+	}
+
+	if _, err := computeRatios(&testIter{err: errors.New("cursor killed")}); err == nil {
+		t.Fatal("expected the iterator error")
+	}
+}
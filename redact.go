@@ -0,0 +1,14 @@
+package main
+
+import (
+	"regexp"
+)
+
+// a mongodb:// or mongodb+srv:// connection string with a password in its userinfo
+var connectionStringPassword = regexp.MustCompile(`(mongodb(?:\+srv)?://[^:@/\s]*):[^@/\s]*@`)
+
+// redactConnectionStrings masks the passwords of any mongo connection strings in the text, so errors
+// that include the connection string can be logged without leaking credentials
+func redactConnectionStrings(text string) string {
+	return connectionStringPassword.ReplaceAllString(text, "$1:xxxxx@")
+}
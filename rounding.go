@@ -0,0 +1,19 @@
+package main
+
+import (
+	"math"
+)
+
+// roundValues rounds each of the record's numeric fields that has an entry in decimals to that many decimal
+// places e.g. {"value": 1} turns a value of 5.550847 into 5.6. Other fields, and fields that aren't numbers,
+// are left as they are
+func roundValues(record map[string]interface{}, decimals map[string]int) {
+	for field, places := range decimals {
+		value, ok := record[field].(float64)
+		if !ok {
+			continue
+		}
+		scale := math.Pow(10, float64(places))
+		record[field] = math.Round(value*scale) / scale
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoundValues(t *testing.T) {
+	record := map[string]interface{}{"value": 5.550847, "rate": 0.0375, "duration": 1800000.0, "units": "mmol/L", "insulinOnBoard": 1.23456}
+	roundValues(record, map[string]int{"value": 1, "rate": 3, "duration": 0, "units": 2, "missing": 2})
+
+	expected := map[string]interface{}{"value": 5.6, "rate": 0.038, "duration": 1800000.0, "units": "mmol/L", "insulinOnBoard": 1.23456}
+	for field, value := range expected {
+		if record[field] != value {
+			t.Errorf("expected %s to be %v but got %v", field, value, record[field])
+		}
+	}
+	if _, ok := record["missing"]; ok {
+		t.Error("a missing field shouldn't be added")
+	}
+}
+
+func TestProcessResults_valueDecimals(t *testing.T) {
+	iter := &testIter{records: []map[string]interface{}{
+		{"type": "cbg", "units": "mmol/L", "value": 5.550847441541339},
+		{"type": "cbg", "units": "mmol/L", "value": 10.04},
+	}}
+	res := httptest.NewRecorder()
+	processResults(res, iter, resultOptions{emptyStatus: http.StatusOK, valueDecimals: map[string]int{"value": 1}}, time.Now())
+
+	expected := "[{\"type\":\"cbg\",\"units\":\"mmol/L\",\"value\":5.6},\n{\"type\":\"cbg\",\"units\":\"mmol/L\",\"value\":10}]"
+	if res.Body.String() != expected {
+		t.Fatalf("expected %s but got %s", expected, res.Body.String())
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// search terms are kept to plain text so nothing a client sends is read as a pattern
+var searchTerm = regexp.MustCompile(`^[A-Za-z0-9 _.:-]{1,64}$`)
+
+// parseSearch turns a search param into alternatives matching any of the configured fields that start
+// with the term. The match is anchored at the start, and case sensitive, so mongo can use an index on
+// the field rather than scanning every value
+func parseSearch(search string, fields []string) ([]bson.M, error) {
+	if search == "" {
+		return nil, nil
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("search isn't enabled")
+	}
+	if !searchTerm.MatchString(search) {
+		return nil, fmt.Errorf("search can only contain letters, numbers, spaces and _.:- , got [%s]", search)
+	}
+	pattern := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(search)}
+	alternatives := []bson.M{}
+	for _, field := range fields {
+		alternatives = append(alternatives, bson.M{field: pattern})
+	}
+	return alternatives, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	config := &Config{SearchFields: []string{"payload.note", "deviceId"}}
+	p, paramsError := getParams(url.Values{"startdate": {"2015-10-01T00:00:00Z"}, "search": {"site change"}}, config)
+	if paramsError != nil {
+		t.Fatalf("unexpected error %v", paramsError)
+	}
+	p.groupId = "abc123"
+	query, err := generateMongoQuery(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := fakeCollection{
+		{"_groupId": "abc123", "_active": true, "_schemaVersion": 0, "time": "2015-10-10T15:00:00Z", "id": "note", "payload": map[string]interface{}{"note": "site change after shower"}},
+		{"_groupId": "abc123", "_active": true, "_schemaVersion": 0, "time": "2015-10-10T15:00:00Z", "id": "device", "deviceId": "site change pump"},
+		{"_groupId": "abc123", "_active": true, "_schemaVersion": 0, "time": "2015-10-10T15:00:00Z", "id": "middle", "payload": map[string]interface{}{"note": "new site change"}},
+		{"_groupId": "abc123", "_active": true, "_schemaVersion": 0, "time": "2015-10-10T15:00:00Z", "id": "case", "payload": map[string]interface{}{"note": "Site change"}},
+		{"_groupId": "abc123", "_active": true, "_schemaVersion": 0, "time": "2015-10-10T15:00:00Z", "id": "other", "payload": map[string]interface{}{"note": "site"}, "value": "site change"},
+	}
+	iter := data.find(query)
+	found := []string{}
+	var record map[string]interface{}
+	for iter.Next(&record) {
+		found = append(found, record["id"].(string))
+	}
+	if len(found) != 2 || found[0] != "note" || found[1] != "device" {
+		t.Fatalf("expected the note and device records but got %v", found)
+	}
+
+	//the term can't be used as a pattern
+	for _, unsafe := range []string{".*", "site|change", "^site", "(a+)+", "site$", "{\"$gt\": \"\"}"} {
+		if _, paramsError := getParams(url.Values{"search": {unsafe}}, config); paramsError == nil || paramsError.Code != error_invalid_param.Code {
+			t.Errorf("should have rejected search [%s]", unsafe)
+		}
+	}
+	alternatives, err := parseSearch("1.5", config.SearchFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pattern := alternatives[0]["payload.note"]; pattern == nil || data.matches(map[string]interface{}{"payload": map[string]interface{}{"note": "105"}}, alternatives[0]) {
+		t.Fatalf("expected . to be matched literally but got %v", alternatives)
+	}
+
+	if _, paramsError := getParams(url.Values{"search": {"site"}}, &Config{}); paramsError == nil {
+		t.Fatal("should have rejected search when no searchFields are configured")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo"
+)
+
+// mongoSessions hands out copies of the base session. Copies share the base session's connections,
+// which can go stale after a network blip, so the base is refreshed once it is older than maxAge and
+// whenever an operation fails with what looks like a broken connection
+type mongoSessions struct {
+	base        *mgo.Session
+	maxAge      time.Duration
+	mu          sync.Mutex
+	refreshedAt time.Time
+	//overridable for tests
+	refreshBase func()
+	now         func() time.Time
+}
+
+func newMongoSessions(base *mgo.Session, maxAge time.Duration) *mongoSessions {
+	return &mongoSessions{
+		base:        base,
+		maxAge:      maxAge,
+		refreshedAt: time.Now(),
+		refreshBase: base.Refresh,
+		now:         time.Now,
+	}
+}
+
+// Copy returns a copy of the base session for a request, which the caller must close
+func (s *mongoSessions) Copy() *mgo.Session {
+	s.refreshIfOld()
+	return s.base.Copy()
+}
+
+func (s *mongoSessions) refreshIfOld() {
+	if s.maxAge <= 0 {
+		return
+	}
+	s.mu.Lock()
+	old := s.now().Sub(s.refreshedAt) > s.maxAge
+	s.mu.Unlock()
+	if old {
+		s.refresh()
+	}
+}
+
+func (s *mongoSessions) refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshBase()
+	s.refreshedAt = s.now()
+}
+
+// retry runs op and, if it fails because of a stale connection, refreshes the base session and runs
+// it once more. op should take its own copy of the session so the retry gets fresh connections
+func (s *mongoSessions) retry(op func() error) error {
+	err := op()
+	if isStaleSessionError(err) {
+		log.Println(DATA_API_PREFIX, "refreshing mongo session after error:", redactConnectionStrings(err.Error()))
+		s.refresh()
+		err = op()
+	}
+	return err
+}
+
+// isStaleSessionError reports whether err looks like a connection that has gone away underneath the
+// session, as opposed to a problem with the query itself
+func isStaleSessionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	message := err.Error()
+	for _, stale := range []string{"Closed explicitly", "connection reset", "broken pipe", "no reachable servers", "i/o timeout"} {
+		if strings.Contains(message, stale) {
+			return true
+		}
+	}
+	return false
+}
+
+// the part of *mgo.Session the iterGuard closes
+type sessionCloser interface {
+	Close()
+}
+
+// iterGuard keeps the iterators a request opens on its session copy so the copy is only closed once they're
+// done with it. A session closed under an open iterator leaves the cursor on a socket the pool hands to the
+// next request, which can then read the end of the previous response
+type iterGuard struct {
+	//POST /data opens iterators from several goroutines
+	mutex sync.Mutex
+	iters []*guardedIter
+}
+
+// guardedIter records whether the iterator was closed
+type guardedIter struct {
+	resultIter
+	closed bool
+}
+
+func (i *guardedIter) Close() error {
+	i.closed = true
+	return i.resultIter.Close()
+}
+
+// track returns the iterator wrapped so the guard knows when it's closed
+func (g *iterGuard) track(iter resultIter) resultIter {
+	guarded := &guardedIter{resultIter: iter}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.iters = append(g.iters, guarded)
+	return guarded
+}
+
+// closeSession closes any of the session's iterators still open and then the session, returning how many
+// were open. Each of those is a bug in the streaming path so it's logged
+func (g *iterGuard) closeSession(session sessionCloser) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	open := 0
+	for _, iter := range g.iters {
+		if iter.closed {
+			continue
+		}
+		open++
+		iter.Close()
+	}
+	if open > 0 {
+		log.Println(DATA_API_PREFIX, fmt.Sprintf("[%d] iterators were still open when their session was closed", open))
+	}
+	session.Close()
+	return open
+}
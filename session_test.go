@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestSessions(maxAge time.Duration, refreshes *int) *mongoSessions {
+	return &mongoSessions{
+		maxAge:      maxAge,
+		refreshedAt: time.Now(),
+		refreshBase: func() { *refreshes++ },
+		now:         time.Now,
+	}
+}
+
+func TestMongoSessions_retryStaleSession(t *testing.T) {
+	refreshes := 0
+	sessions := newTestSessions(0, &refreshes)
+
+	attempts := 0
+	err := sessions.retry(func() error {
+		attempts++
+		if attempts == 1 {
+			return io.EOF
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("the retry should have succeeded, got %v", err)
+	}
+	if attempts != 2 || refreshes != 1 {
+		t.Fatalf("expected 2 attempts and 1 refresh but got %d and %d", attempts, refreshes)
+	}
+}
+
+func TestMongoSessions_noRetryForQueryErrors(t *testing.T) {
+	refreshes := 0
+	sessions := newTestSessions(0, &refreshes)
+
+	attempts := 0
+	err := sessions.retry(func() error {
+		attempts++
+		return errors.New("bad query")
+	})
+
+	if err == nil || attempts != 1 || refreshes != 0 {
+		t.Fatalf("a query error shouldn't be retried, got %v after %d attempts and %d refreshes", err, attempts, refreshes)
+	}
+}
+
+func TestMongoSessions_refreshAfterMaxAge(t *testing.T) {
+	refreshes := 0
+	sessions := newTestSessions(time.Hour, &refreshes)
+	now := time.Now()
+	sessions.now = func() time.Time { return now }
+
+	sessions.refreshIfOld()
+	if refreshes != 0 {
+		t.Fatal("a new session shouldn't be refreshed")
+	}
+
+	now = now.Add(2 * time.Hour)
+	sessions.refreshIfOld()
+	if refreshes != 1 {
+		t.Fatal("a session older than the max age should be refreshed")
+	}
+
+	sessions.refreshIfOld()
+	if refreshes != 1 {
+		t.Fatal("a just refreshed session shouldn't be refreshed again")
+	}
+}
+
+type orderedCloser struct {
+	name   string
+	closes *[]string
+}
+
+func (c orderedCloser) Close() {
+	*c.closes = append(*c.closes, c.name)
+}
+
+// orderedIter is a testIter that records when it's closed
+type orderedIter struct {
+	testIter
+	closes *[]string
+}
+
+func (i *orderedIter) Close() error {
+	*i.closes = append(*i.closes, "iter")
+	return i.testIter.Close()
+}
+
+func TestIterGuard_closesSessionAfterStreaming(t *testing.T) {
+	closes := []string{}
+	guard := &iterGuard{}
+	iter := guard.track(&orderedIter{testIter: testIter{records: []map[string]interface{}{{"type": "cbg"}, {"type": "smbg"}}}, closes: &closes})
+
+	res := httptest.NewRecorder()
+	processResults(res, iter, resultOptions{emptyStatus: http.StatusOK}, time.Now())
+	if open := guard.closeSession(orderedCloser{name: "session", closes: &closes}); open != 0 {
+		t.Fatalf("expected the streamed iterator to be closed but %d were open", open)
+	}
+	if fmt.Sprint(closes) != "[iter session]" {
+		t.Fatalf("expected the session closed after the iterator but got %v", closes)
+	}
+
+	//a processing error part way through still closes the iterator
+	closes = []string{}
+	guard = &iterGuard{}
+	iter = guard.track(&orderedIter{testIter: testIter{records: []map[string]interface{}{{"type": "cbg"}, {"type": "smbg"}}}, closes: &closes})
+	failing := RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("can't process")
+	})
+	processResults(httptest.NewRecorder(), iter, resultOptions{emptyStatus: http.StatusOK, processors: []RecordProcessor{failing}}, time.Now())
+	if open := guard.closeSession(orderedCloser{name: "session", closes: &closes}); open != 0 || fmt.Sprint(closes) != "[iter session]" {
+		t.Fatalf("expected the iterator closed before the session but got %d open and %v", open, closes)
+	}
+}
+
+func TestIterGuard_prematureClose(t *testing.T) {
+	closes := []string{}
+	guard := &iterGuard{}
+	guard.track(&orderedIter{closes: &closes})
+	if open := guard.closeSession(orderedCloser{name: "session", closes: &closes}); open != 1 || fmt.Sprint(closes) != "[iter session]" {
+		t.Fatalf("expected the open iterator closed before the session but got %d open and %v", open, closes)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the fields the sort param can order by when sortFields isn't configured
+var defaultSortFields = []string{"time", "deviceTime"}
+
+// parseSort turns a sort param of comma separated fields, each optionally prefixed with - for descending
+// e.g. "-value,time", into the keys for mgo's Query.Sort. Only the allowed fields can be sorted on, so
+// a client can't ask for a sort no index supports
+func parseSort(sort string, allowed []string) ([]string, error) {
+	if sort == "" {
+		return nil, nil
+	}
+	keys := []string{}
+	for _, key := range strings.Split(sort, ",") {
+		field := strings.TrimPrefix(key, "-")
+		isAllowed := false
+		for _, allowedField := range allowed {
+			isAllowed = isAllowed || field == allowedField
+		}
+		if !isAllowed {
+			return nil, fmt.Errorf("can't sort on [%s], sortable fields are %v", field, allowed)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
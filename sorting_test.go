@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+	allowed := []string{"time", "deviceTime", "value"}
+
+	for sort, expected := range map[string][]string{
+		"":                 nil,
+		"time":             {"time"},
+		"-value":           {"-value"},
+		"-deviceTime,time": {"-deviceTime", "time"},
+	} {
+		keys, err := parseSort(sort, allowed)
+		if err != nil {
+			t.Errorf("unexpected error for [%s]: %s", sort, err)
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("expected %v for [%s] but got %v", expected, sort, keys)
+		}
+	}
+
+	for _, sort := range []string{"units", "-payload.sgv", "time,units", "--time", "value ", "$natural", "time,"} {
+		if _, err := parseSort(sort, allowed); err == nil {
+			t.Errorf("should have rejected sort [%s]", sort)
+		}
+	}
+
+	//value isn't sortable unless configured
+	if _, err := parseSort("value", defaultSortFields); err == nil {
+		t.Error("should have rejected sort on value with the default sortFields")
+	}
+}
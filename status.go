@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients/shoreline"
+)
+
+// the part of the shoreline client used to check tokens
+type tokenChecker interface {
+	CheckToken(token string) *shoreline.TokenData
+}
+
+// requireServerToken only lets requests with a server token through
+func requireServerToken(h http.Handler, tokens tokenChecker) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		td := tokens.CheckToken(req.Header.Get("x-tidepool-session-token"))
+		if td == nil || !td.IsServer {
+			jsonError(res, error_server_only, time.Now())
+			return
+		}
+		h.ServeHTTP(res, req)
+	})
+}
+
+// statusHandler is the minimal status check for load balancers, just OK once mongo can be reached
+func statusHandler(ping func() error) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		if err := ping(); err != nil {
+			jsonError(res, error_status_check.setInternalMessage(err), start)
+			return
+		}
+		res.Write([]byte("OK\n"))
+	})
+}
+
+// the internals reported by the detailed status
+type detailedStatus struct {
+	Mongo             string  `json:"mongo"`
+	MongoPingSeconds  float64 `json:"mongoPingSeconds"`
+	UptimeSeconds     float64 `json:"uptimeSeconds"`
+	QueriesInProgress int     `json:"queriesInProgress"`
+	RawInUse          int     `json:"rawInUse"`
+	AggregationInUse  int     `json:"aggregationInUse"`
+}
+
+// detailedStatusHandler reports mongo's health alongside how busy the service is. Unlike statusHandler it
+// always answers 200 so the details are there when mongo is down
+func detailedStatusHandler(ping func() error, started time.Time, queries *queryRegistry, raw, aggregation limiter) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		status := detailedStatus{
+			Mongo:             "OK",
+			UptimeSeconds:     start.Sub(started).Seconds(),
+			QueriesInProgress: len(queries.list()),
+			RawInUse:          len(raw),
+			AggregationInUse:  len(aggregation),
+		}
+		if err := ping(); err != nil {
+			status.Mongo = redactConnectionStrings(err.Error())
+		}
+		status.MongoPingSeconds = time.Since(start).Seconds()
+
+		bytes, err := json.Marshal(status)
+		if err != nil {
+			jsonError(res, error_loading_events.setInternalMessage(err), start)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(bytes)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients/shoreline"
+)
+
+type fakeTokens map[string]*shoreline.TokenData
+
+func (f fakeTokens) CheckToken(token string) *shoreline.TokenData {
+	return f[token]
+}
+
+func TestStatus_access(t *testing.T) {
+	tokens := fakeTokens{
+		"server": {UserID: "shoreline", IsServer: true},
+		"user":   {UserID: "abc123"},
+	}
+	ping := func() error { return nil }
+	queries := newQueryRegistry()
+	queries.add(activeQuery{RequestId: "1", UserId: "abc123", Started: time.Now()})
+	raw := newLimiter(4)
+	raw.acquire()
+
+	status := statusHandler(ping)
+	detail := requireServerToken(detailedStatusHandler(ping, time.Now().Add(-time.Hour), queries, raw, nil), tokens)
+
+	for _, token := range []string{"", "user", "server"} {
+		req := httptest.NewRequest("GET", "/status", nil)
+		req.Header.Set("x-tidepool-session-token", token)
+
+		res := httptest.NewRecorder()
+		status.ServeHTTP(res, req)
+		if res.Code != http.StatusOK || res.Body.String() != "OK\n" {
+			t.Errorf("expected /status to be open to token [%s] but got %d %s", token, res.Code, res.Body.String())
+		}
+
+		res = httptest.NewRecorder()
+		detail.ServeHTTP(res, req)
+		if token != "server" {
+			if !strings.Contains(res.Body.String(), error_server_only.Code) {
+				t.Errorf("expected /status/detail to be refused to token [%s] but got %s", token, res.Body.String())
+			}
+			continue
+		}
+		var body detailedStatus
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatalf("expected the detailed status but got %s", res.Body.String())
+		}
+		if body.Mongo != "OK" || body.QueriesInProgress != 1 || body.RawInUse != 1 || body.AggregationInUse != 0 || body.UptimeSeconds < 3600 {
+			t.Errorf("unexpected detailed status %+v", body)
+		}
+	}
+}
+
+func TestStatus_mongoDown(t *testing.T) {
+	ping := func() error { return errors.New("no reachable servers") }
+
+	res := httptest.NewRecorder()
+	statusHandler(ping).ServeHTTP(res, httptest.NewRequest("GET", "/status", nil))
+	if !strings.Contains(res.Body.String(), error_status_check.Code) {
+		t.Fatalf("expected a %s error but got %s", error_status_check.Code, res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	detailedStatusHandler(ping, time.Now(), newQueryRegistry(), nil, nil).ServeHTTP(res, httptest.NewRequest("GET", "/status/detail", nil))
+	var body detailedStatus
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || body.Mongo != "no reachable servers" {
+		t.Fatalf("expected the mongo error in the detailed status but got %s", res.Body.String())
+	}
+}
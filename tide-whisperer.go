@@ -1,18 +1,26 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
-	"strings"
 
-	httpgzip "github.com/daaku/go.httpgzip"
 	"github.com/gorilla/pat"
 	"github.com/satori/go.uuid"
 	common "github.com/tidepool-org/go-common"
@@ -21,7 +29,6 @@ import (
 	"github.com/tidepool-org/go-common/clients/hakken"
 	"github.com/tidepool-org/go-common/clients/mongo"
 	"github.com/tidepool-org/go-common/clients/shoreline"
-	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 )
 
@@ -33,7 +40,169 @@ type (
 		SchemaVersion struct {
 			Minimum int
 			Maximum int
+			// higher minimums for types that were only valid from a later schema version e.g. {"cbg": 2}
+			TypeMinimums map[string]int
 		} `json:"schemaVersion"`
+		// how startdate/enddate params with a non-UTC offset are handled: "strict" rejects them,
+		// "normalize" converts them to UTC and anything else (the default) uses them as given
+		UTCDates string `json:"utcDates"`
+		// mongo iterator batch size, a batchSize param can override the default up to the maximum.
+		// Zero leaves the driver default in place
+		BatchSize struct {
+			Default int
+			Maximum int
+		} `json:"batchSize"`
+		// reject requests with query params the endpoint doesn't recognize rather than ignoring them
+		StrictParams bool `json:"strictParams"`
+		// days of data returned by default, keyed by type, when a single type is requested without
+		// a startdate or enddate e.g. {"cbg": 14}. Types without an entry default to all time
+		DefaultWindowDays map[string]int `json:"defaultWindowDays"`
+		// shortest period without data reported by the gaps endpoint, defaults to an hour
+		GapThresholdMinutes int `json:"gapThresholdMinutes"`
+		// the most requests served at once by the raw data endpoint and, separately, by the aggregation
+		// endpoints (e.g. gaps) so heavy reports can't starve raw queries or vice versa. PerClient is the most
+		// any one client IP can have in progress, behind trustedProxies that's the forwarded IP. Streams is the
+		// most event streams open at once, as they stay open until the client goes away. Zero is unlimited
+		Concurrency struct {
+			Raw         int
+			Aggregation int
+			PerClient   int
+			Streams     int
+		} `json:"concurrency"`
+		// refresh the base mongo session once it is this old so stale connections aren't reused. Zero
+		// only refreshes after a connection error
+		SessionMaxAgeMinutes int `json:"sessionMaxAgeMinutes"`
+		// reject userIDs that aren't in the Tidepool id format before calling any other service
+		ValidateUserIds bool `json:"validateUserIds"`
+		// leave out records dated after the current time plus the skew allowance, which are
+		// usually from devices with a wrong clock
+		ExcludeFuture struct {
+			Enabled     bool
+			SkewMinutes int
+		} `json:"excludeFuture"`
+		// added to the enddate param so records a little after it are still returned, for clients whose
+		// clock is slightly behind passing their "now" as the enddate
+		EndDateSkewMinutes int `json:"endDateSkewMinutes"`
+		// dictionary (trained with zstd --train) used to compress responses for clients accepting zstd.
+		// Only used when built with the zstd tag
+		ZstdDictionary string `json:"zstdDictionary"`
+		// fraction (0.0-1.0) of data requests that log their params, full query and timing. Requests are
+		// picked by their request id, unset logs every request
+		DebugSampleRate *float64 `json:"debugSampleRate"`
+		// fraction (0.0-1.0) of data requests whose query is explained to find whether it used an index, counted
+		// by the fields it filters on. They're on /metrics when metrics are enabled and logged otherwise. 0 (the
+		// default) explains none
+		IndexSampleRate float64 `json:"indexSampleRate"`
+		// IPs or CIDR ranges of the proxies in front of the service, whose X-Forwarded-* headers are trusted
+		TrustedProxies []string `json:"trustedProxies"`
+		// what to do with data requests made over plain http: "reject", "redirect" to https, or allow them (default)
+		RequireHTTPS string `json:"requireHttps"`
+		// fields the exists param may check, replacing defaultExistsFields when set
+		ExistsFields []string `json:"existsFields"`
+		// fields the sort param may order by, replacing defaultSortFields when set. Each should lead an index
+		// after _groupId so sorts don't run in memory
+		SortFields []string `json:"sortFields"`
+		// the most values the params of one request can add to its query or pipeline, 100 when not set, so a
+		// pathological request e.g. thousands of times can't build a query mongo struggles with
+		MaxQueryClauses int `json:"maxQueryClauses"`
+		// the most query params a request can have, counting repeats, before it's turned away with a 400. 0 is unlimited
+		MaxQueryParams int `json:"maxQueryParams"`
+		// the most users one POST /data request can ask for, 20 when not set
+		MaxBatchUsers int `json:"maxBatchUsers"`
+		// how many of a POST /data request's users are looked up and queried at once, 4 when not set
+		BatchConcurrency int `json:"batchConcurrency"`
+		// string fields the search param matches against e.g. ["payload.note", "deviceId"], search is rejected when unset
+		SearchFields []string `json:"searchFields"`
+		// route /{userID}/ and the like as if they had no trailing slash
+		StripTrailingSlash bool `json:"stripTrailingSlash"`
+		// names of the RecordProcessors each returned record goes through, in order. Defaults to just
+		// stripInternalFields, add normalizeUnits to return units in their canonical form
+		RecordProcessors []string `json:"recordProcessors"`
+		// more ways of writing units for normalizeUnits, mapped to the canonical form e.g. {"mmol": "mmol/L"}
+		UnitAliases map[string]string `json:"unitAliases"`
+		// key for the pseudonyms made by the anonymize record processor, which is only available when this is set.
+		// Exports made with the same key give a device the same pseudonym
+		AnonymizeKey string `json:"anonymizeKey"`
+		// serve /status/detail with the service's internals: "server" for server tokens only, "open" for anyone.
+		// Not served when unset. /status is always open
+		DetailedStatus string `json:"detailedStatus"`
+		// serve POST /indexes so servers can create missing indexes without a redeploy
+		IndexEndpoint bool `json:"indexEndpoint"`
+		// add a _source field to each returned object naming the collection it was read from
+		SourceTag bool `json:"sourceTag"`
+		// collection holding the tombstones of deleted and upload-cancelled records. When set, servers
+		// can read a user's tombstones from /{userID}/tombstones for upload reconciliation
+		TombstoneCollection string `json:"tombstoneCollection"`
+		// drop a client that stops reading a response for this long, freeing its mongo cursor. This only
+		// limits each write, a long response to a client that keeps reading is unaffected
+		WriteIdleTimeoutSeconds int `json:"writeIdleTimeoutSeconds"`
+		// the longest a /{userID} query can read from mongo before it's stopped with a 504, so a very large
+		// dataset can't hold a pooled connection for minutes. 0 (the default) doesn't limit it
+		QueryTimeoutSeconds int `json:"queryTimeoutSeconds"`
+		// decimal places numeric fields are rounded to when returned, keyed by field e.g. {"value": 2} so
+		// mmol/L values aren't returned to 15 places. Fields without an entry aren't rounded
+		ValueDecimals map[string]int `json:"valueDecimals"`
+		// the format /{userID} responds in when the request has neither a format param nor an Accept header
+		// asking for one, json when not set
+		DefaultFormat string `json:"defaultFormat"`
+		// the fields returned first in each object, in this order, e.g. ["type", "time", "value"]. The other
+		// fields always follow sorted by name
+		FieldOrder []string `json:"fieldOrder"`
+		// how many levels of nested objects csv exports expand into dotted columns e.g. payload.transmitterId when
+		// the fields param isn't given. Deeper objects, and all of them at 0 (the default), are json in one column
+		CSVFlattenDepth int `json:"csvFlattenDepth"`
+		// high volume types, e.g. cbg, that can only be requested with a startdate (or a default window)
+		// so a mistake can't scan all of a user's history
+		DateWindowRequiredTypes []string `json:"dateWindowRequiredTypes"`
+		// types with so many objects that requesting them without a startdate is warned about, just cbg when not set
+		HighVolumeTypes []string `json:"highVolumeTypes"`
+		// caps on how many objects one request can ask for. For a request for particular types the most
+		// restrictive of the Maximum and those types' TypeMaximums applies. 0 is no cap
+		Limits struct {
+			Maximum      int
+			TypeMaximums map[string]int
+		} `json:"limits"`
+		// sensitive types only servers can view for other users, even when a user has been given view
+		// permission. Users can still view their own
+		ServerOnlyTypes []string `json:"serverOnlyTypes"`
+		// the insulin action curve used by /{userID}/iob, 360 and 75 minutes when not set. The peak must
+		// be less than half the duration
+		InsulinAction struct {
+			DurationMinutes int
+			PeakMinutes     int
+		} `json:"insulinAction"`
+		// what to do when a query param is given more than once: "first" (the default) uses the first,
+		// "last" the last and "reject" returns a 400
+		DuplicateParams string `json:"duplicateParams"`
+		// what to do when a comma separated param e.g. type has the same value more than once: "" (the default)
+		// leaves them, "dedupe" drops the repeats and "reject" returns a 400
+		DuplicateValues string `json:"duplicateValues"`
+		// what users viewing their own data get before they've uploaded any: "empty" (the default) the same
+		// empty result as a user without data in the range, "notFound" a 404 no_uploads
+		NoUploads string `json:"noUploads"`
+		// what happens at startup when the deviceData collection doesn't exist: "warn" (the default) logs how
+		// to fix it and carries on, "create" creates it and "fail" stops
+		MissingCollection string `json:"missingCollection"`
+		// how long permission checks wait for gatekeeper, 0 waits as long as the http client does. When gatekeeper
+		// is slower than that the check falls back to "deny" (the default) or "cachedAllow", which allows viewers
+		// gatekeeper allowed within the last CacheMinutes, 60 by default. Fallbacks are counted in the metrics
+		GatekeeperTimeout struct {
+			Milliseconds int
+			Fallback     string
+			CacheMinutes int
+		} `json:"gatekeeperTimeout"`
+		// how often /{userID}/events looks for changed objects, 10 seconds when not set
+		EventPollSeconds int `json:"eventPollSeconds"`
+		// how long users' own private pairs are cached for their requests for their own data, 60 by default
+		SelfPairCacheMinutes int `json:"selfPairCacheMinutes"`
+		// how long the private pairs of users viewed by others are cached, 0 (the default) looks them up each time
+		PairCacheMinutes int `json:"pairCacheMinutes"`
+		// record the latency and outcome of calls to shoreline, seagull and gatekeeper and serve them
+		// on /metrics. Buckets are the histogram upper bounds in seconds
+		Metrics struct {
+			Enabled bool
+			Buckets []float64
+		} `json:"metrics"`
 	}
 	// so we can wrap and marshal the detailed error
 	detailedError struct {
@@ -46,290 +215,2023 @@ type (
 	}
 	//generic type as device data can be comprised of many things
 	deviceData map[string]interface{}
+	// the part of *mgo.Iter used when streaming results, so results can be processed from any iterator
+	// producing maps, whether from a Find or an aggregation Pipe
+	resultIter interface {
+		Next(result interface{}) bool
+		Close() error
+	}
+	// the filters for a data query, see the /{userID} endpoint for their details
+	params struct {
+		groupId          string
+		minSchemaVersion int
+		maxSchemaVersion int
+		startDate        string
+		endDate          string
+		//comma separated lists
+		types     string
+		subTypes  string
+		deviceIds string
+		uploadIds string
+		//$elemMatch criteria for pumpSettings keyed by settings array
+		settings map[string]bson.M
+		//correlated type and subType clauses, any of which may match
+		typeSubTypes []bson.M
+		//latest time returned regardless of endDate, zero for no limit
+		notAfter time.Time
+		//allowance added to endDate for clients with slow clocks
+		endDateSkew time.Duration
+		//only objects strictly before this time, for paging backwards
+		before string
+		//comma separated exact times, any of which may match
+		times string
+		//types that must not be returned
+		excludedTypes []string
+		//schema version floors for particular types, on top of minSchemaVersion
+		typeMinSchemaVersions map[string]int
+		//fields that must, or must not, be present
+		exists map[string]bool
+		//search alternatives, any of which may match
+		search []bson.M
+		//only objects after this position in time then _id order, for paging with a cursor
+		after *pageCursor
+	}
+	// per request options for how processResults writes the results
+	resultOptions struct {
+		//status returned when there are no results, 200 or 204
+		emptyStatus int
+		//write each record as a line of newline delimited json rather than in an array
+		ndjson bool
+		//write the records as csv rows, with csvFields as the columns or else the fields found in the records
+		csv       bool
+		csvFields []string
+		//how many levels of nested objects are expanded into dotted csv columns
+		csvFlattenDepth int
+		//send a hash of the streamed records in the checksum trailer
+		checksum bool
+		//send the position of the last record in the cursor trailer, the records must have their _id
+		cursor bool
+		//add a localTime field to each record
+		withLocalTime bool
+		//zone for localTime when a record has no timezoneOffset, may be nil
+		timezone *time.Location
+		//zone each record's time is rewritten into, nil to leave times in UTC
+		tz *time.Location
+		//run over each record before it is written
+		processors []RecordProcessor
+		//when set, records are written as chunks of this many transposed into columns
+		columnarChunkSize int
+		//the fields written first in each record, see marshalOrdered
+		fieldOrder []string
+		//decimal places to round fields to, see roundValues
+		valueDecimals map[string]int
+		//closed when the client goes away, usually the request context's Done
+		done <-chan struct{}
+		//when reading stops with a 504, zero for no limit
+		deadline time.Time
+	}
 )
 
-var (
-	error_status_check = detailedError{Status: http.StatusInternalServerError, Code: "data_status_check", Message: "checking of the status endpoint showed an error"}
+// the query params understood by the /{userID} endpoint
+var dataParams = map[string]bool{
+	"startdate":      true,
+	"enddate":        true,
+	"type":           true,
+	"subtype":        true,
+	"emptyStatus":    true,
+	"batchSize":      true,
+	"checksum":       true,
+	"withLocalTime":  true,
+	"timezone":       true,
+	"settings":       true,
+	"typeSubtype":    true,
+	"format":         true,
+	"exists":         true,
+	"layout":         true,
+	"bucket":         true,
+	"agg":            true,
+	"hint":           true,
+	"before":         true,
+	"pageSize":       true,
+	"times":          true,
+	"countByType":    true,
+	"search":         true,
+	"sort":           true,
+	"limit":          true,
+	"offset":         true,
+	"deviceId":       true,
+	"uploadId":       true,
+	"cursor":         true,
+	"fields":         true,
+	"tz":             true,
+	"collapseBasals": true,
+	"isoWeek":        true,
+	"month":          true,
+}
 
-	error_no_view_permisson = detailedError{Status: http.StatusForbidden, Code: "data_cant_view", Message: "user is not authorized to view data"}
-	error_no_permissons     = detailedError{Status: http.StatusInternalServerError, Code: "data_perms_error", Message: "error finding permissons for user"}
-	error_running_query     = detailedError{Status: http.StatusInternalServerError, Code: "data_store_error", Message: "internal server error"}
-	error_loading_events    = detailedError{Status: http.StatusInternalServerError, Code: "data_marshal_error", Message: "internal server error"}
-	error_incorrect_params  = detailedError{Status: http.StatusInternalServerError, Code: "params", Message: "incorrect parameters"}
-)
+// the fields the exists param can check when existsFields isn't configured
+var defaultExistsFields = []string{
+	"annotations", "carbInput", "clockDriftOffset", "conversionOffset", "deviceId", "deviceTime", "duration",
+	"insulinOnBoard", "payload", "timezoneOffset", "units", "uploadId", "value",
+}
 
-const DATA_API_PREFIX = "api/data"
+const (
+	DATA_API_PREFIX = "api/data"
+	//trailer holding the hex sha256 of the returned records when requested with checksum=true
+	CHECKSUM_TRAILER = "x-tidepool-checksum"
+	//trailer holding the cursor for the page after the returned records when paging with limit
+	CURSOR_TRAILER = "x-tidepool-next-cursor"
+)
 
-//set the intenal message that we will use for logging
+// set the intenal message that we will use for logging
 func (d detailedError) setInternalMessage(internal error) detailedError {
 	d.InternalMessage = internal.Error()
 	return d
 }
 
+// log error detail and write as application/json, with the message in the request's language
+// when it's been picked by localizeErrors
+func jsonError(res http.ResponseWriter, err detailedError, startedAt time.Time) {
 
-// generateMongoQuery takes in a number of parameters and constructs a mongo query
-// to retrieve objects from the Tidepool database. It is used by the router.Add("GET", "/{userID}"
-// endpoint, which implements the Tide-whisperer API. See that function for further documentation
-// on parameters
-func generateMongoQuery(groupId string, minSchemaVersion int, maxSchemaVersion int, 
-		startDateString string, endDateString string, objType string, objSubType string) (bson.M, error) {
+	err.Id = uuid.NewV4().String()
+	err = err.localize(res)
 
-	//the query params for type and subtype can contain multiple values seperated by a comma e.g. "type=smbg,cbg"
-	//so split them out into an array of values
-	objTypes := strings.Split(objType, ",")
-	objSubTypes := strings.Split(objSubType, ",")
+	log.Println(DATA_API_PREFIX, fmt.Sprintf("[%s][%s] failed after [%.5f]secs with error [%s][%s] ", err.Id, err.Code, time.Now().Sub(startedAt).Seconds(), err.Message, redactConnectionStrings(err.InternalMessage)))
 
-	if startDateString != "" {
-		startDate, err := time.Parse(time.RFC3339Nano, startDateString)
-		if err != nil {
-			return nil, err
+	jsonErr, _ := json.Marshal(err)
+
+	//the status has to go before the body, the first Write sends a 200 otherwise
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(err.Status)
+	res.Write(jsonErr)
+}
+
+// sampled reports whether the request with the given id is in the sampled fraction. The decision
+// is made from the id alone so a request is consistently logged, or not, throughout
+func sampled(requestId string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(requestId))
+	return float64(hash.Sum32()) < rate*float64(math.MaxUint32)
+}
+
+// stripTrailingSlash removes a single trailing slash from the path before routing, so
+// a request for /{userID}/ is handled the same as /{userID}
+func stripTrailingSlash(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if len(req.URL.Path) > 1 && strings.HasSuffix(req.URL.Path, "/") {
+			req.URL.Path = strings.TrimSuffix(req.URL.Path, "/")
+			req.URL.RawPath = strings.TrimSuffix(req.URL.RawPath, "/")
 		}
-		startDateString = startDate.Format(time.RFC3339Nano)
+		h.ServeHTTP(res, req)
+	})
+}
+
+// getEmptyStatus reads the emptyStatus query param which controls the status returned
+// when a query matches no records. Defaults to 200 with an empty array
+func getEmptyStatus(emptyStatusString string) (int, error) {
+	switch emptyStatusString {
+	case "", "200":
+		return http.StatusOK, nil
+	case "204":
+		return http.StatusNoContent, nil
 	}
-	if endDateString != "" {
-		endDate, err := time.Parse(time.RFC3339Nano, endDateString)
-		if err != nil {
-			//log.Println(DATA_API_PREFIX, fmt.Sprintf("Error parsing end date: %s", err))
-			//jsonError(res, error_incorrect_params, start)
-			return nil, err
+	return 0, fmt.Errorf("emptyStatus must be 200 or 204, got [%s]", emptyStatusString)
+}
+
+// getBatchSize works out the mongo batch size for a request from the batchSize param
+// and the configured default and maximum. Zero means use the driver default
+func getBatchSize(batchSizeString string, defaultSize int, maximumSize int) (int, error) {
+	batchSize := defaultSize
+	if batchSizeString != "" {
+		var err error
+		if batchSize, err = strconv.Atoi(batchSizeString); err != nil || batchSize <= 0 {
+			return 0, fmt.Errorf("batchSize must be a positive number, got [%s]", batchSizeString)
 		}
-		endDateString = endDate.Format(time.RFC3339Nano)
 	}
-	
-	groupDataQuery := bson.M{"_groupId": groupId, 
-		"_active": true, 
-		"_schemaVersion": bson.M{"$gte": minSchemaVersion, "$lte": maxSchemaVersion, }}
+	if maximumSize > 0 && batchSize > maximumSize {
+		batchSize = maximumSize
+	}
+	return batchSize, nil
+}
 
-	//if optional parameters are present, then add them to the query
-	if len(objTypes) >0 && objTypes[0] != "" {
-		groupDataQuery["type"] = bson.M{"$in":objTypes}
+// the page size used when before is given without pageSize
+const DEFAULT_PAGE_SIZE = 100
+
+// getPageSize works out how many of the most recent objects to return from the pageSize and before
+// params. Zero means the request isn't paged
+func getPageSize(pageSizeString string, before string) (int, error) {
+	if pageSizeString == "" {
+		if before != "" {
+			return DEFAULT_PAGE_SIZE, nil
+		}
+		return 0, nil
+	}
+	pageSize, err := strconv.Atoi(pageSizeString)
+	if err != nil || pageSize <= 0 {
+		return 0, fmt.Errorf("pageSize must be a positive number, got [%s]", pageSizeString)
 	}
+	return pageSize, nil
+}
 
-	if len(objSubTypes) >0 && objSubTypes[0] != "" {
-		groupDataQuery["subType"] = bson.M{"$in":objSubTypes}
+// getCount parses a count param, e.g. limit, which must be at least minimum. Zero means the param wasn't given
+func getCount(countString string, minimum int) (int, bool) {
+	if countString == "" {
+		return 0, true
+	}
+	count, err := strconv.Atoi(countString)
+	if err != nil || count < minimum {
+		return 0, false
 	}
+	return count, true
+}
 
-	if startDateString != "" && endDateString != "" {
-		groupDataQuery["time"] = bson.M{"$gte": startDateString, "$lte": endDateString}
-	} else if startDateString != "" {
-		groupDataQuery["time"] = bson.M{"$gte": startDateString}
-	} else if endDateString != "" {
-		groupDataQuery["time"] = bson.M{"$lte": endDateString}
+// maximumLimit works out the cap on the number of objects for the requested types, the most restrictive
+// of the overall maximum and the maximums for those types. Without types only the overall maximum applies,
+// as a cap meant for one type shouldn't restrict them all. Zero means there's no cap
+func maximumLimit(types string, maximum int, typeMaximums map[string]int) int {
+	limit := maximum
+	if types == "" {
+		return limit
+	}
+	for _, objType := range strings.Split(types, ",") {
+		if typeMaximum := typeMaximums[objType]; typeMaximum > 0 && (limit == 0 || typeMaximum < limit) {
+			limit = typeMaximum
+		}
+	}
+	return limit
+}
+
+// addLocalTime sets a localTime field on the record from its time, in the zone given by the record's
+// timezoneOffset (minutes from UTC) or else in the fallback zone. Records where neither is available
+// or whose time can't be parsed are left as they are
+func addLocalTime(record map[string]interface{}, fallback *time.Location) {
+	timeString, _ := record["time"].(string)
+	utcTime, err := time.Parse(time.RFC3339Nano, timeString)
+	if err != nil {
+		return
 	}
 
-	return groupDataQuery, nil
+	location := fallback
+	switch offset := record["timezoneOffset"].(type) {
+	case int:
+		location = time.FixedZone("", offset*60)
+	case int64:
+		location = time.FixedZone("", int(offset)*60)
+	case float64:
+		location = time.FixedZone("", int(offset*60))
+	}
+	if location == nil {
+		return
+	}
+
+	record["localTime"] = utcTime.In(location).Format(time.RFC3339Nano)
 }
 
-func main() {
-	const deviceDataCollection = "deviceData"
-	var config Config
-	if err := common.LoadConfig([]string{"./config/env.json", "./config/server.json"}, &config); err != nil {
-		log.Fatal(DATA_API_PREFIX, "Problem loading config: ", err)
+// convertTime rewrites the record's time into the zone's local representation e.g. 2015-10-10T08:00:00-07:00,
+// keeping the original in utcTime. Records whose time can't be parsed are left as they are
+func convertTime(record map[string]interface{}, zone *time.Location) {
+	timeString, _ := record["time"].(string)
+	utcTime, err := time.Parse(time.RFC3339Nano, timeString)
+	if err != nil {
+		return
 	}
+	record["utcTime"] = timeString
+	record["time"] = utcTime.In(zone).Format(time.RFC3339Nano)
+}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// process the found data and send the appropriate response
+// formatRecord applies the options that change how a processed record's fields are written, its local time,
+// time zone and rounding
+func (opts resultOptions) formatRecord(record map[string]interface{}) {
+	if opts.withLocalTime {
+		addLocalTime(record, opts.timezone)
 	}
-	httpClient := &http.Client{Transport: tr}
+	if opts.tz != nil {
+		convertTime(record, opts.tz)
+	}
+	roundValues(record, opts.valueDecimals)
+}
 
-	hakkenClient := hakken.NewHakkenBuilder().
-		WithConfig(&config.HakkenConfig).
-		Build()
+func processResults(res http.ResponseWriter, iter resultIter, opts resultOptions, startedAt time.Time) {
+	var results map[string]interface{}
+	found := 0
+	first := false
 
-	if err := hakkenClient.Start(); err != nil {
-		log.Fatal(DATA_API_PREFIX, err)
+	//the hash is built up as we stream so the records never need to be held in memory
+	var checksum hash.Hash
+	if opts.checksum {
+		checksum = sha256.New()
+		res.Header().Add("Trailer", CHECKSUM_TRAILER)
+	}
+	var position *pageCursor
+	if opts.cursor {
+		res.Header().Add("Trailer", CURSOR_TRAILER)
+	}
+	var rows *csvStream
+	if opts.csv {
+		rows = newCSVStream(res, opts.csvFields, opts.fieldOrder, opts.csvFlattenDepth)
 	}
-	defer func() {
-		if err := hakkenClient.Close(); err != nil {
-			log.Panic(DATA_API_PREFIX, "Error closing hakkenClient, panicing to get stacks: ", err)
-		}
-	}()
 
-	shorelineClient := shoreline.NewShorelineClientBuilder().
-		WithHostGetter(config.ShorelineConfig.ToHostGetter(hakkenClient)).
-		WithHttpClient(httpClient).
-		WithConfig(&config.ShorelineConfig.ShorelineClientConfig).
-		Build()
+	//set before reading anything so the response is typed however many records match
+	switch {
+	case opts.csv:
+		res.Header().Set("Content-Type", responseFormats["csv"])
+	case opts.ndjson:
+		res.Header().Set("Content-Type", responseFormats["ndjson"])
+	default:
+		res.Header().Set("Content-Type", "application/json")
+	}
 
-	seagullClient := clients.NewSeagullClientBuilder().
-		WithHostGetter(config.SeagullConfig.ToHostGetter(hakkenClient)).
-		WithHttpClient(httpClient).
-		Build()
+	log.Println(DATA_API_PREFIX, fmt.Sprintf("mongo processing started after [%.5f]secs", time.Now().Sub(startedAt).Seconds()))
 
-	gatekeeperClient := clients.NewGatekeeperClientBuilder().
-		WithHostGetter(config.GatekeeperConfig.ToHostGetter(hakkenClient)).
-		WithHttpClient(httpClient).
-		WithTokenProvider(shorelineClient).
-		Build()
+	//an error means the client has gone, or stopped reading, so there's no point carrying on
+	write := func(bytes []byte) error {
+		if opts.ndjson {
+			first = true
+			if _, err := res.Write(append(bytes, '\n')); err != nil {
+				return err
+			}
+		} else {
+			separator := []byte(",\n")
+			if !first {
+				separator = []byte("[")
+				first = true
+			}
+			if _, err := res.Write(separator); err != nil {
+				return err
+			}
+			if _, err := res.Write(bytes); err != nil {
+				return err
+			}
+		}
+		if checksum != nil {
+			checksum.Write(bytes)
+			checksum.Write([]byte("\n"))
+		}
+		return nil
+	}
+	var chunk []map[string]interface{}
+
+	for iter.Next(&results) {
 
-	userCanViewData := func(userID, groupID string) bool {
-		if userID == groupID {
-			return true
+		//stop reading from mongo once no one is listening
+		select {
+		case <-opts.done:
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("stopped after [%d] records as the client went away", found))
+			iter.Close()
+			return
+		default:
 		}
 
-		perms, err := gatekeeperClient.UserInGroup(userID, groupID)
-		if err != nil {
-			log.Println(DATA_API_PREFIX, "Error looking up user in group", err)
-			return false
+		if !opts.deadline.IsZero() && time.Now().After(opts.deadline) {
+			iter.Close()
+			queryTimedOut(res, found, first || (rows != nil && rows.started), startedAt)
+			return
 		}
 
-		log.Println(perms)
-		return !(perms["root"] == nil && perms["view"] == nil)
-	}
+		//taken before the processors can change the record, and past those they drop so they aren't read again
+		if opts.cursor {
+			if next, ok := cursorAt(results); ok {
+				position = next
+			}
+			delete(results, "_id")
+		}
 
-	//log error detail and write as application/json
-	jsonError := func(res http.ResponseWriter, err detailedError, startedAt time.Time) {
+		record, err := processRecord(results, opts.processors)
+		if err != nil {
+			iter.Close()
+			jsonError(res, error_loading_events.setInternalMessage(err), startedAt)
+			return
+		}
+		if record == nil {
+			continue
+		}
 
-		err.Id = uuid.NewV4().String()
+		found = found + 1
 
-		log.Println(DATA_API_PREFIX, fmt.Sprintf("[%s][%s] failed after [%.5f]secs with error [%s][%s] ", err.Id, err.Code, time.Now().Sub(startedAt).Seconds(), err.Message, err.InternalMessage))
+		opts.formatRecord(record)
 
-		jsonErr, _ := json.Marshal(err)
+		if rows != nil {
+			//the stream can hold on to the record so the driver mustn't decode into it again
+			results = nil
+			if err := rows.add(record); err != nil {
+				log.Println(DATA_API_PREFIX, fmt.Sprintf("stopped after [%d] records as the csv couldn't be written: %s", found, err))
+				iter.Close()
+				return
+			}
+			continue
+		}
 
-		res.Header().Add("content-type", "application/json")
-		res.Write(jsonErr)
-		res.WriteHeader(err.Status)
+		var bytes []byte
+		if opts.columnarChunkSize > 0 {
+			//the driver decodes into the same map each time unless it's reset
+			chunk = append(chunk, record)
+			results = nil
+			if len(chunk) < opts.columnarChunkSize {
+				continue
+			}
+			bytes, err = transposeRecords(chunk)
+			chunk = nil
+		} else {
+			bytes, err = marshalOrdered(record, opts.fieldOrder)
+		}
+		if err != nil {
+			iter.Close()
+			jsonError(res, error_loading_events.setInternalMessage(err), startedAt)
+			return
+		}
+		if err := write(bytes); err != nil {
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("stopped after [%d] records as the response couldn't be written: %s", found, err))
+			iter.Close()
+			return
+		}
 	}
 
-	//process the found data and send the appropriate response
-	processResults := func(res http.ResponseWriter, iter *mgo.Iter, startedAt time.Time) {
-		var results map[string]interface{}
-		found := 0
-		first := false
-
-		log.Println(DATA_API_PREFIX, fmt.Sprintf("mongo processing started after [%.5f]secs", time.Now().Sub(startedAt).Seconds()))
-
-		for iter.Next(&results) {
+	log.Println(DATA_API_PREFIX, fmt.Sprintf("mongo processing finished after [%.5f]secs and returned [%d] records", time.Now().Sub(startedAt).Seconds(), found))
 
-			found = found + 1
+	if err := iter.Close(); err != nil {
+		//the socket timeout is set to the deadline, so a read that blocked past it fails rather than hangs
+		if !opts.deadline.IsZero() && time.Now().After(opts.deadline) {
+			queryTimedOut(res, found, first || (rows != nil && rows.started), startedAt)
+			return
+		}
+		jsonError(res, error_running_query.setInternalMessage(err), startedAt)
+		return
+	}
 
-			bytes, err := json.Marshal(results)
-			if err != nil {
-				jsonError(res, error_loading_events.setInternalMessage(err), startedAt)
-				return
-			} else {
-				if !first {
-					res.Header().Add("content-type", "application/json")
-					res.Write([]byte("["))
-					first = true
-				} else {
-					res.Write([]byte(",\n"))
-				}
-				res.Write(bytes)
-			}
+	if rows != nil {
+		if found == 0 && opts.emptyStatus == http.StatusNoContent {
+			res.Header().Del("Content-Type")
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err := rows.close(); err != nil {
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("the last csv rows couldn't be written: %s", err))
+			return
 		}
+		if position != nil {
+			res.Header().Set(CURSOR_TRAILER, position.encode())
+		}
+		return
+	}
 
-		log.Println(DATA_API_PREFIX, fmt.Sprintf("mongo processing finished after [%.5f]secs and returned [%d] records", time.Now().Sub(startedAt).Seconds(), found))
+	if len(chunk) > 0 {
+		bytes, err := transposeRecords(chunk)
+		if err != nil {
+			jsonError(res, error_loading_events.setInternalMessage(err), startedAt)
+			return
+		}
+		if err := write(bytes); err != nil {
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("the last records couldn't be written: %s", err))
+			return
+		}
+	}
 
-		if err := iter.Close(); err != nil {
-			jsonError(res, error_running_query.setInternalMessage(err), startedAt)
+	if found == 0 {
+		if opts.emptyStatus == http.StatusNoContent {
+			res.Header().Del("Content-Type")
+			res.WriteHeader(http.StatusNoContent)
 			return
 		}
+		if !opts.ndjson {
+			res.Write([]byte("["))
+		}
+	}
 
+	if !opts.ndjson {
 		res.Write([]byte("]"))
+	}
+	if checksum != nil {
+		res.Header().Set(CHECKSUM_TRAILER, hex.EncodeToString(checksum.Sum(nil)))
+	}
+	if position != nil {
+		res.Header().Set(CURSOR_TRAILER, position.encode())
+	}
+	return
+}
+
+// queryTimedOut ends a response whose query ran past its deadline. Before anything is written it's a 504,
+// after that the status has gone so the response is just cut short, without the closing ] or trailers
+func queryTimedOut(res http.ResponseWriter, found int, written bool, startedAt time.Time) {
+	if written {
+		log.Println(DATA_API_PREFIX, fmt.Sprintf("stopped after [%d] records as the query ran past its deadline", found))
 		return
 	}
+	jsonError(res, error_query_timeout.setInternalMessage(fmt.Errorf("query ran past its deadline after [%d] records", found)), startedAt)
+}
 
-	if err := shorelineClient.Start(); err != nil {
-		log.Fatal(err)
+// unknownParams returns the sorted names of any query params not in the known set.
+// Route variables that pat adds to the query (e.g. :userID) are ignored
+func unknownParams(query url.Values, known map[string]bool) []string {
+	unknown := []string{}
+	for name := range query {
+		if !known[name] && !strings.HasPrefix(name, ":") {
+			unknown = append(unknown, name)
+		}
 	}
+	sort.Strings(unknown)
+	return unknown
+}
 
-	session, err := mongo.Connect(&config.Mongo)
-	if err != nil {
-		log.Fatal(err)
+// checkParams returns an error listing the unrecognized query params when running in strict mode,
+// in lenient mode unknown params are ignored
+func checkParams(query url.Values, known map[string]bool, strict bool) *detailedError {
+	if !strict {
+		return nil
 	}
-	//index based on sort and where keys
-	index := mgo.Index{
-		Key:        []string{"_groupId", "_active", "_schemaVersion"},
-		Background: true,
+	if unknown := unknownParams(query, known); len(unknown) > 0 {
+		paramsError := error_unknown_params
+		paramsError.Message = fmt.Sprintf("unknown parameters: %s", strings.Join(unknown, ", "))
+		return &paramsError
 	}
-	_ = session.DB("").C(deviceDataCollection).EnsureIndex(index)
+	return nil
+}
 
-	router := pat.New()
-	router.Add("GET", "/status", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		start := time.Now()
+// defaultStartDate returns the startdate to use for a request that gave no dates, when a single type
+// with a configured default window was asked for. An empty string means no default applies
+func defaultStartDate(objType string, windowDays map[string]int, now time.Time) string {
+	if objType == "" || strings.Contains(objType, ",") {
+		return ""
+	}
+	if days := windowDays[objType]; days > 0 {
+		return now.UTC().AddDate(0, 0, -days).Format(time.RFC3339Nano)
+	}
+	return ""
+}
 
-		mongoSession := session.Copy()
-		defer mongoSession.Close()
+// windowRequired returns the first of the requested types that can only be requested with a date window
+func windowRequired(types string, protected []string) string {
+	for _, objType := range strings.Split(types, ",") {
+		for _, protectedType := range protected {
+			if objType == protectedType {
+				return objType
+			}
+		}
+	}
+	return ""
+}
 
-		if err := mongoSession.Ping(); err != nil {
-			jsonError(res, error_status_check.setInternalMessage(err), start)
-			return
+// restrictTypes stops the params from returning any of the restricted types, rejecting them when they're
+// asked for by name and otherwise leaving them out of the results
+func restrictTypes(p *params, restricted []string) error {
+	requested := strings.Split(p.types, ",")
+	for _, typeSubType := range p.typeSubTypes {
+		if objType, ok := typeSubType["type"].(string); ok {
+			requested = append(requested, objType)
 		}
-		res.Write([]byte("OK\n"))
-		return
-	}))
-	
-	// The /data/userId endpoint retrieves device/health data for a user based on a set of parameters
-	// userid: the ID of the user you want to retrieve data for
-	// type (optional) : The Tidepool data type to search for. Only objects with a type field matching the specified type param will be returned.
-	//					can be /userid?type=smbg or a comma seperated list e.g /userid?type=smgb,cbg . If is a comma seperated 
-	//					list, then objects matching any of the sub types will be returned
-	// subtype (optional) : The Tidepool data subtype to search for. Only objects with a subtype field matching the specified subtype param will be returned.
-	//					can be /userid?subtype=physicalactivity or a comma seperated list e.g /userid?subtypetype=physicalactivity,steps . If is a comma seperated 
-	//					list, then objects matching any of the types will be returned
-	// startdate (optional) : Only objects with 'time' field equal to or greater than start date will be returned . 
-	//						  Must be in ISO date/time format e.g. 2015-10-10T15:00:00.000Z
-	// enddate (optional) : Only objects with 'time' field less than to or equal to start date will be returned . 
-	//						  Must be in ISO date/time format e.g. 2015-10-10T15:00:00.000Z 
- 	router.Add("GET", "/{userID}", httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		start := time.Now()
+	}
+	for _, objType := range requested {
+		for _, restrictedType := range restricted {
+			if objType == restrictedType {
+				return fmt.Errorf("type [%s] can only be viewed by servers", objType)
+			}
+		}
+	}
+	p.excludedTypes = restricted
+	return nil
+}
 
-		userToView := req.URL.Query().Get(":userID")
-		startDateString := req.URL.Query().Get("startdate")
-		endDateString := req.URL.Query().Get("enddate")
-		objType := req.URL.Query().Get("type")
-		objSubType := req.URL.Query().Get("subtype")
+// enforceUTCDate applies the configured utcDates mode to a startdate or enddate param.
+// Dates that don't parse are returned untouched so generateMongoQuery can report them
+func enforceUTCDate(dateString string, mode string) (string, error) {
+	if dateString == "" {
+		return dateString, nil
+	}
+	date, err := time.Parse(time.RFC3339Nano, dateString)
+	if err != nil {
+		return dateString, nil
+	}
+	switch mode {
+	case "strict":
+		if !strings.HasSuffix(dateString, "Z") {
+			return "", fmt.Errorf("date [%s] is not UTC", dateString)
+		}
+	case "normalize":
+		return date.UTC().Format(time.RFC3339Nano), nil
+	}
+	return dateString, nil
+}
 
-		log.Println(DATA_API_PREFIX, fmt.Sprintf("****Params: startdate:%s enddate:%s type:%s subtype:%s", startDateString, endDateString, objType, objSubType))
-		
-		token := req.Header.Get("x-tidepool-session-token")
-		td := shorelineClient.CheckToken(token)
+// the nested pumpSettings values the settings param can match on, mapped to the array of settings
+// segments they are found in and the segment field. basalSchedules.<name>.rate is also accepted
+var settingsFields = map[string][2]string{
+	"bgTarget.low":              {"bgTarget", "low"},
+	"bgTarget.high":             {"bgTarget", "high"},
+	"bgTarget.target":           {"bgTarget", "target"},
+	"bgTarget.range":            {"bgTarget", "range"},
+	"carbRatio.amount":          {"carbRatio", "amount"},
+	"insulinSensitivity.amount": {"insulinSensitivity", "amount"},
+}
 
-		if td == nil || !(td.IsServer || td.UserID == userToView || userCanViewData(td.UserID, userToView)) {
-			jsonError(res, error_no_view_permisson, start)
-			return
+// Tidepool user ids are lowercase hex, 10 characters long or 32 for newer accounts
+var userIdFormat = regexp.MustCompile(`^([0-9a-f]{10}|[0-9a-f]{32})$`)
+
+var basalScheduleName = regexp.MustCompile(`^basalSchedules\.([A-Za-z0-9]+)\.rate$`)
+
+// parseSettingsMatch turns a settings param of comma separated field:value pairs e.g.
+// "bgTarget.low:80,bgTarget.high:140" into $elemMatch criteria keyed by the settings array they apply
+// to, so every criterion on the same array has to match within a single segment. Only the fields in
+// settingsFields and basal schedule rates are accepted
+func parseSettingsMatch(settings string) (map[string]bson.M, error) {
+	if settings == "" {
+		return nil, nil
+	}
+	matches := map[string]bson.M{}
+	for _, pair := range strings.Split(settings, ",") {
+		fieldAndValue := strings.SplitN(pair, ":", 2)
+		if len(fieldAndValue) != 2 {
+			return nil, fmt.Errorf("settings must be field:value pairs, got [%s]", pair)
+		}
+		field, ok := settingsFields[fieldAndValue[0]]
+		if !ok {
+			if name := basalScheduleName.FindStringSubmatch(fieldAndValue[0]); name != nil {
+				field, ok = [2]string{"basalSchedules." + name[1], "rate"}, true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("settings field [%s] can't be matched on", fieldAndValue[0])
 		}
+		value, err := strconv.ParseFloat(fieldAndValue[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("settings value for [%s] must be a number, got [%s]", fieldAndValue[0], fieldAndValue[1])
+		}
+		if matches[field[0]] == nil {
+			matches[field[0]] = bson.M{}
+		}
+		matches[field[0]][field[1]] = value
+	}
+	return matches, nil
+}
 
-		pair := seagullClient.GetPrivatePair(userToView, "uploads", shorelineClient.TokenProvide())
-		if pair == nil {
-			jsonError(res, error_no_permissons, start)
-			return
+// parseTypeSubTypes turns a typeSubtype param of comma separated type:subtype pairs e.g.
+// "bolus:normal,basal:scheduled" into clauses that each require both the type and subtype to match.
+// A pair without a subtype e.g. "smbg" matches on type alone
+func parseTypeSubTypes(typeSubTypes string) ([]bson.M, error) {
+	if typeSubTypes == "" {
+		return nil, nil
+	}
+	clauses := []bson.M{}
+	for _, pair := range strings.Split(typeSubTypes, ",") {
+		typeAndSubType := strings.SplitN(pair, ":", 2)
+		if typeAndSubType[0] == "" {
+			return nil, fmt.Errorf("typeSubtype pairs need a type, got [%s]", pair)
+		}
+		clause := bson.M{"type": typeAndSubType[0]}
+		if len(typeAndSubType) == 2 && typeAndSubType[1] != "" {
+			clause["subType"] = typeAndSubType[1]
 		}
+		clauses = append(clauses, clause)
+	}
+	return clauses, nil
+}
 
-		groupId := pair.ID
+// parseExists turns an exists param of comma separated field:true|false pairs e.g.
+// "carbInput:true,payload.sgv:false" into the fields that must or must not be present. Only the
+// allowed fields and fields nested under them can be checked
+func parseExists(exists string, allowed []string) (map[string]bool, error) {
+	if exists == "" {
+		return nil, nil
+	}
+	fields := map[string]bool{}
+	for _, pair := range strings.Split(exists, ",") {
+		fieldAndValue := strings.SplitN(pair, ":", 2)
+		if len(fieldAndValue) != 2 || (fieldAndValue[1] != "true" && fieldAndValue[1] != "false") {
+			return nil, fmt.Errorf("exists must be field:true or field:false pairs, got [%s]", pair)
+		}
+		field := fieldAndValue[0]
+		isAllowed := false
+		for _, allowedField := range allowed {
+			if field == allowedField || strings.HasPrefix(field, allowedField+".") {
+				isAllowed = true
+				break
+			}
+		}
+		if !isAllowed || strings.ContainsAny(field, "$ ") || strings.Contains(field, "..") || strings.HasSuffix(field, ".") {
+			return nil, fmt.Errorf("exists can't check field [%s]", field)
+		}
+		fields[field] = fieldAndValue[1] == "true"
+	}
+	return fields, nil
+}
 
-		mongoSession := session.Copy()
-		defer mongoSession.Close()
+// typeSchemaVersionFloors builds the alternatives that hold records of the given types to their
+// minimum schema versions while letting every other type through. Only floors for the requested
+// types are included, all of them when no type was requested
+func typeSchemaVersionFloors(typeMinimums map[string]int, requestedTypes []string) []bson.M {
+	requested := map[string]bool{}
+	for _, objType := range requestedTypes {
+		if objType != "" {
+			requested[objType] = true
+		}
+	}
 
-		groupDataQuery, queryBuildError := generateMongoQuery(groupId, config.SchemaVersion.Minimum, config.SchemaVersion.Maximum , 
-						  startDateString , endDateString, objType, objSubType)
-		
-		if queryBuildError != nil {
-			log.Println(DATA_API_PREFIX, fmt.Sprintf("Error parsing date: %s", queryBuildError))
-			jsonError(res, error_incorrect_params, start)
-			return
+	floorTypes := []string{}
+	for objType := range typeMinimums {
+		if len(requested) == 0 || requested[objType] {
+			floorTypes = append(floorTypes, objType)
 		}
-		log.Println(DATA_API_PREFIX, fmt.Sprintf("query:",groupDataQuery))
-	
-		//don't return these fields
-		removeFieldsForReturn := bson.M{"_id": 0, "_groupId": 0, "_version": 0, "_active": 0, "_schemaVersion": 0, "createdTime": 0, "modifiedTime": 0}
+	}
+	if len(floorTypes) == 0 {
+		return nil
+	}
+	sort.Strings(floorTypes)
 
-		startQueryTime := time.Now()
-		//use an iterator to protect against very large queries
-		iter := mongoSession.DB("").C(deviceDataCollection).
-			Find(groupDataQuery).
-			Select(removeFieldsForReturn).
-			Iter()
+	floors := []bson.M{{"type": bson.M{"$nin": floorTypes}}}
+	for _, objType := range floorTypes {
+		floors = append(floors, bson.M{"type": objType, "_schemaVersion": bson.M{"$gte": typeMinimums[objType]}})
+	}
+	return floors
+}
+
+// getParams reads the filter params shared by the data endpoints from the request query, applying the
+// configured date handling. The groupId is filled in once the user's permissions have been checked
+func getParams(q url.Values, config *Config) (*params, *detailedError) {
+	p := &params{
+		minSchemaVersion:      config.SchemaVersion.Minimum,
+		maxSchemaVersion:      config.SchemaVersion.Maximum,
+		typeMinSchemaVersions: config.SchemaVersion.TypeMinimums,
+		startDate:             q.Get("startdate"),
+		endDate:               q.Get("enddate"),
+		types:                 q.Get("type"),
+		subTypes:              q.Get("subtype"),
+		deviceIds:             q.Get("deviceId"),
+		uploadIds:             q.Get("uploadId"),
+		endDateSkew:           time.Duration(config.EndDateSkewMinutes) * time.Minute,
+		before:                q.Get("before"),
+		times:                 q.Get("times"),
+	}
+
+	if startDate, endDate, periodError := calendarPeriod(q); periodError != nil {
+		return nil, periodError
+	} else if startDate != "" {
+		p.startDate, p.endDate = startDate, endDate
+	}
+	if p.startDate == "" && p.endDate == "" {
+		p.startDate = defaultStartDate(p.types, config.DefaultWindowDays, time.Now())
+	}
+	if protected := windowRequired(p.types, config.DateWindowRequiredTypes); p.startDate == "" && protected != "" {
+		windowError := error_window_required.setInternalMessage(fmt.Errorf("type [%s] needs a startdate", protected))
+		return nil, &windowError
+	}
+	if config.ExcludeFuture.Enabled {
+		p.notAfter = time.Now().Add(time.Duration(config.ExcludeFuture.SkewMinutes) * time.Minute)
+	}
 
-		processResults(res, iter, startQueryTime)
+	//checked here so a client's typo is reported as such rather than failing when the query is built
+	dates := map[string]string{"startdate": q.Get("startdate"), "enddate": q.Get("enddate"), "before": p.before}
+	for _, param := range []string{"startdate", "enddate", "before"} {
+		if value := dates[param]; value != "" {
+			if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+				dateError := invalidDate(param, value)
+				return nil, &dateError
+			}
+		}
+	}
+	if p.times != "" {
+		for _, value := range strings.Split(p.times, ",") {
+			if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+				dateError := invalidDate("times", value)
+				return nil, &dateError
+			}
+		}
+	}
 
-	})))
+	var err error
+	if p.startDate, err = enforceUTCDate(p.startDate, config.UTCDates); err != nil {
+		dateError := error_date_not_utc.setInternalMessage(err)
+		return nil, &dateError
+	}
+	if p.endDate, err = enforceUTCDate(p.endDate, config.UTCDates); err != nil {
+		dateError := error_date_not_utc.setInternalMessage(err)
+		return nil, &dateError
+	}
+	if p.before, err = enforceUTCDate(p.before, config.UTCDates); err != nil {
+		dateError := error_date_not_utc.setInternalMessage(err)
+		return nil, &dateError
+	}
+	if p.times != "" {
+		times := strings.Split(p.times, ",")
+		for i := range times {
+			if times[i], err = enforceUTCDate(times[i], config.UTCDates); err != nil {
+				dateError := error_date_not_utc.setInternalMessage(err)
+				return nil, &dateError
+			}
+		}
+		p.times = strings.Join(times, ",")
+	}
+
+	if p.settings, err = parseSettingsMatch(q.Get("settings")); err != nil {
+		paramError := invalidParam("settings", q.Get("settings"), "field:value pairs of pump settings with numeric values")
+		paramError.InternalMessage = err.Error()
+		return nil, &paramError
+	}
+	if p.typeSubTypes, err = parseTypeSubTypes(q.Get("typeSubtype")); err != nil {
+		paramError := invalidParam("typeSubtype", q.Get("typeSubtype"), "type:subtype pairs, each with a type")
+		paramError.InternalMessage = err.Error()
+		return nil, &paramError
+	}
+	existsFields := config.ExistsFields
+	if len(existsFields) == 0 {
+		existsFields = defaultExistsFields
+	}
+	if p.exists, err = parseExists(q.Get("exists"), existsFields); err != nil {
+		paramError := invalidParam("exists", q.Get("exists"), "field:true or field:false pairs of fields that can be checked")
+		paramError.InternalMessage = err.Error()
+		return nil, &paramError
+	}
+	if p.search, err = parseSearch(q.Get("search"), config.SearchFields); err != nil {
+		paramError := invalidParam("search", q.Get("search"), "plain words, on a server with search fields configured")
+		paramError.InternalMessage = err.Error()
+		return nil, &paramError
+	}
+
+	if err := duplicateValues(p, config.DuplicateValues); err != nil {
+		duplicateError := error_duplicate_values.setInternalMessage(err)
+		return nil, &duplicateError
+	}
+
+	maxClauses := config.MaxQueryClauses
+	if maxClauses <= 0 {
+		maxClauses = DEFAULT_MAX_QUERY_CLAUSES
+	}
+	if clauses := queryClauses(p); clauses > maxClauses {
+		complexError := error_query_too_complex.setInternalMessage(fmt.Errorf("params add %d clauses, the most allowed is %d", clauses, maxClauses))
+		return nil, &complexError
+	}
+
+	return p, nil
+}
+
+// generateMongoQuery takes in a number of parameters and constructs a mongo query
+// to retrieve objects from the Tidepool database. It is used by the router.Add("GET", "/{userID}"
+// endpoint, which implements the Tide-whisperer API. See that function for further documentation
+// on parameters
+func generateMongoQuery(p *params) (bson.M, error) {
+
+	//the query params for type and subtype can contain multiple values seperated by a comma e.g. "type=smbg,cbg"
+	//so split them out into an array of values
+	objTypes := strings.Split(p.types, ",")
+	objSubTypes := strings.Split(p.subTypes, ",")
+
+	startDateString := p.startDate
+	endDateString := p.endDate
+
+	if startDateString != "" {
+		startDate, err := time.Parse(time.RFC3339Nano, startDateString)
+		if err != nil {
+			return nil, err
+		}
+		startDateString = startDate.Format(time.RFC3339Nano)
+	}
+	if endDateString != "" {
+		endDate, err := time.Parse(time.RFC3339Nano, endDateString)
+		if err != nil {
+			return nil, err
+		}
+		endDate = endDate.Add(p.endDateSkew)
+		if !p.notAfter.IsZero() && endDate.After(p.notAfter) {
+			endDate = p.notAfter.UTC()
+		}
+		endDateString = endDate.Format(time.RFC3339Nano)
+	} else if !p.notAfter.IsZero() {
+		endDateString = p.notAfter.UTC().Format(time.RFC3339Nano)
+	}
+
+	groupDataQuery := bson.M{"_groupId": p.groupId,
+		"_active":        true,
+		"_schemaVersion": bson.M{"$gte": p.minSchemaVersion, "$lte": p.maxSchemaVersion}}
+
+	//if optional parameters are present, then add them to the query
+	if len(objTypes) > 0 && objTypes[0] != "" {
+		groupDataQuery["type"] = bson.M{"$in": objTypes}
+	}
+	if len(p.excludedTypes) > 0 {
+		typeClause, ok := groupDataQuery["type"].(bson.M)
+		if !ok {
+			typeClause = bson.M{}
+			groupDataQuery["type"] = typeClause
+		}
+		typeClause["$nin"] = p.excludedTypes
+	}
+
+	if len(objSubTypes) > 0 && objSubTypes[0] != "" {
+		groupDataQuery["subType"] = bson.M{"$in": objSubTypes}
+	}
+
+	if p.deviceIds != "" {
+		groupDataQuery["deviceId"] = bson.M{"$in": strings.Split(p.deviceIds, ",")}
+	}
+	if p.uploadIds != "" {
+		groupDataQuery["uploadId"] = bson.M{"$in": strings.Split(p.uploadIds, ",")}
+	}
+
+	if startDateString != "" && endDateString != "" {
+		groupDataQuery["time"] = bson.M{"$gte": startDateString, "$lte": endDateString}
+	} else if startDateString != "" {
+		groupDataQuery["time"] = bson.M{"$gte": startDateString}
+	} else if endDateString != "" {
+		groupDataQuery["time"] = bson.M{"$lte": endDateString}
+	}
+
+	if p.before != "" {
+		before, err := time.Parse(time.RFC3339Nano, p.before)
+		if err != nil {
+			return nil, err
+		}
+		timeRange, ok := groupDataQuery["time"].(bson.M)
+		if !ok {
+			timeRange = bson.M{}
+			groupDataQuery["time"] = timeRange
+		}
+		timeRange["$lt"] = before.Format(time.RFC3339Nano)
+	}
+
+	if p.times != "" {
+		//formatted the same way as the stored times so equivalent forms e.g. .000Z match
+		times := []string{}
+		for _, timeString := range strings.Split(p.times, ",") {
+			exact, err := time.Parse(time.RFC3339Nano, timeString)
+			if err != nil {
+				return nil, err
+			}
+			times = append(times, exact.UTC().Format(time.RFC3339Nano))
+		}
+		timeRange, ok := groupDataQuery["time"].(bson.M)
+		if !ok {
+			timeRange = bson.M{}
+			groupDataQuery["time"] = timeRange
+		}
+		timeRange["$in"] = times
+	}
+
+	for field, criteria := range p.settings {
+		groupDataQuery[field] = bson.M{"$elemMatch": criteria}
+	}
+
+	for field, exists := range p.exists {
+		if clause, ok := groupDataQuery[field].(bson.M); ok {
+			clause["$exists"] = exists
+		} else {
+			groupDataQuery[field] = bson.M{"$exists": exists}
+		}
+	}
+
+	//each of these is a set of alternatives, all of which must be satisfied
+	ors := [][]bson.M{}
+	if len(p.typeSubTypes) > 0 {
+		ors = append(ors, p.typeSubTypes)
+	}
+	if floors := typeSchemaVersionFloors(p.typeMinSchemaVersions, objTypes); len(floors) > 0 {
+		ors = append(ors, floors)
+	}
+	if len(p.search) > 0 {
+		ors = append(ors, p.search)
+	}
+	if p.after != nil {
+		ors = append(ors, p.after.after())
+	}
+	if len(ors) == 1 {
+		groupDataQuery["$or"] = ors[0]
+	} else if len(ors) > 1 {
+		and := []bson.M{}
+		for _, or := range ors {
+			and = append(and, bson.M{"$or": or})
+		}
+		groupDataQuery["$and"] = and
+	}
+
+	return groupDataQuery, nil
+}
+
+func main() {
+	const deviceDataCollection = "deviceData"
+	var config Config
+	if err := common.LoadConfig([]string{"./config/env.json", "./config/server.json"}, &config); err != nil {
+		log.Fatal(DATA_API_PREFIX, "Problem loading config: ", err)
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	httpClient := &http.Client{Transport: tr}
+
+	//when enabled each downstream client gets its own client so its calls are recorded separately
+	metrics := newClientMetrics(config.Metrics.Buckets)
+	clientFor := func(name string) *http.Client {
+		if !config.Metrics.Enabled {
+			return httpClient
+		}
+		return &http.Client{Transport: metrics.instrument(name, tr)}
+	}
+
+	hakkenClient := hakken.NewHakkenBuilder().
+		WithConfig(&config.HakkenConfig).
+		Build()
+
+	if err := hakkenClient.Start(); err != nil {
+		log.Fatal(DATA_API_PREFIX, err)
+	}
+	defer func() {
+		if err := hakkenClient.Close(); err != nil {
+			log.Panic(DATA_API_PREFIX, "Error closing hakkenClient, panicing to get stacks: ", err)
+		}
+	}()
+
+	shorelineClient := shoreline.NewShorelineClientBuilder().
+		WithHostGetter(config.ShorelineConfig.ToHostGetter(hakkenClient)).
+		WithHttpClient(clientFor("shoreline")).
+		WithConfig(&config.ShorelineConfig.ShorelineClientConfig).
+		Build()
+
+	seagullClient := clients.NewSeagullClientBuilder().
+		WithHostGetter(config.SeagullConfig.ToHostGetter(hakkenClient)).
+		WithHttpClient(clientFor("seagull")).
+		Build()
+
+	gatekeeperClient := clients.NewGatekeeperClientBuilder().
+		WithHostGetter(config.GatekeeperConfig.ToHostGetter(hakkenClient)).
+		WithHttpClient(clientFor("gatekeeper")).
+		WithTokenProvider(shorelineClient).
+		Build()
+
+	pairs := newPairCache(seagullClient, time.Duration(config.SelfPairCacheMinutes)*time.Minute, time.Duration(config.PairCacheMinutes)*time.Minute)
+
+	switch config.GatekeeperTimeout.Fallback {
+	case "", GATEKEEPER_FALLBACK_DENY, GATEKEEPER_FALLBACK_CACHED_ALLOW:
+	default:
+		log.Fatal(DATA_API_PREFIX, "Problem loading gatekeeperTimeout: unknown fallback ", config.GatekeeperTimeout.Fallback)
+	}
+	permissions := newPermissionChecker(gatekeeperClient,
+		time.Duration(config.GatekeeperTimeout.Milliseconds)*time.Millisecond,
+		config.GatekeeperTimeout.Fallback,
+		time.Duration(config.GatekeeperTimeout.CacheMinutes)*time.Minute,
+		metrics)
+	userCanViewData := permissions.canView
+
+	//check the request's token allows viewing the user's data and look up the group their data is stored
+	//under. When serverOnly only server tokens are allowed, and the configured serverOnlyTypes are kept from
+	//other users. When either fails the error response is written and ok is false
+	lookupGroupId := func(req *http.Request, userToView string, p *params, serverOnly bool) (string, *detailedError) {
+		if config.ValidateUserIds && !userIdFormat.MatchString(userToView) {
+			userIdError := error_invalid_user_id
+			return "", &userIdError
+		}
+
+		token := req.Header.Get("x-tidepool-session-token")
+		td := shorelineClient.CheckToken(token)
+
+		if serverOnly && (td == nil || !td.IsServer) {
+			serverError := error_server_only
+			return "", &serverError
+		}
+		if td == nil || !(td.IsServer || td.UserID == userToView || userCanViewData(td.UserID, userToView)) {
+			viewError := error_no_view_permisson
+			return "", &viewError
+		}
+		if !td.IsServer && td.UserID != userToView && len(config.ServerOnlyTypes) > 0 {
+			if err := restrictTypes(p, config.ServerOnlyTypes); err != nil {
+				typesError := error_server_only.setInternalMessage(err)
+				return "", &typesError
+			}
+		}
+
+		return pairs.groupId(userToView, shorelineClient.TokenProvide(), td.UserID == userToView, config.NoUploads)
+	}
+	getGroupId := func(res http.ResponseWriter, req *http.Request, userToView string, p *params, serverOnly bool, start time.Time) (groupId string, ok bool) {
+		groupId, groupError := lookupGroupId(req, userToView, p, serverOnly)
+		if groupError != nil {
+			jsonError(res, *groupError, start)
+			return "", false
+		}
+		return groupId, true
+	}
+
+	if err := shorelineClient.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	session, err := mongo.Connect(&config.Mongo)
+	if err != nil {
+		log.Fatal(DATA_API_PREFIX, "Problem connecting to mongo: ", redactConnectionStrings(err.Error()))
+	}
+	switch config.MissingCollection {
+	case "", "warn", "create", "fail":
+	default:
+		log.Fatal(DATA_API_PREFIX, "Problem loading missingCollection: unknown policy ", config.MissingCollection)
+	}
+	if _, err := prepareCollection(session.DB("").C(deviceDataCollection), deviceDataCollection, deviceDataIndexes, config.MissingCollection); err != nil {
+		if config.MissingCollection == "fail" {
+			log.Fatal(DATA_API_PREFIX, "Problem preparing mongo: ", err)
+		}
+		log.Print(DATA_API_PREFIX, "Problem preparing mongo: ", err)
+	}
+
+	sessions := newMongoSessions(session, time.Duration(config.SessionMaxAgeMinutes)*time.Minute)
+
+	compressor, err := newCompressor(&config)
+	if err != nil {
+		log.Fatal(DATA_API_PREFIX, "Problem loading zstd dictionary: ", err)
+	}
+	//the compressing writer hides the language so it's picked again for the wrapped handler
+	compress := func(h http.Handler) http.Handler {
+		return compressor(localizeErrors(h))
+	}
+
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		log.Fatal(DATA_API_PREFIX, "Problem loading trustedProxies: ", err)
+	}
+	secure := func(h http.Handler) http.Handler {
+		return requireHTTPS(h, config.RequireHTTPS, proxies)
+	}
+
+	registerRecordProcessor("normalizeUnits", newUnitNormalizer(config.UnitAliases))
+	if config.AnonymizeKey != "" {
+		registerRecordProcessor("anonymize", newAnonymizer(config.AnonymizeKey))
+	}
+	processors, err := loadRecordProcessors(config.RecordProcessors)
+	if err != nil {
+		log.Fatal(DATA_API_PREFIX, "Problem loading recordProcessors: ", err)
+	}
+	//the source is tagged last so no processor can remove it
+	sourceProcessors := func(collection string) []RecordProcessor {
+		if !config.SourceTag {
+			return nil
+		}
+		return []RecordProcessor{tagSource(collection)}
+	}
+	tombstoneProcessors := sourceProcessors(config.TombstoneCollection)
+	processors = append(processors, sourceProcessors(deviceDataCollection)...)
+
+	insulinDuration := DEFAULT_INSULIN_DURATION
+	if config.InsulinAction.DurationMinutes > 0 {
+		insulinDuration = time.Duration(config.InsulinAction.DurationMinutes) * time.Minute
+	}
+	insulinPeak := DEFAULT_INSULIN_PEAK
+	if config.InsulinAction.PeakMinutes > 0 {
+		insulinPeak = time.Duration(config.InsulinAction.PeakMinutes) * time.Minute
+	}
+	curve, err := newInsulinCurve(insulinDuration, insulinPeak)
+	if err != nil {
+		log.Fatal(DATA_API_PREFIX, "Problem loading insulinAction: ", err)
+	}
+
+	if config.DefaultFormat != "" {
+		if err := checkFormat(config.DefaultFormat); err != nil {
+			log.Fatal(DATA_API_PREFIX, "Problem loading defaultFormat: ", err)
+		}
+	}
+
+	switch config.DuplicateParams {
+	case "", "first", "last", "reject":
+	default:
+		log.Fatal(DATA_API_PREFIX, "Problem loading duplicateParams: unknown policy ", config.DuplicateParams)
+	}
+	switch config.DuplicateValues {
+	case "", "dedupe", "reject":
+	default:
+		log.Fatal(DATA_API_PREFIX, "Problem loading duplicateValues: unknown policy ", config.DuplicateValues)
+	}
+	switch config.NoUploads {
+	case "", "empty", "notFound":
+	default:
+		log.Fatal(DATA_API_PREFIX, "Problem loading noUploads: unknown response ", config.NoUploads)
+	}
+
+	rawLimiter := newLimiter(config.Concurrency.Raw)
+	aggregationLimiter := newLimiter(config.Concurrency.Aggregation)
+	streamLimiter := newLimiter(config.Concurrency.Streams)
+
+	//only lets requests with a server token through
+	serverOnly := func(h http.Handler) http.Handler {
+		return requireServerToken(h, shorelineClient)
+	}
+
+	queries := newQueryRegistry()
+
+	ping := func() error {
+		return sessions.retry(func() error {
+			mongoSession := sessions.Copy()
+			defer mongoSession.Close()
+			return mongoSession.Ping()
+		})
+	}
+
+	router := pat.New()
+	// The /data/status/detail endpoint reports mongo's health, uptime and how many requests are in progress as
+	// {"mongo": "OK", "mongoPingSeconds": 0.002, "uptimeSeconds": 3600, "queriesInProgress": 2, "rawInUse": 2, "aggregationInUse": 0}.
+	// Served when detailedStatus is "server", for server tokens only, or "open". Registered before /status, which
+	// stays open for load balancers
+	switch config.DetailedStatus {
+	case "server":
+		router.Add("GET", "/status/detail", serverOnly(detailedStatusHandler(ping, time.Now(), queries, rawLimiter, aggregationLimiter)))
+	case "open":
+		router.Add("GET", "/status/detail", detailedStatusHandler(ping, time.Now(), queries, rawLimiter, aggregationLimiter))
+	case "":
+	default:
+		log.Fatal(DATA_API_PREFIX, "Problem loading detailedStatus: unknown policy ", config.DetailedStatus)
+	}
+	router.Add("GET", "/status", statusHandler(ping))
+
+	indexSamples := newIndexUsage()
+	//started once the response is written, with a session of its own, so it doesn't run alongside the query
+	//it explains or slow the sampled request down
+	explainQuery := func(query bson.M, options queryOptions) {
+		mongoSession := sessions.Copy()
+		defer mongoSession.Close()
+
+		var explain bson.M
+		if err := options.apply(mongoSession.DB("").C(deviceDataCollection).Find(query)).Explain(&explain); err != nil {
+			log.Println(DATA_API_PREFIX, "explaining sampled query failed:", redactConnectionStrings(err.Error()))
+			return
+		}
+		shape, indexed := queryShape(query), usedIndex(explain)
+		indexSamples.record(shape, indexed)
+		if !config.Metrics.Enabled {
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("sampled query filtering on [%s] used an index [%t]", shape, indexed))
+		}
+	}
+
+	//registered before /{userID} so they aren't taken as a userID
+	if config.Metrics.Enabled {
+		router.Add("GET", "/metrics", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			metrics.ServeHTTP(res, req)
+			indexSamples.writeMetrics(res)
+		}))
+	}
+	// The /data/queries endpoint lists the data requests in progress, longest running first, as
+	// [{"requestId": "...", "userId": "...", "started": "2015-10-10T15:00:00Z", "params": "type=cbg"}, ...]
+	// to find a runaway query during an incident. Only servers can use it
+	router.Add("GET", "/queries", secure(serverOnly(queries)))
+
+	// The /data/indexes endpoint creates any of the indexes the queries rely on that are missing, including the
+	// maintenance ones not built at startup, without a redeploy. It reports each as {"key": ["_groupId", ...],
+	// "created": true}. Only servers can use it, and only when indexEndpoint is configured
+	if config.IndexEndpoint {
+		router.Add("POST", "/indexes", secure(serverOnly(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+
+			mongoSession := sessions.Copy()
+			defer mongoSession.Close()
+
+			results, err := ensureIndexes(mongoSession.DB("").C(deviceDataCollection), allIndexes())
+			if err != nil {
+				jsonError(res, error_running_query.setInternalMessage(err), start)
+				return
+			}
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("ensured indexes %+v", results))
+
+			bytes, err := json.Marshal(results)
+			if err != nil {
+				jsonError(res, error_loading_events.setInternalMessage(err), start)
+				return
+			}
+			res.Header().Set("Content-Type", "application/json")
+			res.Write(bytes)
+		}))))
+	}
+
+	// The /data/userId/tombstones endpoint returns the tombstones left when the user's data was deleted or an
+	// upload cancelled, so uploads can be reconciled. Only servers can use it. It accepts the type, subtype,
+	// startdate and enddate params of /data/userId, with the dates matched against the replaced record's time
+	if config.TombstoneCollection != "" {
+		router.Add("GET", "/{userID}/tombstones", secure(rawLimiter.limit(compress(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+
+			userToView := req.URL.Query().Get(":userID")
+
+			p, paramsError := getParams(req.URL.Query(), &config)
+			if paramsError != nil {
+				jsonError(res, *paramsError, start)
+				return
+			}
+
+			groupId, ok := getGroupId(res, req, userToView, p, true, start)
+			if !ok {
+				return
+			}
+			p.groupId = groupId
+
+			query, err := tombstoneQuery(p)
+			if err != nil {
+				jsonError(res, error_incorrect_params.setInternalMessage(err), start)
+				return
+			}
+
+			mongoSession := sessions.Copy()
+			defer mongoSession.Close()
+
+			iter := mongoSession.DB("").C(config.TombstoneCollection).
+				Find(query).
+				Select(internalFieldsProjection()).
+				Iter()
+			processResults(res, iter, resultOptions{emptyStatus: http.StatusOK, processors: tombstoneProcessors, done: req.Context().Done()}, start)
+		})))))
+	}
+
+	// The /data/userId/manifest endpoint summarises what /data/userId would return for the same type, subtype,
+	// startdate and enddate params, so clients can decide whether to go ahead with a large export, as
+	// {"count": 1235, "start": "...", "end": "...", "estimatedBytes": 308750, "types": {"cbg": {"count": 1234, "start": "...", "end": "..."}, ...}}
+	router.Add("GET", "/{userID}/manifest", secure(aggregationLimiter.limit(compress(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		userToView := req.URL.Query().Get(":userID")
+
+		p, paramsError := getParams(req.URL.Query(), &config)
+		if paramsError != nil {
+			jsonError(res, *paramsError, start)
+			return
+		}
+
+		groupId, ok := getGroupId(res, req, userToView, p, false, start)
+		if !ok {
+			return
+		}
+		p.groupId = groupId
+
+		groupDataQuery, err := generateMongoQuery(p)
+		if err != nil {
+			jsonError(res, error_incorrect_params.setInternalMessage(err), start)
+			return
+		}
+
+		var summary *manifest
+		err = sessions.retry(func() error {
+			mongoSession := sessions.Copy()
+			defer mongoSession.Close()
+
+			var stats struct {
+				AvgObjSize float64 `bson:"avgObjSize"`
+			}
+			if err := mongoSession.DB("").Run(bson.D{{Name: "collStats", Value: deviceDataCollection}}, &stats); err != nil {
+				return err
+			}
+
+			iter := mongoSession.DB("").C(deviceDataCollection).Pipe(manifestPipeline(groupDataQuery)).Iter()
+			summary, err = buildManifest(iter, stats.AvgObjSize)
+			return err
+		})
+		if err != nil {
+			jsonError(res, error_running_query.setInternalMessage(err), start)
+			return
+		}
+
+		bytes, err := json.Marshal(summary)
+		if err != nil {
+			jsonError(res, error_loading_events.setInternalMessage(err), start)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(bytes)
+	})))))
+
+	// The /data/userId/events endpoint streams the user's objects as server-sent events for live dashboards. The
+	// objects /data/userId would return for the type, subtype, startdate and enddate params are sent first as
+	// snapshot events followed by a ready event, then objects modified since are sent as update events every
+	// eventPollSeconds until the client disconnects. Each event's id is the object's modifiedTime. Streams over
+	// concurrency.streams are turned away with a 503, a stream's slot is freed when its client disconnects
+	router.Add("GET", "/{userID}/events", secure(streamLimiter.limit(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		userToView := req.URL.Query().Get(":userID")
+
+		p, paramsError := getParams(req.URL.Query(), &config)
+		if paramsError != nil {
+			jsonError(res, *paramsError, start)
+			return
+		}
+
+		groupId, ok := getGroupId(res, req, userToView, p, false, start)
+		if !ok {
+			return
+		}
+		p.groupId = groupId
+
+		if _, err := generateMongoQuery(p); err != nil {
+			jsonError(res, error_incorrect_params.setInternalMessage(err), start)
+			return
+		}
+
+		flusher, ok := res.(http.Flusher)
+		if !ok {
+			jsonError(res, error_loading_events.setInternalMessage(fmt.Errorf("response can't be streamed")), start)
+			return
+		}
+
+		mongoSession := sessions.Copy()
+		defer mongoSession.Close()
+
+		//modifiedTime is needed to find what has changed, the stream removes it before sending
+		projection := internalFieldsProjection()
+		delete(projection, "modifiedTime")
+
+		fetch := func(since string) resultIter {
+			//objects stop being in the future as the stream goes on
+			if config.ExcludeFuture.Enabled {
+				p.notAfter = time.Now().Add(time.Duration(config.ExcludeFuture.SkewMinutes) * time.Minute)
+			}
+			groupDataQuery, err := generateMongoQuery(p)
+			if err != nil {
+				return failedIter{err}
+			}
+			if since == "" {
+				return mongoSession.DB("").C(deviceDataCollection).Find(groupDataQuery).Select(projection).Iter()
+			}
+			groupDataQuery["modifiedTime"] = bson.M{"$gte": since}
+			return mongoSession.DB("").C(deviceDataCollection).Find(groupDataQuery).Select(projection).Sort("modifiedTime").Iter()
+		}
+
+		pollInterval := DEFAULT_EVENT_POLL_INTERVAL
+		if config.EventPollSeconds > 0 {
+			pollInterval = time.Duration(config.EventPollSeconds) * time.Second
+		}
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		stream := &eventStream{w: res, flush: flusher.Flush, processors: processors}
+		if err := streamEvents(stream, fetch, time.Now(), ticker.C, req.Context().Done()); err != nil {
+			//the stream is already under way so all we can do is log it
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("events stream for [%s] stopped: %s", userToView, err))
+		}
+	}))))
+
+	// The /data/userId/validate endpoint takes the same params as /data/userId and checks them, and the requester's
+	// permission, without querying for the data. It returns 200 with the params as they would be used, or 400 with
+	// the reason they were rejected e.g. {"valid": false, "error": {"code": "params", "detail": "..."}}
+	router.Add("GET", "/{userID}/validate", secure(validateHandler(&config, getGroupId)))
+
+	// The /data/ndjson endpoint converts a json array posted to it, e.g. an export saved from /data/userId, into
+	// newline delimited json with one element per line, as format=ndjson returns. The lines are streamed back as
+	// the array is read so it's never all held in memory. Only servers can use it
+	router.Add("POST", "/ndjson", secure(serverOnly(ndjsonHandler())))
+
+	//several users' data in one request, checking permission for each
+	router.Add("POST", "/data", secure(rawLimiter.limit(compress(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mongoSession := sessions.Copy()
+		guard := &iterGuard{}
+		defer guard.closeSession(mongoSession)
+
+		batchHandler(&config, lookupGroupId, processors, func(query bson.M) resultIter {
+			return guard.track(mongoSession.DB("").C(deviceDataCollection).Find(query).Select(internalFieldsProjection()).Sort("time").Iter())
+		}).ServeHTTP(res, req)
+	})))))
+
+	// The /data/userId/count endpoint returns how many objects /data/userId would return for the same type, subtype
+	// and date params as {"count": 1234}, without reading them
+	router.Add("GET", "/{userID}/count", secure(aggregationLimiter.limit(countHandler(&config, getGroupId, func(query bson.M) (int, error) {
+		var n int
+		err := sessions.retry(func() (err error) {
+			mongoSession := sessions.Copy()
+			defer mongoSession.Close()
+
+			n, err = mongoSession.DB("").C(deviceDataCollection).Find(query).Count()
+			return err
+		})
+		return n, err
+	}))))
+
+	// The /data/userId/deviceStatus endpoint returns the latest object from each of the user's devices, for showing
+	// when each last synced, as {"<deviceId>": {"time": "2015-10-10T15:00:00Z", "type": "cbg"}, ...}. Takes the same
+	// type, subtype, startdate and enddate params as /data/userId, with its default window
+	router.Add("GET", "/{userID}/deviceStatus", secure(aggregationLimiter.limit(compress(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		userToView := req.URL.Query().Get(":userID")
+
+		p, paramsError := getParams(req.URL.Query(), &config)
+		if paramsError != nil {
+			jsonError(res, *paramsError, start)
+			return
+		}
+
+		groupId, ok := getGroupId(res, req, userToView, p, false, start)
+		if !ok {
+			return
+		}
+		p.groupId = groupId
+
+		groupDataQuery, err := generateMongoQuery(p)
+		if err != nil {
+			jsonError(res, error_incorrect_params.setInternalMessage(err), start)
+			return
+		}
+
+		var devices map[string]deviceStatus
+		err = sessions.retry(func() error {
+			mongoSession := sessions.Copy()
+			defer mongoSession.Close()
+
+			iter := mongoSession.DB("").C(deviceDataCollection).Pipe(deviceStatusPipeline(groupDataQuery)).Iter()
+			devices, err = latestByDevice(iter)
+			return err
+		})
+		if err != nil {
+			jsonError(res, error_running_query.setInternalMessage(err), start)
+			return
+		}
+
+		bytes, err := json.Marshal(devices)
+		if err != nil {
+			jsonError(res, error_loading_events.setInternalMessage(err), start)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(bytes)
+	})))))
+
+	// The /data/userId/iob endpoint computes the user's insulin on board from their bolus and basal objects using
+	// the configured insulin action curve, returning [{"time": "2015-10-10T15:00:00Z", "iob": 2.345}, ...] every
+	// interval (default 5m) from startdate to enddate, or over the last day without them. Basal is counted in full
+	// rather than relative to the scheduled rate
+	router.Add("GET", "/{userID}/iob", secure(aggregationLimiter.limit(compress(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		userToView := req.URL.Query().Get(":userID")
+
+		//checked as the bolus and basal query that's run, whatever types were asked for
+		p, paramsError := getParams(iobParams(req.URL.Query(), start), &config)
+		if paramsError != nil {
+			jsonError(res, *paramsError, start)
+			return
+		}
+
+		from, to, step, err := iobWindow(p.startDate, p.endDate, req.URL.Query().Get("interval"), start)
+		if err != nil {
+			windowError := invalidParam("interval", req.URL.Query().Get("interval"), fmt.Sprintf("at least 1m e.g. 5m, with enddate after startdate and at most %d points between them", MAX_IOB_POINTS))
+			windowError.InternalMessage = err.Error()
+			jsonError(res, windowError, start)
+			return
+		}
+
+		groupId, ok := getGroupId(res, req, userToView, p, false, start)
+		if !ok {
+			return
+		}
+		p.groupId = groupId
+
+		//insulin delivered up to the curve's duration before the start is still on board, from doses that may have
+		//started up to MAX_DOSE_DURATION before that
+		onBoardFrom := from.Add(-insulinDuration)
+		p.startDate = onBoardFrom.Add(-MAX_DOSE_DURATION).Format(time.RFC3339Nano)
+		p.endDate = to.Format(time.RFC3339Nano)
+		groupDataQuery, err := generateMongoQuery(p)
+		if err != nil {
+			jsonError(res, error_incorrect_params.setInternalMessage(err), start)
+			return
+		}
+
+		var doses []insulinDose
+		err = sessions.retry(func() error {
+			mongoSession := sessions.Copy()
+			defer mongoSession.Close()
+
+			iter := mongoSession.DB("").C(deviceDataCollection).
+				Find(groupDataQuery).
+				Select(bson.M{"_id": 0, "type": 1, "time": 1, "normal": 1, "extended": 1, "rate": 1, "duration": 1}).
+				Iter()
+			doses, err = dosesFromRecords(iter)
+			return err
+		})
+		if err != nil {
+			jsonError(res, error_running_query.setInternalMessage(err), start)
+			return
+		}
+
+		bytes, err := json.Marshal(computeIOB(clipDoses(doses, onBoardFrom, to), curve, from, to, step))
+		if err != nil {
+			jsonError(res, error_loading_events.setInternalMessage(err), start)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(bytes)
+	})))))
+
+	// The /data/userId/ratios endpoint returns the carb ratios applied by boluses given with the bolus wizard, for
+	// therapy review, as [{"time": "2015-10-10T12:00:00Z", "carbInput": 60, "insulin": 6, "ratio": 10, "programmed": 10}, ...]
+	// where insulin is the bolus less the wizard's recommended correction. Takes the startdate and enddate params
+	router.Add("GET", "/{userID}/ratios", secure(aggregationLimiter.limit(compress(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		userToView := req.URL.Query().Get(":userID")
+
+		p, paramsError := getParams(req.URL.Query(), &config)
+		if paramsError != nil {
+			jsonError(res, *paramsError, start)
+			return
+		}
+
+		groupId, ok := getGroupId(res, req, userToView, p, false, start)
+		if !ok {
+			return
+		}
+		p.groupId = groupId
+
+		p.types = "wizard,bolus"
+		p.subTypes = ""
+		groupDataQuery, err := generateMongoQuery(p)
+		if err != nil {
+			jsonError(res, error_incorrect_params.setInternalMessage(err), start)
+			return
+		}
+
+		var ratios []carbRatio
+		err = sessions.retry(func() error {
+			mongoSession := sessions.Copy()
+			defer mongoSession.Close()
+
+			iter := mongoSession.DB("").C(deviceDataCollection).
+				Find(groupDataQuery).
+				Select(bson.M{"_id": 0, "type": 1, "id": 1, "time": 1, "carbInput": 1, "insulinCarbRatio": 1, "bolus": 1, "recommended": 1, "normal": 1, "extended": 1}).
+				Iter()
+			ratios, err = computeRatios(iter)
+			return err
+		})
+		if err != nil {
+			jsonError(res, error_running_query.setInternalMessage(err), start)
+			return
+		}
+
+		bytes, err := json.Marshal(ratios)
+		if err != nil {
+			jsonError(res, error_loading_events.setInternalMessage(err), start)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(bytes)
+	})))))
+
+	// The /data/userId/gaps endpoint finds the periods when a user has no data e.g. for adherence reports.
+	// It accepts the type, subtype, startdate and enddate params of /data/userId and returns the intervals
+	// longer than the configured gap threshold between consecutive objects, and between the given dates
+	// and the first and last objects, as [{"start": "2015-10-10T15:00:00Z", "end": "2015-10-11T09:30:00Z"}, ...]
+	router.Add("GET", "/{userID}/gaps", secure(aggregationLimiter.limit(compress(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		userToView := req.URL.Query().Get(":userID")
+
+		p, paramsError := getParams(req.URL.Query(), &config)
+		if paramsError != nil {
+			jsonError(res, *paramsError, start)
+			return
+		}
+
+		groupId, ok := getGroupId(res, req, userToView, p, false, start)
+		if !ok {
+			return
+		}
+		p.groupId = groupId
+
+		groupDataQuery, err := generateMongoQuery(p)
+		if err != nil {
+			jsonError(res, error_incorrect_params.setInternalMessage(err), start)
+			return
+		}
+
+		threshold := DEFAULT_GAP_THRESHOLD
+		if config.GapThresholdMinutes > 0 {
+			threshold = time.Duration(config.GapThresholdMinutes) * time.Minute
+		}
+
+		var gaps []dataGap
+		err = sessions.retry(func() error {
+			mongoSession := sessions.Copy()
+			defer mongoSession.Close()
+
+			//only the times are needed, in order, to find the gaps between them
+			iter := mongoSession.DB("").C(deviceDataCollection).
+				Find(groupDataQuery).
+				Select(bson.M{"_id": 0, "time": 1}).
+				Sort("time").
+				Iter()
+
+			gaps, err = findGaps(iter, p.startDate, p.endDate, threshold)
+			return err
+		})
+		if err != nil {
+			jsonError(res, error_running_query.setInternalMessage(err), start)
+			return
+		}
+
+		bytes, err := json.Marshal(gaps)
+		if err != nil {
+			jsonError(res, error_loading_events.setInternalMessage(err), start)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(bytes)
+	})))))
+
+	// The /data/userId endpoint retrieves device/health data for a user based on a set of parameters
+	// userid: the ID of the user you want to retrieve data for
+	// type (optional) : The Tidepool data type to search for. Only objects with a type field matching the specified type param will be returned.
+	//					can be /userid?type=smbg or a comma seperated list e.g /userid?type=smgb,cbg . If is a comma seperated
+	//					list, then objects matching any of the sub types will be returned
+	// subtype (optional) : The Tidepool data subtype to search for. Only objects with a subtype field matching the specified subtype param will be returned.
+	//					can be /userid?subtype=physicalactivity or a comma seperated list e.g /userid?subtypetype=physicalactivity,steps . If is a comma seperated
+	//					list, then objects matching any of the types will be returned
+	// startdate (optional) : Only objects with 'time' field equal to or greater than start date will be returned .
+	//						  Must be in ISO date/time format e.g. 2015-10-10T15:00:00.000Z
+	// enddate (optional) : Only objects with 'time' field less than to or equal to start date will be returned .
+	//						  Must be in ISO date/time format e.g. 2015-10-10T15:00:00.000Z
+	//						  The configured endDateSkewMinutes is added to allow for clients with slow clocks
+	//						  When neither date is given and a single type is requested, the type's configured default
+	//						  window (if any) is applied e.g. only the last 14 days of cbg. Without either, types in the
+	//						  configured dateWindowRequiredTypes are rejected
+	// emptyStatus (optional) : The status returned when no objects match, either 200 (default) with an empty array or 204 with no body
+	// batchSize (optional) : The number of objects fetched from mongo per round trip, capped at the configured maximum
+	// checksum (optional) : When true a sha256 of the returned objects is sent in the x-tidepool-checksum trailer,
+	//						  so clients can cheaply tell whether a dataset has changed
+	// withLocalTime (optional) : When true each object gets a localTime field, its time in the zone given by its timezoneOffset
+	// timezone (optional) : IANA zone e.g. America/Los_Angeles used for localTime when an object has no timezoneOffset
+	// tz (optional) : IANA zone e.g. America/Los_Angeles each object's time is rewritten into e.g. 2015-10-10T08:00:00-07:00,
+	//						  with the original UTC time kept in utcTime. Applies to json responses
+	// settings (optional) : Match pumpSettings on nested values, as comma separated field:value pairs e.g.
+	//						  /userid?type=pumpSettings&settings=bgTarget.low:80,bgTarget.high:140 . Criteria on the same settings
+	//						  array must all match one segment. Accepts bgTarget.low/high/target/range, carbRatio.amount,
+	//						  insulinSensitivity.amount and basalSchedules.<name>.rate
+	// typeSubtype (optional) : Comma separated type:subtype pairs where the type and subtype must match together e.g.
+	//						  /userid?typeSubtype=bolus:normal,basal:scheduled returns normal boluses and scheduled basals
+	//						  but not scheduled boluses. Applied in addition to any type and subtype params
+	// exists (optional) : Comma separated field:true|false pairs to find objects with or without a field e.g.
+	//						  /userid?exists=carbInput:true,payload.sgv:false . Only the configured existsFields (and fields
+	//						  nested under them) can be checked
+	// format (optional) : json, ndjson, which streams each object on its own line with no enclosing array, csv, or zip,
+	//						  which downloads a zip archive with a <type>.ndjson file for each type, holding that type's objects
+	//						  one per line. Without it the format is taken from the Accept header (application/json,
+	//						  application/x-ndjson, text/csv or application/zip), or else is the configured defaultFormat, json by default
+	// fields (optional) : Only return these fields, or dotted paths into nested objects, e.g. time,value,payload.note
+	//						  for a lightweight chart. Internal fields can't be asked for. For csv they are the columns in
+	//						  order, without it the columns are the fields of the first 1000 objects and the fields of later
+	//						  objects that aren't columns go as json in an _other column. Objects and arrays are json in their cell
+	// layout (optional) : rows (default), an array of objects, or columnar, an array of chunks of up to 1000 objects
+	//						  transposed into parallel arrays e.g. [{"time": ["2015-10-10T15:00:00Z", ...], "value": [101, ...]}, ...]
+	//						  which is far smaller for long series. Needs a single type and the json format, fields an
+	//						  object doesn't have are null in their array
+	// bucket (optional) : Downsample to one point per interval e.g. 15m or 1h, returning [{"time": "2015-10-10T15:00:00Z",
+	//						  "value": 104.5, "count": 3}, ...] for the intervals with data. Intervals are aligned to the UTC
+	//						  clock and labelled with their start. Needs a single type
+	// agg (optional) : How a bucket's values are combined, avg (default), min, max or last
+	// times (optional) : Comma separated ISO date/times, only objects at exactly one of them are returned e.g.
+	//						  /userid?times=2015-10-10T15:00:00.000Z,2015-10-10T15:05:00.000Z . Applied with any other date params
+	// before (optional) : Only objects with 'time' strictly before this ISO date/time, newest first, for paging backwards
+	//						  e.g. infinite scroll. Pass the time of the oldest object of a page to get the next page.
+	//						  Objects sharing that exact time with the oldest of a full page are skipped
+	// pageSize (optional) : Return only the most recent pageSize objects, newest first. 100 when before is given without it.
+	//						  Capped at the configured limits for the requested types
+	// countByType (optional) : When true, returns the number of objects of each type matching the other params
+	//						  instead of the objects e.g. {"cbg": 1234, "bolus": 56}
+	// search (optional) : Only objects where one of the configured searchFields starts with this text e.g.
+	//						  /userid?search=site%20change . Letters, numbers, spaces and _.:- only, case sensitive
+	// sort (optional) : Comma separated fields to order the objects by, each prefixed with - for descending e.g.
+	//						  /userid?sort=-deviceTime . Only time and deviceTime, or the configured sortFields, are allowed.
+	//						  Objects are in time order by default, other than with pageSize or before, which return the
+	//						  most recent first
+	// collapseBasals (optional) : When true, runs of back to back basal objects with the same rate and deliveryType are
+	//						  merged into one object with their total duration. Objects are returned in time order
+	// Requests likely to be slow, e.g. cbg without a startdate, are still run but each reason is sent back in a
+	// Warning header
+	// cursor (optional) : Pages through the objects in time then _id order, which objects stored while paging can't
+	//						  upset. A request with limit and no offset or sort gets the cursor for the next page in the
+	//						  x-tidepool-next-cursor trailer e.g. /userid?limit=1000&cursor=MjAxNS0xMC0xMFQxNTowMDowMFog...
+	//						  There are no more objects once a page has fewer than limit
+	// deviceId (optional) : Only objects from these devices e.g. /userid?deviceId=DexG4Rec_SM12345678,InsOmn-1234
+	// uploadId (optional) : Only objects from these uploads e.g. /userid?uploadId=upid_abcdef123456
+	// limit, offset (optional) : Page through the objects in time order, or the sort order, returning at most limit
+	//						  objects after skipping the first offset e.g. /userid?limit=1000&offset=2000 . limit is capped
+	//						  at the configured limits. Not with pageSize, before, format=zip, bucket or collapseBasals
+	// hint (optional) : Servers only. The name of an index the objects query must use, for performance testing
+	//						  or when mongo's planner picks badly. Unknown index names are rejected
+	router.Add("GET", "/{userID}", secure(rawLimiter.limit(compress(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		userToView := req.URL.Query().Get(":userID")
+
+		res.Header().Add("Vary", "Accept")
+		r, paramsError := parseDataRequest(req.URL.Query(), req.Header.Get("Accept"), &config)
+		if paramsError != nil {
+			jsonError(res, *paramsError, start)
+			return
+		}
+		p := r.params
+		addWarnings(res, queryWarnings(r, config.HighVolumeTypes))
+
+		requestId := uuid.NewV4().String()
+		debug := config.DebugSampleRate == nil || sampled(requestId, *config.DebugSampleRate)
+
+		if debug {
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("[%s] ****Params: startdate:%s enddate:%s type:%s subtype:%s settings:%v", requestId, p.startDate, p.endDate, p.types, p.subTypes, p.settings))
+		}
+
+		//only servers can choose the index
+		hint := req.URL.Query().Get("hint")
+		groupId, ok := getGroupId(res, req, userToView, p, hint != "", start)
+		if !ok {
+			return
+		}
+		p.groupId = groupId
+
+		activeParams := req.URL.Query()
+		activeParams.Del(":userID")
+		queries.add(activeQuery{RequestId: requestId, UserId: userToView, Started: start, Params: activeParams.Encode()})
+		defer queries.remove(requestId)
+
+		mongoSession := sessions.Copy()
+		guard := &iterGuard{}
+		defer guard.closeSession(mongoSession)
+		queryTimeout := time.Duration(config.QueryTimeoutSeconds) * time.Second
+		if queryTimeout > 0 {
+			mongoSession.SetSocketTimeout(queryTimeout)
+		}
+
+		groupDataQuery, queryBuildError := generateMongoQuery(p)
+
+		//the dates have already been checked by getParams, so this is our fault rather than the client's
+		if queryBuildError != nil {
+			jsonError(res, error_incorrect_params.setInternalMessage(queryBuildError), start)
+			return
+		}
+		if debug {
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("[%s] query: %v", requestId, groupDataQuery))
+		}
+
+		//don't return these fields
+		removeFieldsForReturn := fieldsProjection(r.fields)
+		if r.cursor {
+			//the cursor needs each object's time and _id, processResults removes the _id
+			delete(removeFieldsForReturn, "_id")
+			if len(r.fields) > 0 {
+				removeFieldsForReturn["time"] = 1
+			}
+		}
+
+		var hintKey []string
+		if hint != "" {
+			indexes, err := mongoSession.DB("").C(deviceDataCollection).Indexes()
+			if err != nil {
+				jsonError(res, error_running_query.setInternalMessage(err), start)
+				return
+			}
+			if hintKey, err = indexKey(indexes, hint); err != nil {
+				hintError := invalidParam("hint", hint, "the name of one of the collection's indexes")
+				hintError.InternalMessage = err.Error()
+				jsonError(res, hintError, start)
+				return
+			}
+		}
+
+		if req.URL.Query().Get("countByType") == "true" {
+			iter := guard.track(mongoSession.DB("").C(deviceDataCollection).Pipe(countByTypePipeline(groupDataQuery)).Iter())
+			counts, err := typeCounts(iter)
+			if err != nil {
+				jsonError(res, error_running_query.setInternalMessage(err), start)
+				return
+			}
+
+			bytes, err := json.Marshal(counts)
+			if err != nil {
+				jsonError(res, error_loading_events.setInternalMessage(err), start)
+				return
+			}
+			res.Header().Set("Content-Type", "application/json")
+			res.Write(bytes)
+			return
+		}
+
+		if r.interval > 0 {
+			//only the times and values are needed, in order, to fill the buckets
+			iter := guard.track(mongoSession.DB("").C(deviceDataCollection).
+				Find(groupDataQuery).
+				Select(bson.M{"_id": 0, "time": 1, "value": 1}).
+				Sort("time").
+				Iter())
+			buckets, err := downsample(iter, r.interval, r.agg)
+			if err != nil {
+				jsonError(res, error_running_query.setInternalMessage(err), start)
+				return
+			}
+			if len(buckets) == 0 && r.emptyStatus == http.StatusNoContent {
+				res.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			bytes, err := json.Marshal(buckets)
+			if err != nil {
+				jsonError(res, error_loading_events.setInternalMessage(err), start)
+				return
+			}
+			res.Header().Set("Content-Type", "application/json")
+			res.Write(bytes)
+			return
+		}
+
+		if r.format == "zip" {
+			var types []string
+			if err := mongoSession.DB("").C(deviceDataCollection).Find(groupDataQuery).Distinct("type", &types); err != nil {
+				jsonError(res, error_running_query.setInternalMessage(err), start)
+				return
+			}
+			sort.Strings(types)
+
+			res.Header().Set("Content-Type", "application/zip")
+			res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", userToView))
+			opts := resultOptions{
+				withLocalTime: req.URL.Query().Get("withLocalTime") == "true",
+				timezone:      r.timezone,
+				tz:            r.tz,
+				processors:    processors,
+				fieldOrder:    config.FieldOrder,
+				valueDecimals: config.ValueDecimals,
+			}
+			err := writeZipArchive(res, types, opts, func(objType string) resultIter {
+				typeQuery := bson.M{}
+				for key, value := range groupDataQuery {
+					typeQuery[key] = value
+				}
+				typeQuery["type"] = objType
+				return guard.track(mongoSession.DB("").C(deviceDataCollection).Find(typeQuery).Select(removeFieldsForReturn).Iter())
+			})
+			if err != nil {
+				//the archive is already under way so all we can do is log it
+				log.Println(DATA_API_PREFIX, fmt.Sprintf("[%s] error writing zip archive: %s", requestId, err))
+			}
+			return
+		}
+
+		startQueryTime := time.Now()
+		query := mongoSession.DB("").C(deviceDataCollection).
+			Find(groupDataQuery).
+			Select(removeFieldsForReturn)
+		options := dataQueryOptions(r, hintKey)
+		query = options.apply(query)
+		//use an iterator to protect against very large queries
+		mongoIter := query.Iter()
+		iter := guard.track(mongoIter)
+		if r.collapseBasals {
+			iter = collapseBasals(iter)
+		}
+
+		var queryDeadline time.Time
+		if queryTimeout > 0 {
+			queryDeadline = startQueryTime.Add(queryTimeout)
+		}
+
+		processResults(res, iter, resultOptions{
+			emptyStatus:       r.emptyStatus,
+			checksum:          req.URL.Query().Get("checksum") == "true",
+			withLocalTime:     req.URL.Query().Get("withLocalTime") == "true",
+			timezone:          r.timezone,
+			tz:                r.tz,
+			processors:        processors,
+			columnarChunkSize: r.columnarChunkSize,
+			cursor:            r.cursor,
+			ndjson:            r.format == "ndjson",
+			csv:               r.format == "csv",
+			csvFields:         r.fields,
+			csvFlattenDepth:   config.CSVFlattenDepth,
+			fieldOrder:        config.FieldOrder,
+			valueDecimals:     config.ValueDecimals,
+			done:              req.Context().Done(),
+			deadline:          queryDeadline,
+		}, startQueryTime)
+
+		if config.IndexSampleRate > 0 && sampled(requestId, config.IndexSampleRate) {
+			go explainQuery(groupDataQuery, options)
+		}
+
+		if debug {
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("[%s] request finished after [%.5f]secs, query took [%.5f]secs", requestId, time.Now().Sub(start).Seconds(), time.Now().Sub(startQueryTime).Seconds()))
+		}
+
+		//the response is already under way so the query can't be retried, but the next one gets fresh connections
+		if isStaleSessionError(mongoIter.Err()) {
+			sessions.refresh()
+		}
+
+	})))))
+
+	var handler http.Handler = router
+	if config.StripTrailingSlash {
+		handler = stripTrailingSlash(router)
+	}
+	handler = duplicateParams(handler, config.DuplicateParams)
+	handler = maxParams(handler, config.MaxQueryParams)
+	handler = newClientLimiter(config.Concurrency.PerClient, proxies).limit(handler)
+	handler = localizeErrors(handler)
+	handler = writeIdleTimeout(handler, time.Duration(config.WriteIdleTimeoutSeconds)*time.Second)
 
 	done := make(chan bool)
 	server := common.NewServer(&http.Server{
-		Addr:    config.Service.GetPort(),
-		Handler: router,
+		Addr:        config.Service.GetPort(),
+		Handler:     handler,
+		ConnContext: saveConn,
 	})
 
 	var start func() error
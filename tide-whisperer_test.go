@@ -1,10 +1,19 @@
 package main
+
 import (
-	"testing"
-	"reflect"
-	"labix.org/v2/mgo/bson"
+	"context"
 	"encoding/json"
+	"fmt"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"testing"
+	"time"
 )
 
 func TestGenerateMongoQuery_basic(t *testing.T) {
@@ -16,18 +25,18 @@ func TestGenerateMongoQuery_basic(t *testing.T) {
 	types := ""
 	subTypes := ""
 
-	mongoQuery, err := generateMongoQuery(userId, minSV, maxSV, startDate, endDate, types, subTypes)
+	mongoQuery, err := generateMongoQuery(&params{groupId: userId, minSchemaVersion: minSV, maxSchemaVersion: maxSV, startDate: startDate, endDate: endDate, types: types, subTypes: subTypes})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	expectedQuery := bson.M{"_groupId": userId, 
-		"_active": true, 
-		"_schemaVersion": bson.M{"$gte": minSV, "$lte": maxSV }}
+	expectedQuery := bson.M{"_groupId": userId,
+		"_active":        true,
+		"_schemaVersion": bson.M{"$gte": minSV, "$lte": maxSV}}
 
 	eq := reflect.DeepEqual(mongoQuery, expectedQuery)
 	if !eq {
-	    t.Fatal(getErrString(mongoQuery, expectedQuery))
+		t.Fatal(getErrString(mongoQuery, expectedQuery))
 	}
 }
 
@@ -40,22 +49,22 @@ func TestGenerateMongoQuery_allparams(t *testing.T) {
 	types := "smbg"
 	subTypes := "stype"
 
-	mongoQuery, err := generateMongoQuery(userId, minSV, maxSV, startDate, endDate, types, subTypes)
+	mongoQuery, err := generateMongoQuery(&params{groupId: userId, minSchemaVersion: minSV, maxSchemaVersion: maxSV, startDate: startDate, endDate: endDate, types: types, subTypes: subTypes})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	expectedQuery := bson.M{
-		"_groupId": userId, 
-		"_active": true, 
-		"type":bson.M{"$in":strings.Split("smbg",",")},
-		"subType":bson.M{"$in":strings.Split("stype",",")},
-		"time": bson.M{"$gte": "2015-10-08T15:00:00Z", "$lte": "2015-10-11T15:00:00Z"},
-		"_schemaVersion": bson.M{"$gte": minSV, "$lte": maxSV }}
+		"_groupId":       userId,
+		"_active":        true,
+		"type":           bson.M{"$in": strings.Split("smbg", ",")},
+		"subType":        bson.M{"$in": strings.Split("stype", ",")},
+		"time":           bson.M{"$gte": "2015-10-08T15:00:00Z", "$lte": "2015-10-11T15:00:00Z"},
+		"_schemaVersion": bson.M{"$gte": minSV, "$lte": maxSV}}
 
 	eq := reflect.DeepEqual(mongoQuery, expectedQuery)
 	if !eq {
-	    t.Fatal(getErrString(mongoQuery, expectedQuery))
+		t.Fatal(getErrString(mongoQuery, expectedQuery))
 	}
 }
 
@@ -68,19 +77,20 @@ func TestGenerateMongoQuery_badDates(t *testing.T) {
 	types := "smbg"
 	subTypes := "stype"
 
-	mongoQuery, err := generateMongoQuery(userId, minSV, maxSV, startDate, endDate, types, subTypes)
+	mongoQuery, err := generateMongoQuery(&params{groupId: userId, minSchemaVersion: minSV, maxSchemaVersion: maxSV, startDate: startDate, endDate: endDate, types: types, subTypes: subTypes})
 	if err == nil {
 		t.Fatal("should have failed to parse start date")
 	}
 
 	startDate = "2015-10-11T15:00:00.000Z"
 	endDate = "2015-10-11"
-	mongoQuery, err = generateMongoQuery(userId, minSV, maxSV, startDate, endDate, types, subTypes)
+	mongoQuery, err = generateMongoQuery(&params{groupId: userId, minSchemaVersion: minSV, maxSchemaVersion: maxSV, startDate: startDate, endDate: endDate, types: types, subTypes: subTypes})
 	if err == nil {
 		t.Fatal("Should have failed to parse end date")
 	}
 
-	if mongoQuery == nil{}
+	if mongoQuery == nil {
+	}
 }
 
 func TestGenerateMongoQuery_multipleTypesAndSubTypes(t *testing.T) {
@@ -92,34 +102,1084 @@ func TestGenerateMongoQuery_multipleTypesAndSubTypes(t *testing.T) {
 	types := "smbg,physicalActivity"
 	subTypes := "stype1,stype2"
 
-	mongoQuery, err := generateMongoQuery(userId, minSV, maxSV, startDate, endDate, types, subTypes)
+	mongoQuery, err := generateMongoQuery(&params{groupId: userId, minSchemaVersion: minSV, maxSchemaVersion: maxSV, startDate: startDate, endDate: endDate, types: types, subTypes: subTypes})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	expectedQuery := bson.M{
-		"_groupId": userId, 
-		"_active": true, 
-		"type":bson.M{"$in":strings.Split(types,",")},
-		"subType":bson.M{"$in":strings.Split(subTypes,",")},
-		"time": bson.M{"$gte": "2015-10-08T15:00:00Z", "$lte": "2015-10-11T15:00:00Z"},
-		"_schemaVersion": bson.M{"$gte": minSV, "$lte": maxSV }}
+		"_groupId":       userId,
+		"_active":        true,
+		"type":           bson.M{"$in": strings.Split(types, ",")},
+		"subType":        bson.M{"$in": strings.Split(subTypes, ",")},
+		"time":           bson.M{"$gte": "2015-10-08T15:00:00Z", "$lte": "2015-10-11T15:00:00Z"},
+		"_schemaVersion": bson.M{"$gte": minSV, "$lte": maxSV}}
 
 	eq := reflect.DeepEqual(mongoQuery, expectedQuery)
 	if !eq {
-	    t.Fatal(getErrString(mongoQuery, expectedQuery))
+		t.Fatal(getErrString(mongoQuery, expectedQuery))
 	}
 }
 
-func getErrString(mongoQuery, expectedQuery bson.M) string {
-	exp, err1 := json.MarshalIndent(expectedQuery, "", "  ")
-	mq, err2 := json.MarshalIndent(mongoQuery, "", "  ")
-	errStr := "expected:\n"+string(exp)+"\ndid not match returned query\n"+string(mq)
-	if err1 == nil && err2 == nil {}
-	return errStr
+func TestGenerateMongoQuery_deviceIds(t *testing.T) {
+	mongoQuery, err := generateMongoQuery(&params{groupId: "abc123", deviceIds: "DexG4Rec_SM12345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDevices := bson.M{"$in": []string{"DexG4Rec_SM12345678"}}
+	if !reflect.DeepEqual(mongoQuery["deviceId"], expectedDevices) {
+		t.Fatalf("expected deviceId %v but got %v", expectedDevices, mongoQuery["deviceId"])
+	}
+
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123", types: "cbg", deviceIds: "DexG4Rec_SM12345678,InsOmn-1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDevices = bson.M{"$in": []string{"DexG4Rec_SM12345678", "InsOmn-1234"}}
+	if !reflect.DeepEqual(mongoQuery["deviceId"], expectedDevices) {
+		t.Fatalf("expected deviceId %v but got %v", expectedDevices, mongoQuery["deviceId"])
+	}
+
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mongoQuery["deviceId"]; ok {
+		t.Fatalf("expected no deviceId clause without deviceIds but got %v", mongoQuery)
+	}
+}
+
+func TestGenerateMongoQuery_uploadIds(t *testing.T) {
+	mongoQuery, err := generateMongoQuery(&params{groupId: "abc123", types: "cbg,smbg", startDate: "2015-10-08T15:00:00.000Z", uploadIds: "upid_abcdef123456,upid_fedcba654321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedQuery := bson.M{
+		"_groupId":       "abc123",
+		"_active":        true,
+		"type":           bson.M{"$in": []string{"cbg", "smbg"}},
+		"uploadId":       bson.M{"$in": []string{"upid_abcdef123456", "upid_fedcba654321"}},
+		"time":           bson.M{"$gte": "2015-10-08T15:00:00Z"},
+		"_schemaVersion": bson.M{"$gte": 0, "$lte": 0}}
+	if !reflect.DeepEqual(mongoQuery, expectedQuery) {
+		t.Fatal(getErrString(mongoQuery, expectedQuery))
+	}
+
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123", types: "cbg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mongoQuery["uploadId"]; ok {
+		t.Fatalf("expected no uploadId clause without uploadIds but got %v", mongoQuery)
+	}
+}
+
+func TestGenerateMongoQuery_settings(t *testing.T) {
+	settings, err := parseSettingsMatch("bgTarget.low:80,bgTarget.high:140,basalSchedules.standard.rate:0.85")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mongoQuery, err := generateMongoQuery(&params{groupId: "abc123", minSchemaVersion: 0, maxSchemaVersion: 1, types: "pumpSettings", settings: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedQuery := bson.M{
+		"_groupId":                "abc123",
+		"_active":                 true,
+		"type":                    bson.M{"$in": []string{"pumpSettings"}},
+		"bgTarget":                bson.M{"$elemMatch": bson.M{"low": 80.0, "high": 140.0}},
+		"basalSchedules.standard": bson.M{"$elemMatch": bson.M{"rate": 0.85}},
+		"_schemaVersion":          bson.M{"$gte": 0, "$lte": 1}}
+
+	if !reflect.DeepEqual(mongoQuery, expectedQuery) {
+		t.Fatal(getErrString(mongoQuery, expectedQuery))
+	}
+}
+
+func TestGenerateMongoQuery_typeSubTypePairs(t *testing.T) {
+	typeSubTypes, err := parseTypeSubTypes("bolus:normal,basal:scheduled,smbg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mongoQuery, err := generateMongoQuery(&params{groupId: "abc123", minSchemaVersion: 0, maxSchemaVersion: 1, typeSubTypes: typeSubTypes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedQuery := bson.M{
+		"_groupId": "abc123",
+		"_active":  true,
+		"$or": []bson.M{
+			{"type": "bolus", "subType": "normal"},
+			{"type": "basal", "subType": "scheduled"},
+			{"type": "smbg"},
+		},
+		"_schemaVersion": bson.M{"$gte": 0, "$lte": 1}}
+
+	if !reflect.DeepEqual(mongoQuery, expectedQuery) {
+		t.Fatal(getErrString(mongoQuery, expectedQuery))
+	}
+
+	if _, err := parseTypeSubTypes("bolus:normal,:scheduled"); err == nil {
+		t.Fatal("should have rejected a pair without a type")
+	}
+}
+
+func TestGenerateMongoQuery_excludeFuture(t *testing.T) {
+	notAfter := time.Date(2015, 10, 11, 15, 5, 0, 0, time.UTC)
+
+	//a record dated after notAfter falls outside the upper bound
+	mongoQuery, err := generateMongoQuery(&params{groupId: "abc123", startDate: "2015-10-08T15:00:00.000Z", notAfter: notAfter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTime := bson.M{"$gte": "2015-10-08T15:00:00Z", "$lte": "2015-10-11T15:05:00Z"}
+	if !reflect.DeepEqual(mongoQuery["time"], expectedTime) {
+		t.Fatalf("expected time %v but got %v", expectedTime, mongoQuery["time"])
+	}
+
+	//an enddate in the future is pulled back
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123", endDate: "2016-01-01T00:00:00.000Z", notAfter: notAfter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTime = bson.M{"$lte": "2015-10-11T15:05:00Z"}
+	if !reflect.DeepEqual(mongoQuery["time"], expectedTime) {
+		t.Fatalf("expected time %v but got %v", expectedTime, mongoQuery["time"])
+	}
+
+	//an earlier enddate is kept
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123", endDate: "2015-10-10T00:00:00.000Z", notAfter: notAfter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTime = bson.M{"$lte": "2015-10-10T00:00:00Z"}
+	if !reflect.DeepEqual(mongoQuery["time"], expectedTime) {
+		t.Fatalf("expected time %v but got %v", expectedTime, mongoQuery["time"])
+	}
+}
+
+func TestGenerateMongoQuery_endDateSkew(t *testing.T) {
+	//a record 90 seconds after the enddate is within a 2 minute skew
+	mongoQuery, err := generateMongoQuery(&params{groupId: "abc123", endDate: "2015-10-11T15:00:00.000Z", endDateSkew: 2 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTime := bson.M{"$lte": "2015-10-11T15:02:00Z"}
+	if !reflect.DeepEqual(mongoQuery["time"], expectedTime) {
+		t.Fatalf("expected time %v but got %v", expectedTime, mongoQuery["time"])
+	}
+	if recordTime := "2015-10-11T15:01:30Z"; recordTime > expectedTime["$lte"].(string) {
+		t.Fatalf("expected %s to be included", recordTime)
+	}
+
+	//the skew doesn't reach past excludeFuture's limit
+	notAfter := time.Date(2015, 10, 11, 15, 1, 0, 0, time.UTC)
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123", endDate: "2015-10-11T15:00:00.000Z", endDateSkew: 2 * time.Minute, notAfter: notAfter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTime = bson.M{"$lte": "2015-10-11T15:01:00Z"}
+	if !reflect.DeepEqual(mongoQuery["time"], expectedTime) {
+		t.Fatalf("expected time %v but got %v", expectedTime, mongoQuery["time"])
+	}
+
+	//without an enddate there's nothing to skew
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123", endDateSkew: 2 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mongoQuery["time"]; ok {
+		t.Fatalf("expected no time bounds but got %v", mongoQuery["time"])
+	}
+}
+
+func TestGenerateMongoQuery_before(t *testing.T) {
+	data := fakeCollection{}
+	for i := 0; i < 10; i++ {
+		data = append(data, map[string]interface{}{"_groupId": "abc123", "_active": true, "_schemaVersion": 1, "time": time.Date(2015, 10, 10, 15, i, 0, 0, time.UTC).Format(time.RFC3339Nano), "value": i})
+	}
+
+	//walk back through the data 4 at a time, starting from the most recent
+	pages := [][]int{}
+	before := ""
+	for {
+		query, err := generateMongoQuery(&params{groupId: "abc123", minSchemaVersion: 1, maxSchemaVersion: 1, before: before})
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := data.newest(query, 4)
+		if len(page) == 0 {
+			break
+		}
+		values := []int{}
+		for _, record := range page {
+			values = append(values, record["value"].(int))
+		}
+		pages = append(pages, values)
+		before = page[len(page)-1]["time"].(string)
+	}
+
+	expected := [][]int{{9, 8, 7, 6}, {5, 4, 3, 2}, {1, 0}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Fatalf("expected pages %v but got %v", expected, pages)
+	}
+
+	//before combines with the other date bounds
+	query, err := generateMongoQuery(&params{groupId: "abc123", startDate: "2015-10-10T15:00:00.000Z", before: "2015-10-10T15:05:00.000Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTime := bson.M{"$gte": "2015-10-10T15:00:00Z", "$lt": "2015-10-10T15:05:00Z"}
+	if !reflect.DeepEqual(query["time"], expectedTime) {
+		t.Fatalf("expected time %v but got %v", expectedTime, query["time"])
+	}
+
+	if _, err := generateMongoQuery(&params{groupId: "abc123", before: "yesterday"}); err == nil {
+		t.Fatal("should have rejected an unparsable before")
+	}
+}
+
+func TestGenerateMongoQuery_times(t *testing.T) {
+	mongoQuery, err := generateMongoQuery(&params{groupId: "abc123", times: "2015-10-10T15:00:00.000Z,2015-10-10T10:05:00-05:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTime := bson.M{"$in": []string{"2015-10-10T15:00:00Z", "2015-10-10T15:05:00Z"}}
+	if !reflect.DeepEqual(mongoQuery["time"], expectedTime) {
+		t.Fatalf("expected time %v but got %v", expectedTime, mongoQuery["time"])
+	}
+
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123", startDate: "2015-10-10T00:00:00.000Z", times: "2015-10-10T15:00:00.5Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTime = bson.M{"$gte": "2015-10-10T00:00:00Z", "$in": []string{"2015-10-10T15:00:00.5Z"}}
+	if !reflect.DeepEqual(mongoQuery["time"], expectedTime) {
+		t.Fatalf("expected time %v but got %v", expectedTime, mongoQuery["time"])
+	}
+
+	if _, err := generateMongoQuery(&params{groupId: "abc123", times: "2015-10-10T15:00:00Z,noon"}); err == nil {
+		t.Fatal("should have rejected an unparsable time")
+	}
+}
+
+func TestRestrictTypes(t *testing.T) {
+	restricted := []string{"pumpSettings", "insulin"}
+
+	//a user viewing someone else's data is denied a restricted type
+	for _, p := range []*params{
+		{types: "pumpSettings"},
+		{types: "smbg,insulin"},
+		{typeSubTypes: []bson.M{{"type": "insulin", "subType": "pen"}}},
+	} {
+		if err := restrictTypes(p, restricted); err == nil {
+			t.Errorf("expected types [%s] %v to be denied", p.types, p.typeSubTypes)
+		}
+	}
+
+	//but allowed others, with the restricted types kept out of the results
+	p := &params{groupId: "abc123", types: "smbg,cbg"}
+	if err := restrictTypes(p, restricted); err != nil {
+		t.Fatal(err)
+	}
+	mongoQuery, err := generateMongoQuery(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedType := bson.M{"$in": []string{"smbg", "cbg"}, "$nin": restricted}
+	if !reflect.DeepEqual(mongoQuery["type"], expectedType) {
+		t.Fatalf("expected type %v but got %v", expectedType, mongoQuery["type"])
+	}
+
+	p = &params{groupId: "abc123"}
+	if err := restrictTypes(p, restricted); err != nil {
+		t.Fatal(err)
+	}
+	mongoQuery, err = generateMongoQuery(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedType = bson.M{"$nin": restricted}
+	if !reflect.DeepEqual(mongoQuery["type"], expectedType) {
+		t.Fatalf("expected type %v but got %v", expectedType, mongoQuery["type"])
+	}
+}
+
+func TestGenerateMongoQuery_typeMinSchemaVersions(t *testing.T) {
+	floors := map[string]int{"cbg": 2, "bolus": 3}
+
+	mongoQuery, err := generateMongoQuery(&params{groupId: "abc123", minSchemaVersion: 1, maxSchemaVersion: 5, typeMinSchemaVersions: floors})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedQuery := bson.M{
+		"_groupId": "abc123",
+		"_active":  true,
+		"$or": []bson.M{
+			{"type": bson.M{"$nin": []string{"bolus", "cbg"}}},
+			{"type": "bolus", "_schemaVersion": bson.M{"$gte": 3}},
+			{"type": "cbg", "_schemaVersion": bson.M{"$gte": 2}},
+		},
+		"_schemaVersion": bson.M{"$gte": 1, "$lte": 5}}
+	if !reflect.DeepEqual(mongoQuery, expectedQuery) {
+		t.Fatal(getErrString(mongoQuery, expectedQuery))
+	}
+
+	//only the floors for requested types apply, and they combine with typeSubtype pairs
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123", minSchemaVersion: 1, maxSchemaVersion: 5, types: "cbg,smbg",
+		typeMinSchemaVersions: floors, typeSubTypes: []bson.M{{"type": "cbg"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedQuery = bson.M{
+		"_groupId": "abc123",
+		"_active":  true,
+		"type":     bson.M{"$in": []string{"cbg", "smbg"}},
+		"$and": []bson.M{
+			{"$or": []bson.M{{"type": "cbg"}}},
+			{"$or": []bson.M{
+				{"type": bson.M{"$nin": []string{"cbg"}}},
+				{"type": "cbg", "_schemaVersion": bson.M{"$gte": 2}},
+			}},
+		},
+		"_schemaVersion": bson.M{"$gte": 1, "$lte": 5}}
+	if !reflect.DeepEqual(mongoQuery, expectedQuery) {
+		t.Fatal(getErrString(mongoQuery, expectedQuery))
+	}
+
+	//requesting only types without a floor leaves the query alone
+	mongoQuery, err = generateMongoQuery(&params{groupId: "abc123", types: "smbg", typeMinSchemaVersions: floors})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mongoQuery["$or"]; ok {
+		t.Fatal("no floors should apply to smbg")
+	}
+}
+
+func TestGenerateMongoQuery_exists(t *testing.T) {
+	exists, err := parseExists("carbInput:true,payload.sgv:false", defaultExistsFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mongoQuery, err := generateMongoQuery(&params{groupId: "abc123", minSchemaVersion: 0, maxSchemaVersion: 1, exists: exists})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedQuery := bson.M{
+		"_groupId":       "abc123",
+		"_active":        true,
+		"carbInput":      bson.M{"$exists": true},
+		"payload.sgv":    bson.M{"$exists": false},
+		"_schemaVersion": bson.M{"$gte": 0, "$lte": 1}}
+	if !reflect.DeepEqual(mongoQuery, expectedQuery) {
+		t.Fatal(getErrString(mongoQuery, expectedQuery))
+	}
+}
+
+func TestParseExists_rejected(t *testing.T) {
+	for _, exists := range []string{"_groupId:true", "password:true", "carbInput", "carbInput:yes", "payload.$where:true", "payload.:true", "valueX:true"} {
+		if _, err := parseExists(exists, defaultExistsFields); err == nil {
+			t.Fatalf("should have rejected exists [%s]", exists)
+		}
+	}
+	if _, err := parseExists("custom.field:true", []string{"custom"}); err != nil {
+		t.Fatalf("a configured field should be allowed, got %v", err)
+	}
+}
+
+func TestParseSettingsMatch_rejected(t *testing.T) {
+	for _, settings := range []string{"bgTarget.low", "bgTarget.$where:1", "basalSchedules.a.b.rate:1", "payload.x:1", "bgTarget.low:high"} {
+		if _, err := parseSettingsMatch(settings); err == nil {
+			t.Fatalf("should have rejected settings [%s]", settings)
+		}
+	}
+}
+
+func TestUserIdFormat(t *testing.T) {
+	for _, userId := range []string{"0123456789", "abcdef0123", "0123456789abcdef0123456789abcdef"} {
+		if !userIdFormat.MatchString(userId) {
+			t.Fatalf("userID [%s] should be valid", userId)
+		}
+	}
+	for _, userId := range []string{"", "abc123", "ABCDEF0123", "0123456789a", `{"$ne":1}`, "012345678g", "0123456789\n"} {
+		if userIdFormat.MatchString(userId) {
+			t.Fatalf("userID [%s] should be rejected", userId)
+		}
+	}
+}
+
+func TestDefaultStartDate(t *testing.T) {
+	windows := map[string]int{"cbg": 14}
+	now := time.Date(2015, 10, 20, 15, 0, 0, 0, time.UTC)
 
+	if start := defaultStartDate("cbg", windows, now); start != "2015-10-06T15:00:00Z" {
+		t.Fatalf("expected the 14 day cbg window to start at 2015-10-06T15:00:00Z but got [%s]", start)
+	}
+	for _, objType := range []string{"", "pumpSettings", "cbg,smbg"} {
+		if start := defaultStartDate(objType, windows, now); start != "" {
+			t.Fatalf("expected no default window for type [%s] but got [%s]", objType, start)
+		}
+	}
+	if start := defaultStartDate("cbg", nil, now); start != "" {
+		t.Fatalf("expected no default window when none are configured but got [%s]", start)
+	}
+}
+
+func TestGetParams_dateWindowRequired(t *testing.T) {
+	config := &Config{}
+	config.DateWindowRequiredTypes = []string{"cbg"}
+
+	_, paramsError := getParams(url.Values{"type": {"smbg,cbg"}}, config)
+	if paramsError == nil || paramsError.Code != error_window_required.Code || paramsError.Status != http.StatusBadRequest {
+		t.Fatalf("expected a %s error but got %v", error_window_required.Code, paramsError)
+	}
+
+	if _, paramsError := getParams(url.Values{"type": {"cbg"}, "startdate": {"2015-10-10T15:00:00.000Z"}}, config); paramsError != nil {
+		t.Fatalf("a startdate should be allowed but got %v", paramsError)
+	}
+	if _, paramsError := getParams(url.Values{"type": {"smbg"}}, config); paramsError != nil {
+		t.Fatalf("an unprotected type should be allowed but got %v", paramsError)
+	}
+
+	//a default window counts
+	config.DefaultWindowDays = map[string]int{"cbg": 14}
+	if _, paramsError := getParams(url.Values{"type": {"cbg"}}, config); paramsError != nil {
+		t.Fatalf("the default window should be allowed but got %v", paramsError)
+	}
+}
+
+func TestGetParams_invalidDate(t *testing.T) {
+	for param, value := range map[string]string{
+		"startdate": "yesterday",
+		"enddate":   "2015-13-45",
+		"before":    "2015-10-10 15:00",
+		"times":     "2015-10-10T15:00:00Z,noon",
+	} {
+		_, paramsError := getParams(url.Values{param: {value}}, &Config{})
+		if paramsError == nil || paramsError.Code != error_invalid_date.Code || paramsError.Status != http.StatusBadRequest {
+			t.Errorf("expected a %s error for %s [%s] but got %v", error_invalid_date.Code, param, value, paramsError)
+			continue
+		}
+		if !strings.HasPrefix(paramsError.Message, param+" must be") {
+			t.Errorf("expected the message to name %s but got [%s]", param, paramsError.Message)
+		}
+	}
+
+	if _, paramsError := getParams(url.Values{"startdate": {"2015-10-10T15:00:00.000Z"}, "enddate": {"2015-10-11T15:00:00+02:00"}}, &Config{}); paramsError != nil {
+		t.Fatalf("expected valid dates to be accepted but got %v", paramsError)
+	}
+}
+
+func TestEnforceUTCDate(t *testing.T) {
+	offsetDate := "2015-10-08T17:00:00.000+02:00"
+
+	if _, err := enforceUTCDate(offsetDate, "strict"); err == nil {
+		t.Fatal("strict mode should have rejected an offset date")
+	}
+	if date, err := enforceUTCDate("2015-10-08T15:00:00.000Z", "strict"); err != nil || date != "2015-10-08T15:00:00.000Z" {
+		t.Fatalf("strict mode should have accepted a UTC date, got [%s] %v", date, err)
+	}
+
+	date, err := enforceUTCDate(offsetDate, "normalize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date != "2015-10-08T15:00:00Z" {
+		t.Fatalf("expected the date normalized to 2015-10-08T15:00:00Z but got [%s]", date)
+	}
+
+	if date, err := enforceUTCDate(offsetDate, ""); err != nil || date != offsetDate {
+		t.Fatalf("default mode should have left the date alone, got [%s] %v", date, err)
+	}
+}
+
+func TestGetPageSize(t *testing.T) {
+	if pageSize, err := getPageSize("", ""); err != nil || pageSize != 0 {
+		t.Fatalf("expected no paging but got %d %v", pageSize, err)
+	}
+	if pageSize, err := getPageSize("", "2015-10-10T15:00:00Z"); err != nil || pageSize != DEFAULT_PAGE_SIZE {
+		t.Fatalf("expected the default page size but got %d %v", pageSize, err)
+	}
+	if pageSize, err := getPageSize("25", ""); err != nil || pageSize != 25 {
+		t.Fatalf("expected 25 but got %d %v", pageSize, err)
+	}
+	for _, bad := range []string{"0", "-1", "ten"} {
+		if _, err := getPageSize(bad, ""); err == nil {
+			t.Errorf("should have rejected pageSize [%s]", bad)
+		}
+	}
+}
+
+func TestGetCount(t *testing.T) {
+	if count, ok := getCount("", 1); !ok || count != 0 {
+		t.Fatalf("expected no count but got %d %v", count, ok)
+	}
+	if count, ok := getCount("0", 0); !ok || count != 0 {
+		t.Fatalf("expected an offset of 0 to be allowed but got %d %v", count, ok)
+	}
+	if count, ok := getCount("250", 1); !ok || count != 250 {
+		t.Fatalf("expected 250 but got %d %v", count, ok)
+	}
+	for _, bad := range []string{"0", "-5", "ten", "1.5"} {
+		if _, ok := getCount(bad, 1); ok {
+			t.Errorf("should have rejected limit [%s]", bad)
+		}
+	}
+}
+
+func TestMaximumLimit(t *testing.T) {
+	typeMaximums := map[string]int{"cbg": 5000, "pumpSettings": 10}
+
+	tests := []struct {
+		types    string
+		maximum  int
+		expected int
+	}{
+		{types: "cbg", maximum: 0, expected: 5000},
+		{types: "cbg", maximum: 1000, expected: 1000},
+		{types: "pumpSettings", maximum: 1000, expected: 10},
+		{types: "smbg", maximum: 1000, expected: 1000},
+		{types: "smbg", maximum: 0, expected: 0},
+		{types: "cbg,pumpSettings", maximum: 0, expected: 10},
+		{types: "cbg,smbg", maximum: 20000, expected: 5000},
+		{types: "", maximum: 1000, expected: 1000},
+		{types: "", maximum: 0, expected: 0},
+	}
+	for _, test := range tests {
+		if limit := maximumLimit(test.types, test.maximum, typeMaximums); limit != test.expected {
+			t.Errorf("type [%s] with maximum %d: expected %d but got %d", test.types, test.maximum, test.expected, limit)
+		}
+	}
+
+	if limit := maximumLimit("cbg", 1000, nil); limit != 1000 {
+		t.Errorf("expected the overall maximum without type maximums but got %d", limit)
+	}
+}
+
+func TestGetBatchSize(t *testing.T) {
+	if size, err := getBatchSize("", 0, 0); err != nil || size != 0 {
+		t.Fatalf("expected the driver default (0) but got %d %v", size, err)
+	}
+	if size, err := getBatchSize("", 500, 0); err != nil || size != 500 {
+		t.Fatalf("expected the configured default 500 but got %d %v", size, err)
+	}
+	if size, err := getBatchSize("250", 500, 1000); err != nil || size != 250 {
+		t.Fatalf("expected the requested 250 but got %d %v", size, err)
+	}
+	if size, err := getBatchSize("5000", 500, 1000); err != nil || size != 1000 {
+		t.Fatalf("expected the maximum 1000 but got %d %v", size, err)
+	}
+	for _, bad := range []string{"0", "-1", "lots"} {
+		if _, err := getBatchSize(bad, 500, 1000); err == nil {
+			t.Fatalf("should have rejected batchSize [%s]", bad)
+		}
+	}
+}
+
+func TestUnknownParams(t *testing.T) {
+	query := url.Values{":userID": {"abc123"}, "type": {"smbg"}, "startDate": {"2015-10-08T15:00:00.000Z"}, "subTYPE": {"x"}}
+
+	unknown := unknownParams(query, dataParams)
+	if !reflect.DeepEqual(unknown, []string{"startDate", "subTYPE"}) {
+		t.Fatalf("expected startDate and subTYPE to be reported but got %v", unknown)
+	}
+
+	if paramsError := checkParams(query, dataParams, true); paramsError == nil || paramsError.Status != http.StatusBadRequest {
+		t.Fatalf("strict mode should have rejected the unknown params, got %v", paramsError)
+	} else if paramsError.Message != "unknown parameters: startDate, subTYPE" {
+		t.Fatalf("the error should list the unknown params, got [%s]", paramsError.Message)
+	}
+	if paramsError := checkParams(query, dataParams, false); paramsError != nil {
+		t.Fatalf("lenient mode should have ignored the unknown params, got %v", paramsError)
+	}
+
+	delete(query, "startDate")
+	delete(query, "subTYPE")
+	if unknown := unknownParams(query, dataParams); len(unknown) != 0 {
+		t.Fatalf("expected no unknown params but got %v", unknown)
+	}
+}
+
+func TestProcessResults_emptyStatus(t *testing.T) {
+	res := httptest.NewRecorder()
+	processResults(res, &testIter{}, resultOptions{emptyStatus: http.StatusOK}, time.Now())
+	if res.Code != http.StatusOK || res.Body.String() != "[]" {
+		t.Fatalf("expected 200 with [] but got %d with %s", res.Code, res.Body.String())
+	}
+	if contentType := res.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("expected an empty result to still be json but got [%s]", contentType)
+	}
+
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{}, resultOptions{emptyStatus: http.StatusNoContent}, time.Now())
+	if res.Code != http.StatusNoContent || res.Body.Len() != 0 {
+		t.Fatalf("expected 204 with no body but got %d with %s", res.Code, res.Body.String())
+	}
+	if contentType := res.Header().Get("Content-Type"); contentType != "" {
+		t.Fatalf("expected no content type without a body but got [%s]", contentType)
+	}
+
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{records: []map[string]interface{}{{"type": "smbg"}}}, resultOptions{emptyStatus: http.StatusNoContent}, time.Now())
+	if res.Code != http.StatusOK || res.Body.String() != `[{"type":"smbg"}]` {
+		t.Fatalf("expected 200 with the record but got %d with %s", res.Code, res.Body.String())
+	}
+}
+
+func TestProcessResults_checksum(t *testing.T) {
+	checksumOf := func(records ...map[string]interface{}) string {
+		res := httptest.NewRecorder()
+		processResults(res, &testIter{records: records}, resultOptions{emptyStatus: http.StatusOK, checksum: true}, time.Now())
+		checksum := res.Result().Trailer.Get(CHECKSUM_TRAILER)
+		if checksum == "" {
+			t.Fatal("expected a checksum trailer")
+		}
+		return checksum
+	}
+
+	first := checksumOf(map[string]interface{}{"type": "smbg", "value": 5.5}, map[string]interface{}{"type": "cbg", "value": 101})
+	second := checksumOf(map[string]interface{}{"type": "smbg", "value": 5.5}, map[string]interface{}{"type": "cbg", "value": 101})
+	if first != second {
+		t.Fatalf("identical datasets should have the same checksum, got %s and %s", first, second)
+	}
+
+	changed := checksumOf(map[string]interface{}{"type": "smbg", "value": 5.6}, map[string]interface{}{"type": "cbg", "value": 101})
+	if first == changed {
+		t.Fatal("a changed record should change the checksum")
+	}
+}
+
+func TestProcessResults_contentType(t *testing.T) {
+	res := httptest.NewRecorder()
+	processResults(res, &testIter{records: []map[string]interface{}{{"type": "cbg"}, {"type": "smbg"}}}, resultOptions{emptyStatus: http.StatusOK}, time.Now())
+	if values := res.Header()["Content-Type"]; len(values) != 1 || values[0] != "application/json" {
+		t.Fatalf("expected a single Content-Type but got %v", res.Header())
+	}
+
+	//an error part way through doesn't add another
+	failSecond := RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		if record["type"] == "smbg" {
+			return nil, fmt.Errorf("can't process smbg")
+		}
+		return record, nil
+	})
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{records: []map[string]interface{}{{"type": "cbg"}, {"type": "smbg"}}}, resultOptions{emptyStatus: http.StatusOK, processors: []RecordProcessor{failSecond}}, time.Now())
+	if values := res.Header()["Content-Type"]; len(values) != 1 {
+		t.Fatalf("expected a single Content-Type but got %v", res.Header())
+	}
+	for name := range res.Header() {
+		if name != http.CanonicalHeaderKey(name) {
+			t.Fatalf("expected canonical header names but got %s", name)
+		}
+	}
+}
+
+func TestProcessResults_deadline(t *testing.T) {
+	records := func() []map[string]interface{} {
+		return []map[string]interface{}{{"type": "cbg"}, {"type": "smbg"}}
+	}
+
+	res := httptest.NewRecorder()
+	processResults(res, &testIter{records: records()}, resultOptions{emptyStatus: http.StatusOK, deadline: time.Now().Add(-time.Second)}, time.Now())
+	if res.Code != http.StatusGatewayTimeout || !strings.Contains(res.Body.String(), "query_timeout") {
+		t.Fatalf("expected a 504 before anything was written but got %d with %s", res.Code, res.Body.String())
+	}
+
+	//a read that failed because it blocked past the deadline is a timeout rather than a store error
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{err: fmt.Errorf("i/o timeout")}, resultOptions{emptyStatus: http.StatusOK, deadline: time.Now().Add(-time.Second)}, time.Now())
+	if res.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected a 504 for the failed read but got %d", res.Code)
+	}
+
+	slow := RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return record, nil
+	})
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{records: records()}, resultOptions{emptyStatus: http.StatusOK, processors: []RecordProcessor{slow}, deadline: time.Now().Add(10 * time.Millisecond)}, time.Now())
+	if res.Code != http.StatusOK || res.Body.String() != `[{"type":"cbg"}` {
+		t.Fatalf("expected the response cut short after the first record but got %d with %s", res.Code, res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{records: records()}, resultOptions{emptyStatus: http.StatusOK, deadline: time.Now().Add(time.Minute)}, time.Now())
+	if res.Code != http.StatusOK || res.Body.String() != `[{"type":"cbg"},
+{"type":"smbg"}]` {
+		t.Fatalf("expected all the records before the deadline but got %d with %s", res.Code, res.Body.String())
+	}
+}
+
+func TestProcessResults_ndjson(t *testing.T) {
+	records := []map[string]interface{}{
+		{"type": "cbg", "value": 101, "time": "2015-10-10T15:00:00Z"},
+		{"type": "smbg", "value": 5.5, "payload": map[string]interface{}{"note": "a\nb"}},
+		{"type": "basal", "rate": 0.75},
+	}
+	res := httptest.NewRecorder()
+	processResults(res, &testIter{records: records}, resultOptions{emptyStatus: http.StatusOK, ndjson: true}, time.Now())
+
+	if contentType := res.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Fatalf("expected the ndjson content type but got [%s]", contentType)
+	}
+	body := res.Body.String()
+	if !strings.HasSuffix(body, "\n") || strings.HasPrefix(body, "[") {
+		t.Fatalf("expected lines without an enclosing array but got %s", body)
+	}
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	if len(lines) != len(records) {
+		t.Fatalf("expected %d lines but got %d: %s", len(records), len(lines), body)
+	}
+	for i, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line %d [%s] doesn't unmarshal on its own: %s", i, line, err)
+		}
+		if record["type"] != records[i]["type"] {
+			t.Errorf("line %d: expected a %s but got %v", i, records[i]["type"], record)
+		}
+	}
+
+	//nothing found is an empty body, or still a 204 when asked for
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{}, resultOptions{emptyStatus: http.StatusOK, ndjson: true}, time.Now())
+	if res.Code != http.StatusOK || res.Body.Len() != 0 || res.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected an empty ndjson body but got %d %v %s", res.Code, res.Header(), res.Body.String())
+	}
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{}, resultOptions{emptyStatus: http.StatusNoContent, ndjson: true}, time.Now())
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 but got %d", res.Code)
+	}
+
+	//json is still an array
+	res = httptest.NewRecorder()
+	processResults(res, &testIter{records: []map[string]interface{}{{"type": "cbg"}, {"type": "smbg"}}}, resultOptions{emptyStatus: http.StatusOK}, time.Now())
+	if res.Body.String() != "[{\"type\":\"cbg\"},\n{\"type\":\"smbg\"}]" {
+		t.Fatalf("expected the json array unchanged but got %s", res.Body.String())
+	}
+}
+
+func TestProcessResults_clientGone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	iter := &testIter{records: []map[string]interface{}{{"type": "cbg"}, {"type": "cbg"}, {"type": "cbg"}, {"type": "cbg"}}}
+
+	//the client disconnects once the first record is on its way
+	disconnect := RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		cancel()
+		return record, nil
+	})
+
+	res := httptest.NewRecorder()
+	processResults(res, iter, resultOptions{emptyStatus: http.StatusOK, processors: []RecordProcessor{disconnect}, done: ctx.Done()}, time.Now())
+
+	if len(iter.records) != 2 {
+		t.Fatalf("expected reading to stop after the disconnect but %d records are left", len(iter.records))
+	}
+	if res.Body.String() != `[{"type":"cbg"}` {
+		t.Fatalf("expected only the first record to be written but got %s", res.Body.String())
+	}
+}
+
+func TestAddLocalTime(t *testing.T) {
+	record := map[string]interface{}{"time": "2015-10-08T15:00:00.000Z", "timezoneOffset": -420}
+	addLocalTime(record, nil)
+	if record["localTime"] != "2015-10-08T08:00:00-07:00" {
+		t.Fatalf("expected localTime 2015-10-08T08:00:00-07:00 but got %v", record["localTime"])
+	}
+
+	//offsets decoded from json arrive as floats
+	record = map[string]interface{}{"time": "2015-10-08T15:00:00.000Z", "timezoneOffset": float64(330)}
+	addLocalTime(record, nil)
+	if record["localTime"] != "2015-10-08T20:30:00+05:30" {
+		t.Fatalf("expected localTime 2015-10-08T20:30:00+05:30 but got %v", record["localTime"])
+	}
+
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record = map[string]interface{}{"time": "2015-10-08T15:00:00.000Z"}
+	addLocalTime(record, newYork)
+	if record["localTime"] != "2015-10-08T11:00:00-04:00" {
+		t.Fatalf("expected localTime from the request timezone 2015-10-08T11:00:00-04:00 but got %v", record["localTime"])
+	}
+
+	record = map[string]interface{}{"time": "2015-10-08T15:00:00.000Z"}
+	addLocalTime(record, nil)
+	if _, ok := record["localTime"]; ok {
+		t.Fatal("should not add localTime without an offset or timezone")
+	}
 }
 
+func TestConvertTime(t *testing.T) {
+	losAngeles, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for utc, local := range map[string]string{
+		"2015-10-08T15:00:00.000Z": "2015-10-08T08:00:00-07:00",
+		"2015-12-08T15:00:00.000Z": "2015-12-08T07:00:00-08:00",
+		"2015-10-08T15:00:00.5Z":   "2015-10-08T08:00:00.5-07:00",
+	} {
+		record := map[string]interface{}{"time": utc}
+		convertTime(record, losAngeles)
+		if record["time"] != local || record["utcTime"] != utc {
+			t.Errorf("expected time %s and utcTime %s but got %v and %v", local, utc, record["time"], record["utcTime"])
+		}
+	}
+
+	record := map[string]interface{}{"type": "pumpSettings"}
+	convertTime(record, losAngeles)
+	if len(record) != 1 {
+		t.Fatalf("should leave a record without a time alone but got %v", record)
+	}
+
+	iter := &testIter{records: []map[string]interface{}{{"time": "2015-10-08T15:00:00.000Z", "type": "cbg"}}}
+	res := httptest.NewRecorder()
+	processResults(res, iter, resultOptions{emptyStatus: http.StatusOK, tz: losAngeles}, time.Now())
+	if expected := `[{"time":"2015-10-08T08:00:00-07:00","type":"cbg","utcTime":"2015-10-08T15:00:00.000Z"}]`; res.Body.String() != expected {
+		t.Fatalf("expected %s but got %s", expected, res.Body.String())
+	}
+}
 
+func TestProcessResults_aggregation(t *testing.T) {
+	//aggregation output has its own shape, e.g. a $group by type, and streams the same way as found records
+	iter := &testIter{records: []map[string]interface{}{
+		{"_id": map[string]interface{}{"type": "cbg"}, "count": 288, "latest": "2015-10-08T23:55:00.000Z"},
+		{"_id": map[string]interface{}{"type": "smbg"}, "count": 4, "latest": "2015-10-08T21:00:00.000Z"},
+	}}
 
+	res := httptest.NewRecorder()
+	processResults(res, iter, resultOptions{emptyStatus: http.StatusOK}, time.Now())
 
+	var streamed []map[string]interface{}
+	if err := json.Unmarshal(res.Body.Bytes(), &streamed); err != nil {
+		t.Fatalf("expected a json array but got %s: %v", res.Body.String(), err)
+	}
+	expected := []map[string]interface{}{
+		{"_id": map[string]interface{}{"type": "cbg"}, "count": 288.0, "latest": "2015-10-08T23:55:00.000Z"},
+		{"_id": map[string]interface{}{"type": "smbg"}, "count": 4.0, "latest": "2015-10-08T21:00:00.000Z"},
+	}
+	if !reflect.DeepEqual(streamed, expected) {
+		t.Fatalf("expected %v but got %v", expected, streamed)
+	}
+}
+
+func TestSampled(t *testing.T) {
+	for _, rate := range []float64{0.1, 0.5} {
+		count := 0
+		for i := 0; i < 10000; i++ {
+			if sampled(fmt.Sprintf("request-%d", i), rate) {
+				count++
+			}
+		}
+		if fraction := float64(count) / 10000; fraction < rate-0.03 || fraction > rate+0.03 {
+			t.Fatalf("expected roughly %.2f of requests sampled but got %.3f", rate, fraction)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		requestId := fmt.Sprintf("request-%d", i)
+		if sampled(requestId, 0.3) != sampled(requestId, 0.3) {
+			t.Fatalf("sampling of %s should be deterministic", requestId)
+		}
+	}
+
+	if sampled("request-1", 0) || !sampled("request-1", 1) {
+		t.Fatal("a rate of 0 should sample nothing and 1 everything")
+	}
+}
+
+func TestStripTrailingSlash(t *testing.T) {
+	var routed string
+	handler := stripTrailingSlash(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		routed = req.URL.Path
+	}))
+
+	for path, expected := range map[string]string{
+		"/abc123/":      "/abc123",
+		"/abc123":       "/abc123",
+		"/abc123/gaps/": "/abc123/gaps",
+		"/abc123//":     "/abc123/",
+		"/":             "/",
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path+"?type=cbg", nil))
+		if routed != expected {
+			t.Fatalf("expected %s to be routed as %s but got %s", path, expected, routed)
+		}
+	}
+}
+
+func TestGetEmptyStatus(t *testing.T) {
+	for param, expected := range map[string]int{"": http.StatusOK, "200": http.StatusOK, "204": http.StatusNoContent} {
+		status, err := getEmptyStatus(param)
+		if err != nil || status != expected {
+			t.Fatalf("expected %d for [%s] but got %d (%v)", expected, param, status, err)
+		}
+	}
+	if _, err := getEmptyStatus("404"); err == nil {
+		t.Fatal("should have rejected emptyStatus 404")
+	}
+}
+
+// testIter serves records from memory in place of a mongo iterator
+type testIter struct {
+	records []map[string]interface{}
+	err     error
+}
+
+func (i *testIter) Next(result interface{}) bool {
+	if len(i.records) == 0 {
+		return false
+	}
+	*(result.(*map[string]interface{})) = i.records[0]
+	i.records = i.records[1:]
+	return true
+}
+
+func (i *testIter) Close() error {
+	return i.err
+}
+
+// fakeCollection matches records against the subset of query operators the tests need
+type fakeCollection []map[string]interface{}
+
+func (c fakeCollection) find(query bson.M) resultIter {
+	found := []map[string]interface{}{}
+	for _, record := range c {
+		if c.matches(record, query) {
+			found = append(found, record)
+		}
+	}
+	return &testIter{records: found}
+}
+
+func (c fakeCollection) matches(record map[string]interface{}, query bson.M) bool {
+	for field, criteria := range query {
+		if field == "$or" {
+			matched := false
+			for _, alternative := range criteria.([]bson.M) {
+				matched = matched || c.matches(record, alternative)
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		value := lookupField(record, field)
+		if pattern, ok := criteria.(bson.RegEx); ok {
+			text, isString := value.(string)
+			if !isString || !regexp.MustCompile(pattern.Pattern).MatchString(text) {
+				return false
+			}
+			continue
+		}
+		operators, ok := criteria.(bson.M)
+		if !ok {
+			if value != criteria {
+				return false
+			}
+			continue
+		}
+		for operator, operand := range operators {
+			switch operator {
+			case "$in":
+				in := false
+				for _, option := range operand.([]string) {
+					in = in || value == option
+				}
+				if !in {
+					return false
+				}
+			case "$gte":
+				if compareValues(value, operand) < 0 {
+					return false
+				}
+			case "$lte":
+				if compareValues(value, operand) > 0 {
+					return false
+				}
+			case "$lt":
+				if compareValues(value, operand) >= 0 {
+					return false
+				}
+			case "$gt":
+				if compareValues(value, operand) <= 0 {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lookupField finds a dotted field e.g. payload.note in a record
+func lookupField(record map[string]interface{}, field string) interface{} {
+	var value interface{} = record
+	for _, name := range strings.Split(field, ".") {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = nested[name]
+	}
+	return value
+}
+
+// compareValues orders the strings, ints and ids found in test records
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case int:
+		if b, ok := b.(int); ok {
+			return a - b
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	case bson.ObjectId:
+		if b, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(a.Hex(), b.Hex())
+		}
+	}
+	return -1
+}
+
+// newest returns up to n of the records matching the query, newest first, as a paged query would
+func (c fakeCollection) newest(query bson.M, n int) []map[string]interface{} {
+	found := []map[string]interface{}{}
+	iter := c.find(query)
+	var record map[string]interface{}
+	for iter.Next(&record) {
+		found = append(found, record)
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i]["time"].(string) > found[j]["time"].(string) })
+	if len(found) > n {
+		found = found[:n]
+	}
+	return found
+}
+
+func getErrString(mongoQuery, expectedQuery bson.M) string {
+	exp, err1 := json.MarshalIndent(expectedQuery, "", "  ")
+	mq, err2 := json.MarshalIndent(mongoQuery, "", "  ")
+	errStr := "expected:\n" + string(exp) + "\ndid not match returned query\n" + string(mq)
+	if err1 == nil && err2 == nil {
+	}
+	return errStr
+
+}
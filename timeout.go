@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+type connContextKey struct{}
+
+// saveConn is the server's ConnContext, keeping the connection where writeIdleTimeout can find it
+func saveConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// writeIdleTimeout drops the connection of a client that stops reading, by giving each write to the
+// response the timeout to reach the client. The handler's next write then fails so it can stop reading
+// from mongo. This is about slow clients, a slow query with a reading client isn't affected. Only HTTP/1.x
+// requests are limited, an HTTP/2 connection carries other requests' streams that a deadline would drop too
+func writeIdleTimeout(h http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		conn, ok := req.Context().Value(connContextKey{}).(net.Conn)
+		if !ok || req.ProtoMajor != 1 {
+			h.ServeHTTP(res, req)
+			return
+		}
+
+		writer := &deadlineWriter{ResponseWriter: res, conn: conn, timeout: timeout}
+		defer func() {
+			//the connection is the handler's once it's hijacked
+			if writer.hijacked {
+				return
+			}
+			//send what's buffered while the deadline still applies, then clear it for the next request on the connection
+			if flusher, ok := res.(http.Flusher); ok {
+				writer.extend()
+				flusher.Flush()
+			}
+			conn.SetWriteDeadline(time.Time{})
+		}()
+		h.ServeHTTP(writer, req)
+	})
+}
+
+// deadlineWriter extends the connection's write deadline before each write. It passes through the optional
+// interfaces of the ResponseWriter it wraps so handlers can still flush, watch for the client going away and
+// hijack the connection
+type deadlineWriter struct {
+	http.ResponseWriter
+	conn     net.Conn
+	timeout  time.Duration
+	hijacked bool
+}
+
+func (w *deadlineWriter) extend() {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+}
+
+func (w *deadlineWriter) Write(bytes []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(bytes)
+}
+
+func (w *deadlineWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.extend()
+		flusher.Flush()
+	}
+}
+
+func (w *deadlineWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	//never closed, as for a client that doesn't go away
+	return make(chan bool)
+}
+
+// Hijack hands the connection to the handler without a deadline, as it's writing to it directly from then on
+func (w *deadlineWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+		conn.SetWriteDeadline(time.Time{})
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteIdleTimeout_stalledReader(t *testing.T) {
+	failed := make(chan error, 1)
+	chunk := bytes.Repeat([]byte("x"), 64*1024)
+
+	server := httptest.NewUnstartedServer(writeIdleTimeout(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		//far more than the socket buffers hold, so writes stall once the client stops reading
+		for i := 0; i < 10000; i++ {
+			if _, err := res.Write(chunk); err != nil {
+				failed <- err
+				return
+			}
+		}
+		failed <- nil
+	}), 100*time.Millisecond))
+	server.Config.ConnContext = saveConn
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+
+	//never read the response
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Fatal("expected the stalled client to be dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stalled client wasn't dropped")
+	}
+}
+
+func TestWriteIdleTimeout_readingClient(t *testing.T) {
+	server := httptest.NewUnstartedServer(writeIdleTimeout(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("OK"))
+	}), 100*time.Millisecond))
+	server.Config.ConnContext = saveConn
+	server.Start()
+	defer server.Close()
+
+	//the deadline is cleared between requests so an idle keep-alive connection still works
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// deadlineConn records the write deadlines set on it
+type deadlineConn struct {
+	net.Conn
+	deadlines int
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines++
+	return nil
+}
+
+func TestWriteIdleTimeout_http2(t *testing.T) {
+	handler := writeIdleTimeout(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("OK"))
+	}), 100*time.Millisecond)
+
+	for protoMajor, limited := range map[int]bool{1: true, 2: false} {
+		conn := &deadlineConn{}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.ProtoMajor = protoMajor
+		req = req.WithContext(saveConn(req.Context(), conn))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if (conn.deadlines > 0) != limited {
+			t.Errorf("HTTP/%d: expected deadlines set %t but %d were", protoMajor, limited, conn.deadlines)
+		}
+	}
+}
+
+func TestWriteIdleTimeout_passesThroughInterfaces(t *testing.T) {
+	server := httptest.NewUnstartedServer(writeIdleTimeout(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if _, ok := res.(http.CloseNotifier); !ok {
+			t.Error("expected the writer to be a CloseNotifier")
+		}
+		hijacker, ok := res.(http.Hijacker)
+		if !ok {
+			t.Error("expected the writer to be a Hijacker")
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		rw.Flush()
+	}), 100*time.Millisecond))
+	server.Config.ConnContext = saveConn
+	server.Start()
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var body bytes.Buffer
+	body.ReadFrom(res.Body)
+	if body.String() != "hijacked" {
+		t.Fatalf("expected the hijacked connection's response but got %q", body.String())
+	}
+}
+
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write(bytes []byte) (int, error) {
+	return 0, errors.New("i/o timeout")
+}
+
+func TestProcessResults_stopsOnWriteError(t *testing.T) {
+	iter := &testIter{records: []map[string]interface{}{{"type": "cbg"}, {"type": "cbg"}, {"type": "cbg"}}}
+
+	processResults(failingWriter{httptest.NewRecorder()}, iter, resultOptions{emptyStatus: http.StatusOK}, time.Now())
+
+	if len(iter.records) != 2 {
+		t.Fatalf("expected reading to stop after the failed write but %d records are left", len(iter.records))
+	}
+}
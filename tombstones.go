@@ -0,0 +1,24 @@
+package main
+
+import (
+	"labix.org/v2/mgo/bson"
+)
+
+// tombstoneQuery builds the query for a group's tombstones, the records left behind when data is deleted
+// or an upload is cancelled. Tombstones keep the group, type, subType and time of the record they replace
+// but aren't versioned or marked active, so only those filters from the params apply
+func tombstoneQuery(p *params) (bson.M, error) {
+	query, err := generateMongoQuery(&params{
+		groupId:   p.groupId,
+		startDate: p.startDate,
+		endDate:   p.endDate,
+		types:     p.types,
+		subTypes:  p.subTypes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	delete(query, "_active")
+	delete(query, "_schemaVersion")
+	return query, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestTombstoneQuery(t *testing.T) {
+	tombstones := fakeCollection{
+		{"_groupId": "abc123", "type": "cbg", "time": "2015-10-10T15:00:00Z", "deletedTime": "2015-10-12T09:00:00Z", "uploadId": "u1"},
+		{"_groupId": "abc123", "type": "smbg", "time": "2015-10-10T16:00:00Z", "deletedTime": "2015-10-12T09:00:00Z", "uploadId": "u1"},
+		{"_groupId": "abc123", "type": "cbg", "time": "2015-10-01T15:00:00Z", "deletedTime": "2015-10-02T09:00:00Z", "uploadId": "u0"},
+		{"_groupId": "other", "type": "cbg", "time": "2015-10-10T15:00:00Z", "deletedTime": "2015-10-12T09:00:00Z", "uploadId": "u2"},
+	}
+
+	query, err := tombstoneQuery(&params{groupId: "abc123", types: "cbg", startDate: "2015-10-08T00:00:00.000Z", endDate: "2015-10-11T00:00:00.000Z", minSchemaVersion: 1, maxSchemaVersion: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedQuery := bson.M{
+		"_groupId": "abc123",
+		"type":     bson.M{"$in": []string{"cbg"}},
+		"time":     bson.M{"$gte": "2015-10-08T00:00:00Z", "$lte": "2015-10-11T00:00:00Z"},
+	}
+	if !reflect.DeepEqual(query, expectedQuery) {
+		t.Fatal(getErrString(query, expectedQuery))
+	}
+
+	res := httptest.NewRecorder()
+	processResults(res, tombstones.find(query), resultOptions{emptyStatus: http.StatusOK}, time.Now())
+
+	var found []map[string]interface{}
+	if err := json.Unmarshal(res.Body.Bytes(), &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || !reflect.DeepEqual(found[0], tombstones[0]) {
+		t.Fatalf("expected only the first tombstone but got %v", found)
+	}
+}
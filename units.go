@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+)
+
+// the canonical form of each known way of writing units, keyed in lower case
+var defaultUnitAliases = map[string]string{
+	"mmol/l": "mmol/L",
+	"mg/dl":  "mg/dL",
+}
+
+// newUnitNormalizer returns the processor that rewrites units to their canonical form e.g. mmol/l and
+// MMOL/L to mmol/L, so clients don't have to handle every variant devices have uploaded. The aliases
+// are added to the defaults, matching is case insensitive and unknown units are left as they are
+func newUnitNormalizer(aliases map[string]string) RecordProcessor {
+	canonical := map[string]string{}
+	for alias, units := range defaultUnitAliases {
+		canonical[alias] = units
+	}
+	for alias, units := range aliases {
+		canonical[strings.ToLower(alias)] = units
+	}
+
+	normalize := func(value interface{}) interface{} {
+		if units, ok := value.(string); ok {
+			if normalized, ok := canonical[strings.ToLower(units)]; ok {
+				return normalized
+			}
+		}
+		return value
+	}
+
+	return RecordProcessorFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		switch units := record["units"].(type) {
+		case string:
+			record["units"] = normalize(units)
+		//settings give units per measurement e.g. {"bg": "mg/dl", "carb": "grams"}
+		case map[string]interface{}:
+			for measurement, value := range units {
+				units[measurement] = normalize(value)
+			}
+		}
+		return record, nil
+	})
+}
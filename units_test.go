@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnitNormalizer(t *testing.T) {
+	normalizer := newUnitNormalizer(map[string]string{"MMOL": "mmol/L", "mgdl": "mg/dL"})
+
+	for units, expected := range map[string]string{
+		"mmol/L": "mmol/L",
+		"mmol/l": "mmol/L",
+		"MMOL/L": "mmol/L",
+		"mmol":   "mmol/L",
+		"mg/dL":  "mg/dL",
+		"mg/dl":  "mg/dL",
+		"MG/DL":  "mg/dL",
+		"mgdl":   "mg/dL",
+		"grams":  "grams",
+	} {
+		record, err := normalizer.Process(map[string]interface{}{"type": "cbg", "units": units})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record["units"] != expected {
+			t.Errorf("expected [%s] to normalize to [%s] but got [%v]", units, expected, record["units"])
+		}
+	}
+
+	record, err := normalizer.Process(map[string]interface{}{"type": "pumpSettings", "units": map[string]interface{}{"bg": "mg/dl", "carb": "grams"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]interface{}{"bg": "mg/dL", "carb": "grams"}; !reflect.DeepEqual(record["units"], expected) {
+		t.Fatalf("expected settings units %v but got %v", expected, record["units"])
+	}
+
+	//without configured aliases only the defaults apply
+	record, err = newUnitNormalizer(nil).Process(map[string]interface{}{"units": "mmol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record["units"] != "mmol" {
+		t.Fatalf("expected an unknown alias to be left alone but got %v", record["units"])
+	}
+}
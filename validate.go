@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dataRequest is a /{userID} request with all of its params parsed and checked
+type dataRequest struct {
+	params            *params
+	format            string
+	fields            []string
+	layout            string
+	columnarChunkSize int
+	pageSize          int
+	limit             int
+	offset            int
+	cursor            bool
+	interval          time.Duration
+	agg               string
+	sortKeys          []string
+	collapseBasals    bool
+	emptyStatus       int
+	batchSize         int
+	timezone          *time.Location
+	tz                *time.Location
+}
+
+// parseDataRequest reads and checks the params of a /{userID} request, so the same checks are made when a
+// request is only being validated as when it's run
+func parseDataRequest(q url.Values, accept string, config *Config) (*dataRequest, *detailedError) {
+	if paramsError := checkParams(q, dataParams, config.StrictParams); paramsError != nil {
+		return nil, paramsError
+	}
+
+	p, paramsError := getParams(q, config)
+	if paramsError != nil {
+		return nil, paramsError
+	}
+	r := &dataRequest{params: p}
+
+	//the client's params are wrong rather than anything on our side, so these are all 400s
+	reject := func(param string, must string, err error) (*dataRequest, *detailedError) {
+		paramError := invalidParam(param, q.Get(param), must)
+		paramError.InternalMessage = err.Error()
+		return nil, &paramError
+	}
+
+	var err error
+	if r.format, err = responseFormat(q.Get("format"), accept, config.DefaultFormat); err != nil {
+		return reject("format", "one of csv, json, ndjson or zip", err)
+	}
+
+	if r.fields, err = parseFields(q.Get("fields")); err != nil {
+		fieldsError := invalidParam("fields", q.Get("fields"), "comma separated names of fields that aren't internal")
+		fieldsError.InternalMessage = err.Error()
+		return nil, &fieldsError
+	}
+	if r.format == "csv" && q.Get("checksum") == "true" {
+		return reject("checksum", "left out with format=csv", fmt.Errorf("checksum can't be used with format=csv"))
+	}
+
+	r.layout = q.Get("layout")
+	if err := checkLayout(r.layout, p.types, r.format); err != nil {
+		return reject("layout", "rows, or columnar with a single type and format=json", err)
+	}
+	if r.layout == "columnar" {
+		r.columnarChunkSize = COLUMNAR_CHUNK_SIZE
+	}
+
+	if r.pageSize, err = getPageSize(q.Get("pageSize"), p.before); err != nil {
+		return reject("pageSize", "a positive number", err)
+	}
+	if maximum := maximumLimit(p.types, config.Limits.Maximum, config.Limits.TypeMaximums); maximum > 0 && r.pageSize > maximum {
+		r.pageSize = maximum
+	}
+
+	var ok bool
+	if r.limit, ok = getCount(q.Get("limit"), 1); !ok {
+		limitError := invalidParam("limit", q.Get("limit"), "a positive number")
+		return nil, &limitError
+	}
+	if r.offset, ok = getCount(q.Get("offset"), 0); !ok {
+		offsetError := invalidParam("offset", q.Get("offset"), "zero or a positive number")
+		return nil, &offsetError
+	}
+	if maximum := maximumLimit(p.types, config.Limits.Maximum, config.Limits.TypeMaximums); maximum > 0 && r.limit > maximum {
+		r.limit = maximum
+	}
+
+	if r.interval, r.agg, err = parseBucket(q.Get("bucket"), q.Get("agg"), p.types); err != nil {
+		if q.Get("bucket") != "" && q.Get("agg") != "" {
+			return reject("agg", "avg, min, max or last with a bucket", err)
+		}
+		return reject("bucket", "an interval of at least 1m e.g. 15m with a single type", err)
+	}
+	if r.interval > 0 && (r.format != "json" || r.layout == "columnar") {
+		return reject("bucket", "used with format=json and layout=rows", fmt.Errorf("bucket can only be used with format=json and layout=rows"))
+	}
+	if r.pageSize > 0 && (r.format == "zip" || r.interval > 0) {
+		param := "pageSize"
+		if q.Get(param) == "" {
+			param = "before"
+		}
+		return reject(param, "left out with format=zip or bucket", fmt.Errorf("pageSize and before can't be used with format=zip or bucket"))
+	}
+
+	sortFields := config.SortFields
+	if len(sortFields) == 0 {
+		sortFields = defaultSortFields
+	}
+	if r.sortKeys, err = parseSort(q.Get("sort"), sortFields); err != nil {
+		sortError := error_sort_not_allowed.setInternalMessage(err)
+		return nil, &sortError
+	}
+	if len(r.sortKeys) > 0 && (r.pageSize > 0 || r.format == "zip" || r.interval > 0) {
+		return reject("sort", "left out with pageSize, before, format=zip or bucket", fmt.Errorf("sort can't be used with pageSize, before, format=zip or bucket"))
+	}
+	if (r.limit > 0 || r.offset > 0) && (r.pageSize > 0 || r.format == "zip" || r.interval > 0) {
+		param := "limit"
+		if r.limit == 0 {
+			param = "offset"
+		}
+		return reject(param, "left out with pageSize, before, format=zip or bucket", fmt.Errorf("limit and offset can't be used with pageSize, before, format=zip or bucket"))
+	}
+	r.collapseBasals = q.Get("collapseBasals") == "true"
+	if r.collapseBasals && (len(r.sortKeys) > 0 || r.pageSize > 0 || r.limit > 0 || r.offset > 0 || r.format == "zip" || r.interval > 0) {
+		return reject("collapseBasals", "left out with sort, pageSize, before, limit, offset, format=zip or bucket", fmt.Errorf("collapseBasals can't be used with sort, pageSize, before, limit, offset, format=zip or bucket"))
+	}
+	if cursor := q.Get("cursor"); cursor != "" {
+		if len(r.sortKeys) > 0 || r.offset > 0 || r.pageSize > 0 || r.format == "zip" || r.interval > 0 || r.collapseBasals {
+			return reject("cursor", "left out with sort, offset, pageSize, before, format=zip, bucket or collapseBasals", fmt.Errorf("cursor can't be used with sort, offset, pageSize, before, format=zip, bucket or collapseBasals"))
+		}
+		if p.after, err = parseCursor(cursor); err != nil {
+			cursorError := invalidParam("cursor", cursor, "the "+CURSOR_TRAILER+" of a previous page")
+			return nil, &cursorError
+		}
+	}
+	//the cursor pages in time order, and needs the next page's position whether or not the first had one
+	r.cursor = (r.limit > 0 && r.offset == 0 && len(r.sortKeys) == 0) || p.after != nil
+
+	//without a sort mongo returns objects in whatever order it finds them, which can change between requests
+	if len(r.sortKeys) == 0 && r.pageSize == 0 && r.interval == 0 && r.format != "zip" && !r.collapseBasals {
+		r.sortKeys = []string{"time"}
+	}
+
+	if r.emptyStatus, err = getEmptyStatus(q.Get("emptyStatus")); err != nil {
+		return reject("emptyStatus", "200 or 204", err)
+	}
+	if r.batchSize, err = getBatchSize(q.Get("batchSize"), config.BatchSize.Default, config.BatchSize.Maximum); err != nil {
+		return reject("batchSize", "a positive number", err)
+	}
+
+	if timezone := q.Get("timezone"); timezone != "" {
+		if r.timezone, err = time.LoadLocation(timezone); err != nil {
+			return reject("timezone", TIME_ZONE_MUST, err)
+		}
+	}
+	if tz := q.Get("tz"); tz != "" {
+		if r.tz, err = time.LoadLocation(tz); err != nil {
+			return reject("tz", TIME_ZONE_MUST, err)
+		}
+	}
+
+	return r, nil
+}
+
+// the params of a dataRequest as they'll be used, returned by /{userID}/validate
+type normalizedRequest struct {
+	StartDate      string   `json:"startdate,omitempty"`
+	EndDate        string   `json:"enddate,omitempty"`
+	Types          []string `json:"type,omitempty"`
+	SubTypes       []string `json:"subtype,omitempty"`
+	DeviceIds      []string `json:"deviceId,omitempty"`
+	UploadIds      []string `json:"uploadId,omitempty"`
+	Before         string   `json:"before,omitempty"`
+	Times          []string `json:"times,omitempty"`
+	Format         string   `json:"format"`
+	Fields         []string `json:"fields,omitempty"`
+	Layout         string   `json:"layout"`
+	PageSize       int      `json:"pageSize,omitempty"`
+	Limit          int      `json:"limit,omitempty"`
+	Offset         int      `json:"offset,omitempty"`
+	Bucket         string   `json:"bucket,omitempty"`
+	Agg            string   `json:"agg,omitempty"`
+	Sort           []string `json:"sort,omitempty"`
+	CollapseBasals bool     `json:"collapseBasals,omitempty"`
+	EmptyStatus    int      `json:"emptyStatus"`
+	BatchSize      int      `json:"batchSize,omitempty"`
+	Timezone       string   `json:"timezone,omitempty"`
+	Tz             string   `json:"tz,omitempty"`
+}
+
+func (r *dataRequest) normalized() normalizedRequest {
+	list := func(values string) []string {
+		if values == "" {
+			return nil
+		}
+		return strings.Split(values, ",")
+	}
+	zone := func(location *time.Location) string {
+		if location == nil {
+			return ""
+		}
+		return location.String()
+	}
+
+	normalized := normalizedRequest{
+		StartDate:      r.params.startDate,
+		EndDate:        r.params.endDate,
+		Types:          list(r.params.types),
+		SubTypes:       list(r.params.subTypes),
+		DeviceIds:      list(r.params.deviceIds),
+		UploadIds:      list(r.params.uploadIds),
+		Before:         r.params.before,
+		Times:          list(r.params.times),
+		Format:         r.format,
+		Fields:         r.fields,
+		Layout:         r.layout,
+		PageSize:       r.pageSize,
+		Limit:          r.limit,
+		Offset:         r.offset,
+		Agg:            r.agg,
+		Sort:           r.sortKeys,
+		CollapseBasals: r.collapseBasals,
+		EmptyStatus:    r.emptyStatus,
+		BatchSize:      r.batchSize,
+		Timezone:       zone(r.timezone),
+		Tz:             zone(r.tz),
+	}
+	if normalized.Layout == "" {
+		normalized.Layout = "rows"
+	}
+	if r.interval > 0 {
+		normalized.Bucket = r.interval.String()
+	}
+	return normalized
+}
+
+// the body of a /{userID}/validate response
+type validation struct {
+	Valid  bool               `json:"valid"`
+	Params *normalizedRequest `json:"params,omitempty"`
+	//why the request would be slow, it's valid regardless
+	Warnings []string    `json:"warnings,omitempty"`
+	Error    *fieldError `json:"error,omitempty"`
+}
+
+// fieldError is a params detailedError with the reason the params were rejected, which a validation is
+// asking for so it isn't kept back as it is from the data endpoints
+type fieldError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// authorizer checks the requester can view userToView's data, writing the error if not, and returns the
+// group id to query. It is getGroupId in main
+type authorizer func(res http.ResponseWriter, req *http.Request, userToView string, p *params, serverOnly bool, start time.Time) (string, bool)
+
+// validateHandler runs the same parsing and checks as /{userID} but returns the params as they'd be used
+// rather than querying mongo
+func validateHandler(config *Config, authorize authorizer) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		userToView := req.URL.Query().Get(":userID")
+
+		r, paramsError := parseDataRequest(req.URL.Query(), req.Header.Get("Accept"), config)
+		if paramsError == nil {
+			groupId, ok := authorize(res, req, userToView, r.params, req.URL.Query().Get("hint") != "", start)
+			if !ok {
+				return
+			}
+			r.params.groupId = groupId
+			if _, err := generateMongoQuery(r.params); err != nil {
+				queryError := error_incorrect_params.setInternalMessage(err)
+				paramsError = &queryError
+			}
+		}
+
+		result := validation{Valid: paramsError == nil}
+		status := http.StatusOK
+		if paramsError != nil {
+			localized := paramsError.localize(res)
+			result.Error = &fieldError{Code: localized.Code, Message: localized.Message, Detail: localized.InternalMessage}
+			status = http.StatusBadRequest
+			log.Println(DATA_API_PREFIX, fmt.Sprintf("validate of [%s] failed after [%.5f]secs with error [%s][%s]", userToView, time.Now().Sub(start).Seconds(), localized.Code, localized.InternalMessage))
+		} else {
+			normalized := r.normalized()
+			result.Params = &normalized
+			result.Warnings = queryWarnings(r, config.HighVolumeTypes)
+			addWarnings(res, result.Warnings)
+		}
+
+		bytes, err := json.Marshal(result)
+		if err != nil {
+			jsonError(res, error_loading_events.setInternalMessage(err), start)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(status)
+		res.Write(bytes)
+	})
+}
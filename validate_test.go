@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func allowAll(res http.ResponseWriter, req *http.Request, userToView string, p *params, serverOnly bool, start time.Time) (string, bool) {
+	return "group-" + userToView, true
+}
+
+func validate(t *testing.T, handler http.Handler, query string) (int, validation) {
+	req := httptest.NewRequest("GET", "/abc123/validate?:userID=abc123&"+query, nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	var body validation
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected a validation for [%s] but got %s", query, res.Body.String())
+	}
+	return res.Code, body
+}
+
+func TestValidate_valid(t *testing.T) {
+	handler := validateHandler(&Config{}, allowAll)
+
+	status, body := validate(t, handler, "type=cbg,smbg&startdate=2015-10-01T00:00:00Z&sort=-deviceTime&tz=Europe/Paris")
+	if status != http.StatusOK || !body.Valid || body.Error != nil || body.Params == nil {
+		t.Fatalf("expected the params to be valid but got %d %+v", status, body)
+	}
+	params := body.Params
+	if params.StartDate != "2015-10-01T00:00:00Z" || len(params.Types) != 2 || params.Types[1] != "smbg" {
+		t.Errorf("unexpected dates or types %+v", params)
+	}
+	if params.Format != "json" || params.Layout != "rows" || len(params.Sort) != 1 || params.Sort[0] != "-deviceTime" || params.Tz != "Europe/Paris" {
+		t.Errorf("unexpected normalized params %+v", params)
+	}
+
+	if len(body.Warnings) != 1 || !strings.HasPrefix(body.Warnings[0], "sorting by deviceTime") {
+		t.Errorf("expected a warning about the sort but got %v", body.Warnings)
+	}
+
+	status, body = validate(t, handler, "type=cbg&bucket=1h&agg=max")
+	if status != http.StatusOK || body.Params == nil || body.Params.Bucket != "1h0m0s" || body.Params.Agg != "max" {
+		t.Errorf("expected the bucket to be normalized but got %d %+v", status, body.Params)
+	}
+}
+
+func TestValidate_invalid(t *testing.T) {
+	handler := validateHandler(&Config{}, allowAll)
+
+	for query, code := range map[string]string{
+		"startdate=yesterday":            error_invalid_date.Code,
+		"sort=value":                     error_sort_not_allowed.Code,
+		"format=pdf":                     error_invalid_param.Code,
+		"tz=Mars/Olympus":                error_invalid_param.Code,
+		"pageSize=100&format=zip":        error_invalid_param.Code,
+		"collapseBasals=true&sort=-time": error_invalid_param.Code,
+	} {
+		status, body := validate(t, handler, query)
+		if status != http.StatusBadRequest || body.Valid || body.Params != nil || body.Error == nil {
+			t.Errorf("expected [%s] to be rejected but got %d %+v", query, status, body)
+			continue
+		}
+		if body.Error.Code != code || body.Error.Message == "" {
+			t.Errorf("expected [%s] to fail with %s but got %+v", query, code, body.Error)
+		}
+		if code == error_invalid_param.Code && body.Error.Detail == "" {
+			t.Errorf("expected [%s] to say why it was rejected", query)
+		}
+	}
+}
+
+func TestParseDataRequest_clientErrors(t *testing.T) {
+	for _, query := range []string{
+		"emptyStatus=abc",
+		"batchSize=lots",
+		"settings=rate",
+		"typeSubtype=:normal",
+		"exists=value:maybe",
+		"search=site",
+		"layout=grid",
+		"layout=columnar&type=cbg,smbg",
+		"bucket=soon&type=cbg",
+		"bucket=15m&agg=median&type=cbg",
+		"format=pdf",
+		"timezone=Mars/Olympus",
+		"tz=Mars/Olympus",
+		"sort=-time&pageSize=10",
+		"limit=10&format=zip",
+		"before=2015-10-10T00:00:00Z&format=zip",
+		"cursor=abc&sort=-time",
+		"collapseBasals=true&limit=10",
+		"checksum=true&format=csv",
+	} {
+		q, _ := url.ParseQuery(query)
+		_, paramsError := parseDataRequest(q, "", &Config{})
+		if paramsError == nil || paramsError.Status != http.StatusBadRequest || paramsError.Code != error_invalid_param.Code {
+			t.Errorf("expected [%s] to be a 400 invalid_param but got %+v", query, paramsError)
+			continue
+		}
+		if param := strings.Split(paramsError.Message, " ")[0]; q.Get(param) == "" && param != "before" {
+			t.Errorf("expected [%s] to name a param it was given but got [%s]", query, paramsError.Message)
+		}
+	}
+}
+
+func TestValidate_notAllowed(t *testing.T) {
+	authorized := false
+	handler := validateHandler(&Config{}, func(res http.ResponseWriter, req *http.Request, userToView string, p *params, serverOnly bool, start time.Time) (string, bool) {
+		authorized = true
+		jsonError(res, error_no_view_permisson, start)
+		return "", false
+	})
+
+	req := httptest.NewRequest("GET", "/abc123/validate?:userID=abc123&type=cbg", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if !authorized || !strings.Contains(res.Body.String(), error_no_view_permisson.Code) {
+		t.Errorf("expected the permission error but got %s", res.Body.String())
+	}
+}
+
+func TestParseDataRequest_limitOffset(t *testing.T) {
+	config := &Config{}
+	config.Limits.Maximum = 1000
+
+	r, paramsError := parseDataRequest(url.Values{"limit": {"500"}, "offset": {"1500"}}, "", config)
+	if paramsError != nil || r.limit != 500 || r.offset != 1500 {
+		t.Fatalf("expected limit 500 and offset 1500 but got %+v %v", r, paramsError)
+	}
+	if r, paramsError = parseDataRequest(url.Values{"limit": {"5000"}}, "", config); paramsError != nil || r.limit != 1000 {
+		t.Fatalf("expected the limit to be capped at 1000 but got %+v %v", r, paramsError)
+	}
+	if r, paramsError = parseDataRequest(url.Values{}, "", config); paramsError != nil || r.limit != 0 || r.offset != 0 {
+		t.Fatalf("expected no limit by default but got %+v %v", r, paramsError)
+	}
+
+	for _, bad := range []url.Values{
+		{"limit": {"-1"}},
+		{"limit": {"0"}},
+		{"offset": {"-10"}},
+		{"offset": {"x"}},
+	} {
+		_, paramsError := parseDataRequest(bad, "", config)
+		if paramsError == nil || paramsError.Code != error_invalid_param.Code || paramsError.Status != http.StatusBadRequest {
+			t.Errorf("expected %v to be rejected but got %v", bad, paramsError)
+			continue
+		}
+		for param := range bad {
+			if !strings.HasPrefix(paramsError.Message, param+" must be") {
+				t.Errorf("expected the message to name %s but got [%s]", param, paramsError.Message)
+			}
+		}
+	}
+
+	if _, paramsError := parseDataRequest(url.Values{"limit": {"10"}, "pageSize": {"10"}}, "", config); paramsError == nil {
+		t.Error("expected limit to be rejected with pageSize")
+	}
+}
+
+func TestParseDataRequest_defaultSort(t *testing.T) {
+	tests := []struct {
+		query    url.Values
+		expected string
+	}{
+		{query: url.Values{}, expected: "time"},
+		{query: url.Values{"sort": {"-deviceTime"}}, expected: "-deviceTime"},
+		{query: url.Values{"sort": {"-time"}}, expected: "-time"},
+		{query: url.Values{"pageSize": {"10"}}, expected: ""},
+		{query: url.Values{"format": {"zip"}}, expected: ""},
+		{query: url.Values{"collapseBasals": {"true"}}, expected: ""},
+		{query: url.Values{"type": {"cbg"}, "bucket": {"1h"}}, expected: ""},
+	}
+	for _, test := range tests {
+		r, paramsError := parseDataRequest(test.query, "", &Config{})
+		if paramsError != nil {
+			t.Fatalf("%v: %v", test.query, paramsError)
+		}
+		if sort := strings.Join(r.sortKeys, ","); sort != test.expected {
+			t.Errorf("%v: expected sort [%s] but got [%s]", test.query, test.expected, sort)
+		}
+	}
+
+	if _, paramsError := parseDataRequest(url.Values{"sort": {"value"}}, "", &Config{}); paramsError == nil || paramsError.Status != http.StatusBadRequest {
+		t.Errorf("expected a sort on another field to be a 400 but got %v", paramsError)
+	}
+}
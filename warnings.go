@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// the types with enough objects that reading them without a startdate is slow, used when highVolumeTypes
+// isn't configured
+var defaultHighVolumeTypes = []string{"cbg"}
+
+// skipping more than this many objects reads each of them, so deeper pages are warned about
+const SLOW_OFFSET = 10000
+
+// queryWarnings lists what is likely to make the request slow, worked out from its params before it is run.
+// None of them stop the request, they're for client developers to learn from
+func queryWarnings(r *dataRequest, highVolumeTypes []string) []string {
+	if len(highVolumeTypes) == 0 {
+		highVolumeTypes = defaultHighVolumeTypes
+	}
+
+	warnings := []string{}
+	if r.params.startDate == "" {
+		if r.params.types == "" {
+			warnings = append(warnings, "no type or startdate so all of the user's objects are read, give a startdate")
+		} else if highVolume := windowRequired(r.params.types, highVolumeTypes); highVolume != "" {
+			warnings = append(warnings, fmt.Sprintf("no startdate for %s so all of the user's %s objects are read, give a startdate", highVolume, highVolume))
+		}
+	}
+	for _, key := range r.sortKeys {
+		if field := strings.TrimPrefix(key, "-"); !indexed(field) {
+			warnings = append(warnings, fmt.Sprintf("sorting by %s isn't helped by an index so all the objects are sorted in memory", field))
+		}
+	}
+	if r.offset > SLOW_OFFSET {
+		warnings = append(warnings, fmt.Sprintf("an offset of %d reads every object skipped, narrow the dates instead", r.offset))
+	}
+	return warnings
+}
+
+// indexed reports whether one of the indexes the queries are written for has the field
+func indexed(field string) bool {
+	for _, index := range allIndexes() {
+		for _, key := range index.Key {
+			if strings.TrimPrefix(key, "-") == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addWarnings sends each warning in a Warning header, with the 199 miscellaneous warning code
+func addWarnings(res http.ResponseWriter, warnings []string) {
+	for _, warning := range warnings {
+		res.Header().Add("Warning", fmt.Sprintf("199 tide-whisperer %q", warning))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestQueryWarnings(t *testing.T) {
+	tests := []struct {
+		query    url.Values
+		warnings []string
+	}{
+		{query: url.Values{"type": {"cbg"}, "startdate": {"2015-10-01T00:00:00Z"}}},
+		{query: url.Values{"type": {"smbg,bolus"}}},
+		{query: url.Values{"type": {"cbg"}, "startdate": {"2015-10-01T00:00:00Z"}, "limit": {"100"}, "offset": {"500"}}},
+		{query: url.Values{}, warnings: []string{"no type or startdate"}},
+		{query: url.Values{"type": {"smbg,cbg"}}, warnings: []string{"no startdate for cbg"}},
+		{query: url.Values{"type": {"cbg"}, "startdate": {"2015-10-01T00:00:00Z"}, "sort": {"-deviceTime"}}, warnings: []string{"sorting by deviceTime"}},
+		{query: url.Values{"type": {"cbg"}, "startdate": {"2015-10-01T00:00:00Z"}, "limit": {"100"}, "offset": {"20000"}}, warnings: []string{"an offset of 20000"}},
+	}
+	for _, test := range tests {
+		r, paramsError := parseDataRequest(test.query, "", &Config{})
+		if paramsError != nil {
+			t.Fatalf("%v: %v", test.query, paramsError)
+		}
+		warnings := queryWarnings(r, nil)
+		if len(warnings) != len(test.warnings) {
+			t.Errorf("%v: expected %d warnings but got %v", test.query, len(test.warnings), warnings)
+			continue
+		}
+		for i, warning := range warnings {
+			if !strings.HasPrefix(warning, test.warnings[i]) {
+				t.Errorf("%v: expected a warning starting [%s] but got [%s]", test.query, test.warnings[i], warning)
+			}
+		}
+	}
+
+	r, _ := parseDataRequest(url.Values{"type": {"basal"}}, "", &Config{})
+	if warnings := queryWarnings(r, []string{"basal"}); len(warnings) != 1 {
+		t.Errorf("expected the configured high volume types to be warned about but got %v", warnings)
+	}
+}
+
+func TestAddWarnings(t *testing.T) {
+	res := httptest.NewRecorder()
+	addWarnings(res, []string{"first", "a \"quoted\" one"})
+	if headers := res.Header()["Warning"]; len(headers) != 2 || headers[0] != `199 tide-whisperer "first"` || headers[1] != `199 tide-whisperer "a \"quoted\" one"` {
+		t.Errorf("unexpected warning headers %v", headers)
+	}
+}
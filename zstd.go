@@ -0,0 +1,103 @@
+//go:build zstd
+// +build zstd
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	httpgzip "github.com/daaku/go.httpgzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// newCompressor returns the wrapper that compresses data responses. Clients sending
+// Accept-Encoding: zstd get zstd, using the configured zstdDictionary when there is one, and
+// everyone else gets gzip
+func newCompressor(config *Config) (func(http.Handler) http.Handler, error) {
+	var dict []byte
+	if config.ZstdDictionary != "" {
+		var err error
+		if dict, err = ioutil.ReadFile(config.ZstdDictionary); err != nil {
+			return nil, err
+		}
+	}
+	return func(h http.Handler) http.Handler {
+		return newZstdHandler(h, dict)
+	}, nil
+}
+
+func newZstdHandler(h http.Handler, dict []byte) http.Handler {
+	gzipped := httpgzip.NewHandler(h)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !acceptsZstd(req.Header.Get("Accept-Encoding")) {
+			gzipped.ServeHTTP(res, req)
+			return
+		}
+		res.Header().Add("Vary", "Accept-Encoding")
+		zstdRes := &zstdResponseWriter{ResponseWriter: res, dict: dict}
+		defer zstdRes.close()
+		h.ServeHTTP(zstdRes, req)
+	})
+}
+
+// acceptsZstd reports whether an Accept-Encoding header lists zstd without q=0
+func acceptsZstd(acceptEncoding string) bool {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(encoding, ";")
+		if strings.TrimSpace(parts[0]) != "zstd" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if q := strings.Replace(param, " ", "", -1); q == "q=0" || q == "q=0.0" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// zstdResponseWriter compresses the body as it is written. The encoder is only started by the
+// first write so bodiless responses (e.g. 204) stay empty
+type zstdResponseWriter struct {
+	http.ResponseWriter
+	dict    []byte
+	encoder *zstd.Encoder
+}
+
+func (w *zstdResponseWriter) setEncodingHeaders() {
+	w.Header().Set("Content-Encoding", "zstd")
+	w.Header().Del("Content-Length")
+}
+
+func (w *zstdResponseWriter) WriteHeader(status int) {
+	if status != http.StatusNoContent && status != http.StatusNotModified {
+		w.setEncodingHeaders()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *zstdResponseWriter) Write(b []byte) (int, error) {
+	if w.encoder == nil {
+		w.setEncodingHeaders()
+		opts := []zstd.EOption{}
+		if w.dict != nil {
+			opts = append(opts, zstd.WithEncoderDict(w.dict))
+		}
+		encoder, err := zstd.NewWriter(w.ResponseWriter, opts...)
+		if err != nil {
+			return 0, err
+		}
+		w.encoder = encoder
+	}
+	return w.encoder.Write(b)
+}
+
+func (w *zstdResponseWriter) close() error {
+	if w.encoder == nil {
+		return nil
+	}
+	return w.encoder.Close()
+}
@@ -0,0 +1,71 @@
+//go:build zstd
+// +build zstd
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestZstdHandler_roundTrip(t *testing.T) {
+	records := []map[string]interface{}{
+		{"type": "cbg", "units": "mmol/L", "value": 5.5, "time": "2015-10-08T15:00:00Z"},
+		{"type": "cbg", "units": "mmol/L", "value": 5.6, "time": "2015-10-08T15:05:00Z"},
+		{"type": "cbg", "units": "mmol/L", "value": 5.8, "time": "2015-10-08T15:10:00Z"},
+	}
+	handler := newZstdHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		served := make([]map[string]interface{}, len(records))
+		copy(served, records)
+		processResults(res, &testIter{records: served}, resultOptions{emptyStatus: http.StatusOK}, time.Now())
+	}), nil)
+
+	req := httptest.NewRequest("GET", "/abc123", nil)
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	if res.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatalf("expected zstd encoding but got [%s]", res.Header().Get("Content-Encoding"))
+	}
+
+	decoder, err := zstd.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	body, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, records) {
+		t.Fatalf("expected %v but got %v", records, decoded)
+	}
+}
+
+func TestAcceptsZstd(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                 false,
+		"gzip":             false,
+		"zstd":             true,
+		"gzip, zstd;q=0.9": true,
+		"gzip, zstd;q=0":   false,
+		"zstdx":            false,
+	} {
+		if acceptsZstd(header) != expected {
+			t.Fatalf("expected %v for Accept-Encoding [%s]", expected, header)
+		}
+	}
+}